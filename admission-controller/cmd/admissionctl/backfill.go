@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"admissioncontroller/utils"
+)
+
+// runBackfill copies ADMISSION_TABLE into the events table. The server doesn't do it at startup because
+// the copy reads the whole old table
+func runBackfill(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	dsn := fs.String("clickhouse", "", "ClickHouse database with ADMISSION_TABLE, e.g. clickhouse://user@host:9000/default. The password may come from CLICKHOUSE_PASSWORD")
+	table := fs.String("table", "admission_events", "ClickHouse events table, created by the server")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, "Usage: admissionctl backfill -clickhouse <dsn> [flags]\n\n"+
+			"Copies month by month and skips rows copied before, so it may be run again after a failure.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsageErr
+	}
+	if *dsn == "" {
+		fmt.Fprintln(stderr, "no database, use -clickhouse")
+		return exitUsageErr
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := backfillClickHouse(ctx, *dsn, *table, stdout); err != nil {
+		fmt.Fprintf(stderr, "backfill failed: %v\n", err)
+		return exitUsageErr
+	}
+	return exitOK
+}
+
+func backfillClickHouse(ctx context.Context, dsn, table string, stdout io.Writer) error {
+	dataSource, err := clickHouseDSN(dsn)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("clickhouse", dataSource)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.PingContext(ctx); err != nil {
+		return err
+	}
+
+	copied := 0
+	err = utils.BackfillClickHouse(ctx, db, table, func(month uint32) {
+		copied++
+		fmt.Fprintf(stdout, "Copied %d\n", month)
+	})
+	fmt.Fprintf(stdout, "%d months copied into %s\n", copied, table)
+	return err
+}
@@ -0,0 +1,76 @@
+// admissionctl runs the admission checks outside of the webhook
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	_ "github.com/ClickHouse/clickhouse-go/v2"
+
+	"admissioncontroller/utils"
+)
+
+// Exit codes
+const (
+	exitOK       = 0
+	exitDenied   = 1 // At least one object would be denied, or a replayed request newly denied
+	exitUsageErr = 2 // Invalid arguments or unreadable manifests
+)
+
+const usage = `Usage: admissionctl <command> [flags]
+
+Commands:
+  validate   Check manifests against the admission checks, e.g. in CI before deploying
+  replay     Re-evaluate stored admission requests with the checks of this build and show what changes
+  backfill   Copy the history of the old ADMISSION_TABLE into the events table, once after the upgrade
+
+Run admissionctl <command> -h for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(exitUsageErr)
+	}
+
+	// The checks log every decision in JSON, which is of no use on a terminal or in CI
+	utils.Log.SetOutput(io.Discard)
+
+	switch os.Args[1] {
+	case "validate":
+		os.Exit(runValidate(os.Args[2:], os.Stdout, os.Stderr))
+	case "replay":
+		os.Exit(runReplay(os.Args[2:], os.Stdout, os.Stderr))
+	case "backfill":
+		os.Exit(runBackfill(os.Args[2:], os.Stdout, os.Stderr))
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(exitUsageErr)
+	}
+}
+
+// stringList is a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string { return fmt.Sprint(*l) }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// clickHouseDSN adds the password from CLICKHOUSE_PASSWORD to a DSN without one
+func clickHouseDSN(dsn string) (string, error) {
+	dataSource, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := dataSource.User.Password(); !ok && os.Getenv("CLICKHOUSE_PASSWORD") != "" {
+		dataSource.User = url.UserPassword(dataSource.User.Username(), os.Getenv("CLICKHOUSE_PASSWORD"))
+	}
+	return dataSource.String(), nil
+}
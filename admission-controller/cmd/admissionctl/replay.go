@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+
+	"admissioncontroller/evaluate"
+	"admissioncontroller/utils"
+	"admissioncontroller/validation"
+)
+
+// replayFilter selects the stored requests to replay
+type replayFilter struct {
+	namespace, kind, user string
+	since                 time.Time
+}
+
+func (f replayFilter) matches(r evaluate.Recorded) bool {
+	return (f.namespace == "" || r.Request.Namespace == f.namespace) &&
+		(f.kind == "" || r.Request.Kind.Kind == f.kind) &&
+		(f.user == "" || r.User() == f.user || r.Request.UserInfo.Username == f.user) &&
+		(r.Time.IsZero() || !r.Time.Before(f.since))
+}
+
+// runReplay runs stored requests through the checks of this build with enforcement on and reports
+// the requests whose decision would change
+func runReplay(args []string, stdout, stderr io.Writer) int {
+	var files stringList
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Var(&files, "f", "JSONL file with audit events (the file audit sink) or AdmissionReviews with responses. Repeatable, - reads stdin")
+	dsn := fs.String("clickhouse", "", "Read audit events from ClickHouse, e.g. clickhouse://user@host:9000/default. The password may come from CLICKHOUSE_PASSWORD")
+	table := fs.String("table", "admission_events", "ClickHouse events table")
+	since := fs.Duration("since", 7*24*time.Hour, "Replay requests of this period")
+	format := fs.String("o", evaluate.DiffText, "Diff format: text or json")
+	var filter replayFilter
+	fs.StringVar(&filter.namespace, "n", "", "Only requests in this namespace")
+	fs.StringVar(&filter.kind, "kind", "", "Only requests for this kind")
+	fs.StringVar(&filter.user, "user", "", "Only requests of this user name or ID")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, "Usage: admissionctl replay (-f <file|-> | -clickhouse <dsn>) [flags]\n\n"+
+			"Stored requests need object snapshots (AUDIT_SNAPSHOT=denied with a sample rate for allowed requests).\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsageErr
+	}
+	if len(files) == 0 && *dsn == "" {
+		fmt.Fprintln(stderr, "no stored requests, use -f or -clickhouse")
+		return exitUsageErr
+	}
+	if *format != evaluate.DiffText && *format != evaluate.DiffJSON {
+		fmt.Fprintf(stderr, "unknown diff format %q, expected %s or %s\n", *format, evaluate.DiffText, evaluate.DiffJSON)
+		return exitUsageErr
+	}
+	filter.since = time.Now().Add(-*since)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	hook := validation.NewValidationHook(func() bool { return false })
+	diff := evaluate.NewDiff()
+	replay := func(record evaluate.Recorded, err error) error {
+		switch {
+		case err != nil:
+			diff.Skip(err)
+		case filter.matches(record):
+			diff.Add(evaluate.Replay(ctx, hook, record))
+		}
+		return ctx.Err()
+	}
+
+	for _, file := range files {
+		if err := replayFile(file, replay); err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsageErr
+		}
+	}
+	if *dsn != "" {
+		if err := replayClickHouse(ctx, *dsn, *table, filter, replay); err != nil {
+			fmt.Fprintf(stderr, "failed to read ClickHouse: %v\n", err)
+			return exitUsageErr
+		}
+	}
+
+	if err := evaluate.WriteDiff(stdout, *format, diff); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsageErr
+	}
+	if diff.Count(evaluate.ChangeNewlyDenied) > 0 {
+		return exitDenied
+	}
+	return exitOK
+}
+
+func replayFile(file string, fn func(evaluate.Recorded, error) error) error {
+	if file == "-" {
+		return evaluate.ReadRecords(os.Stdin, file, fn)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return evaluate.ReadRecords(f, file, fn)
+}
+
+func replayClickHouse(ctx context.Context, dsn, table string, filter replayFilter, fn func(evaluate.Recorded, error) error) error {
+	dataSource, err := clickHouseDSN(dsn)
+	if err != nil {
+		return err
+	}
+	store, err := utils.OpenClickHouseEventStore(ctx, dataSource, table)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	eventFilter := utils.EventFilter{Namespace: filter.namespace, Kind: filter.kind, User: filter.user, From: filter.since}
+	return store.Snapshots(ctx, eventFilter, func(event utils.AuditEvent) error {
+		return fn(evaluate.RecordFromEvent(event, event.RequestID))
+	})
+}
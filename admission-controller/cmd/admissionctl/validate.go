@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"admissioncontroller/evaluate"
+	"admissioncontroller/validation"
+
+	v1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+// runValidate runs manifests through the validation hook with enforcement on, as the webhook would
+// without observer mode. Objects of kinds the webhook doesn't receive are skipped
+func runValidate(args []string, stdout, stderr io.Writer) int {
+	var files stringList
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Var(&files, "f", "Manifest file or directory, walked recursively for *.yaml, *.yml and *.json. Repeatable, - reads stdin")
+	format := fs.String("o", evaluate.FormatText, "Report format: text, junit or sarif")
+	namespace := fs.String("n", "default", "Namespace of objects which don't set one, as with helm template without --namespace")
+	operation := fs.String("operation", string(v1.Create), "Simulated operation: CREATE or UPDATE")
+	user := fs.String("user", "admissionctl", "Simulated user name")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: admissionctl validate -f <file|dir|-> [flags]\n\nChecked kinds: %s\n\n", strings.Join(validation.ValidatedKinds, ", "))
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsageErr
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(stderr, "no manifests, use -f")
+		return exitUsageErr
+	}
+	op := v1.Operation(strings.ToUpper(*operation))
+	if op != v1.Create && op != v1.Update {
+		fmt.Fprintf(stderr, "unknown operation %q, expected CREATE or UPDATE\n", *operation)
+		return exitUsageErr
+	}
+
+	manifests, err := evaluate.ReadManifests(files)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to read manifests: %v\n", err)
+		return exitUsageErr
+	}
+
+	hook := validation.NewValidationHook(func() bool { return false })
+	results := evaluate.Evaluate(context.Background(), hook, manifests, evaluate.Options{
+		Operation: op,
+		Namespace: *namespace,
+		UserInfo:  authenticationv1.UserInfo{Username: *user},
+	})
+	if err := evaluate.WriteReport(stdout, *format, results); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsageErr
+	}
+	for _, r := range results {
+		if r.Denied() {
+			return exitDenied
+		}
+	}
+	return exitOK
+}
@@ -3,90 +3,222 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	nethttp "net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	_ "github.com/ClickHouse/clickhouse-go"
+	_ "github.com/ClickHouse/clickhouse-go/v2"
 
+	"admissioncontroller/config"
 	"admissioncontroller/http"
+	"admissioncontroller/scan"
 	"admissioncontroller/utils"
+	"admissioncontroller/validation"
 
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	log "k8s.io/klog/v2"
 )
 
-var (
-	tlscert, tlskey, port, metricsPort, k8sID string
-)
+var draining atomic.Bool // Set on SIGTERM, fails readiness
 
 func main() {
+	cfg, err := config.Load(os.Args[1:], os.LookupEnv)
+	if err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
-	tlscert = getEnv("TLS_CERT_PATH", "/etc/certs/tls.crt")
-	tlskey = getEnv("TLS_KEY_PATH", "/etc/certs/tls.key")
-	port = getEnv("SERVER_PORT", "8443")
-	metricsPort = getEnv("METRICS_PORT", "9090")
-	k8sID = getEnv("K8S_ID", "default-cluster")
-
-	flag.StringVar(&tlscert, "tlscert", tlscert, "Path to the TLS certificate")
-	flag.StringVar(&tlskey, "tlskey", tlskey, "Path to the TLS key")
-	flag.StringVar(&port, "port", port, "The port for validation endpoint")
-	flag.StringVar(&metricsPort, "metrics-port", metricsPort, "The port for Prometheus metrics")
-	flag.StringVar(&k8sID, "k8s-id", k8sID, "K8S Cluster ID")
-	flag.Parse()
-
-	utils.SetK8SId(k8sID) // Global K8S_ID
+	utils.SetK8SId(cfg.K8sID) // Global K8S_ID
+	buckets := utils.DefaultLatencyBuckets
+	if len(cfg.Metrics.LatencyBuckets) > 0 {
+		buckets = cfg.Metrics.LatencyBuckets
+	}
+	if err := utils.SetLatencyBuckets(buckets, cfg.Metrics.NativeHistograms); err != nil {
+		log.Fatalf("Invalid latency buckets: %v", err)
+	}
+	if err := applyReloadable(cfg); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	logConfig("Effective configuration", cfg)
+	live := config.NewLive(cfg, func() (config.Config, error) {
+		return config.Load(os.Args[1:], os.LookupEnv)
+	}, applyReloadable)
+	utils.ConnectAuditSinks(cfg)
+
+	if err := utils.SetCertExpiryThresholds(time.Duration(cfg.CertExpiry.WarningDays)*24*time.Hour, time.Duration(cfg.CertExpiry.CriticalDays)*24*time.Hour); err != nil {
+		log.Fatalf("Invalid certificate expiry thresholds: %v", err)
+	}
+	if err := utils.SetCertExpiryGate(cfg.CertExpiry.Gate); err != nil {
+		log.Fatalf("Invalid certificate expiry gate: %v", err)
+	}
 
-	utils.UpdateCertExpiryMetric(tlscert)
+	tlscert, tlskey, tlsca := cfg.TLS.CertPath, cfg.TLS.KeyPath, cfg.TLS.CAPath
+	utils.UpdateCertExpiryMetric(tlscert, tlsca)
+	servingCert, err := utils.NewServingCert(tlscert, tlskey)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificate: %v", err)
+	}
+	utils.RegisterReadinessCheck("tls", servingCert.Ready)
+	utils.RegisterReadinessCheck("config", live.Ready)
+	utils.RegisterReadinessCheck("shutdown", func() error {
+		if draining.Load() {
+			return fmt.Errorf("shutting down")
+		}
+		return nil
+	})
 
 	// Запускаем таймер для регулярного обновления метрики
-	ticker := time.NewTicker(24 * time.Hour) // Обновляем раз в день
+	ticker := time.NewTicker(cfg.CertExpiry.CheckInterval.D())
 	defer ticker.Stop()
 
 	go func() {
 		for range ticker.C {
 			utils.DebugLog("Scheduled check for TLS certificate expiry")
-			utils.UpdateCertExpiryMetric(tlscert)
+			if err := servingCert.Reload(); err != nil {
+				utils.ErrorLog("Keeping the served TLS certificate: %v", err)
+			}
+			utils.UpdateCertExpiryMetric(tlscert, tlsca)
 		}
 	}()
 
 	// Validation server start
-	server := http.NewServer(port)
+	server, err := http.NewServer(http.ServerConfig{
+		Port:              cfg.Server.Port,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout.D(),
+		ReadTimeout:       cfg.Server.ReadTimeout.D(),
+		WriteTimeout:      cfg.Server.WriteTimeout.D(),
+		IdleTimeout:       cfg.Server.IdleTimeout.D(),
+		MaxBodyBytes:      int64(cfg.Server.MaxRequestBodyMB) << 20,
+		TLSMinVersion:     cfg.TLS.MinVersion,
+		TLSCipherSuites:   cfg.TLS.CipherSuites,
+		ClientCAPath:      cfg.TLS.ClientCAPath,
+		AdmissionTimeout:  cfg.Server.AdmissionTimeout.D(),
+		TimeoutPolicy:     cfg.Server.TimeoutPolicy,
+		ObserverMode:      live.ObserverMode,
+		EvaluateTokens:    cfg.Server.EvaluateTokens,
+		GetCertificate:    servingCert.GetCertificate,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create HTTPS server: %v", err)
+	}
 	go func() {
-		utils.InfoLog("Starting HTTPS server on port: %s", port)
-		if err := server.ListenAndServeTLS(tlscert, tlskey); err != nil {
+		utils.InfoLog("Starting HTTPS server on port: %s", cfg.Server.Port)
+		if err := server.ListenAndServeTLS("", ""); err != nil && err != nethttp.ErrServerClosed {
 			utils.ErrorLog("Failed to listen and serve HTTPS: %v", err)
 		}
 	}()
 
 	// Metrics server start
-	metricsServer := http.NewMetricsServer(metricsPort)
+	metricsServer := http.NewMetricsServer(cfg.Metrics.Port)
 	go func() {
-		utils.InfoLog("Starting metrics server on port: %s", metricsPort)
-		if err := metricsServer.ListenAndServe(); err != nil {
+		utils.InfoLog("Starting metrics server on port: %s", cfg.Metrics.Port)
+		if err := metricsServer.ListenAndServe(); err != nil && err != nethttp.ErrServerClosed {
 			utils.ErrorLog("Failed to listen and serve metrics: %v", err)
 		}
 	}()
 
+	// Decision history API start, served over TLS with the same certificate
+	var queryServer *nethttp.Server
+	if cfg.QueryAPI.Port != "" {
+		queryServer, err = http.NewQueryServer(http.QueryServerConfig{
+			Port:           cfg.QueryAPI.Port,
+			Tokens:         cfg.QueryAPI.Tokens,
+			MaxLimit:       cfg.QueryAPI.MaxLimit,
+			QueryTimeout:   cfg.QueryAPI.Timeout.D(),
+			GetCertificate: servingCert.GetCertificate,
+		}, utils.AdmissionEventStore())
+		if err != nil {
+			utils.ErrorLog("Decision history API is disabled: %v", err)
+		} else {
+			go func() {
+				utils.InfoLog("Starting decision history API on port: %s", cfg.QueryAPI.Port)
+				if err := queryServer.ListenAndServeTLS("", ""); err != nil && err != nethttp.ErrServerClosed {
+					utils.ErrorLog("Failed to listen and serve decision history API: %v", err)
+				}
+			}()
+		}
+	}
+
+	// Scans of existing objects, reported as audit events with the request type "audit" and scan metrics
+	scanCtx, stopScan := context.WithCancel(context.Background())
+	defer stopScan()
+	if cfg.Scan.Interval > 0 {
+		restConfig, err := rest.InClusterConfig()
+		var client kubernetes.Interface
+		if err == nil {
+			client, err = kubernetes.NewForConfig(restConfig)
+		}
+		var lease scan.Lease
+		if err == nil {
+			lease, err = scanLease(cfg.Scan)
+		}
+		if err != nil {
+			utils.ErrorLog("Cluster scans are disabled: %v", err)
+		} else {
+			utils.InfoLog("Waiting for lease %s/%s to scan cluster objects", lease.Namespace, lease.Name)
+			go scan.NewScanner(client, validation.NewValidationHook(live.ObserverMode)).RunElected(scanCtx, lease, cfg.Scan.Interval.D())
+		}
+	}
+
+	// Configuration reload on SIGHUP and on config file changes
+	reloadCtx, stopReload := context.WithCancel(context.Background())
+	defer stopReload()
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			reloadConfig(live, "SIGHUP")
+		}
+	}()
+	if cfg.File != "" && cfg.WatchInterval > 0 {
+		go config.Watch(reloadCtx, cfg.File, cfg.WatchInterval.D(), func() {
+			reloadConfig(live, "file change")
+		})
+	}
+
 	// Sys call / Signals processing
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 	sig := <-signalChan
 	log.Errorf("Received %s signal; shutting down...", sig)
+	signal.Stop(hupChan)
+	stopReload()
+	stopScan()
+
+	// Fail readiness first so the endpoint is removed from the Service before the listener closes.
+	// A second signal skips the rest of the drain period
+	draining.Store(true)
+	utils.InfoLog("Draining for %s before shutdown", cfg.Server.DrainDelay)
+	select {
+	case <-time.After(cfg.Server.DrainDelay.D()):
+	case sig = <-signalChan:
+		log.Errorf("Received %s signal; skipping drain", sig)
+	}
 
-	if err := server.Shutdown(context.Background()); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout.D())
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
 		log.Error(err)
 	}
-	if err := metricsServer.Shutdown(context.Background()); err != nil {
+	if err := metricsServer.Shutdown(ctx); err != nil {
 		log.Error(err)
 	}
-}
-
-// getEnv gets an environment variable by name and if it doesn't exist, returns a default value
-func getEnv(name string, defaultValue string) string {
-	value := os.Getenv(name)
-	if value == "" {
-		return defaultValue
+	if queryServer != nil {
+		if err := queryServer.Shutdown(ctx); err != nil {
+			log.Error(err)
+		}
 	}
-	return value
+
+	// Requests which finished late may have used up the timeout above, the audit sinks get a bound of their own
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout.D())
+	defer cancelFlush()
+	utils.CloseAuditSinks(flushCtx)
+	utils.InfoLog("Shutdown complete")
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"admissioncontroller/config"
+	"admissioncontroller/utils"
+)
+
+// applyReloadable pushes the settings which can change without a restart to the other packages.
+// Everything which can fail is checked before the first change
+func applyReloadable(cfg config.Config) error {
+	groups, err := utils.ParseLabelGroups(cfg.Metrics.UsernameGroups)
+	if err != nil {
+		return fmt.Errorf("invalid metric label policy: %v", err)
+	}
+	redact, err := utils.ParseRedactionRules(cfg.Audit.SnapshotRedact)
+	if err != nil {
+		return fmt.Errorf("invalid snapshot redaction rules: %v", err)
+	}
+	err = utils.SetLabelPolicy(utils.LabelPolicy{
+		Username:       cfg.Metrics.UsernameLabel,
+		UsernameGroups: groups,
+		Namespaces:     cfg.Metrics.NamespaceAllowlist,
+		MaxNamespaces:  cfg.Metrics.MaxNamespaces,
+	})
+	if err != nil {
+		return fmt.Errorf("invalid metric label policy: %v", err)
+	}
+	err = utils.SetSnapshotConfig(utils.SnapshotConfig{
+		Mode:       cfg.Audit.Snapshot,
+		SampleRate: cfg.Audit.SnapshotSampleRate,
+		MaxBytes:   cfg.Audit.SnapshotMaxKB << 10,
+		Redact:     redact,
+	})
+	if err != nil {
+		return fmt.Errorf("invalid snapshot settings: %v", err)
+	}
+
+	utils.SetDebug(cfg.Debug)
+	utils.SetConfigVersion(cfg.Version())
+	if cfg.ObserverMode {
+		utils.InfoLog("Observer mode is activated. All requests will be allowed without enforcement.")
+	}
+	return nil
+}
+
+// reloadConfig reloads the configuration and reports the result. A rejected configuration leaves the active one in place
+func reloadConfig(live *config.Live, trigger string) {
+	result, restart, err := live.Reload()
+	utils.ConfigReloads.WithLabelValues(result, utils.GetK8SId()).Inc()
+	switch {
+	case err != nil:
+		utils.ErrorLog("Configuration reload on %s rejected, keeping version %s: %v", trigger, live.Get().Version(), err)
+	case result == config.ReloadApplied:
+		logConfig("Configuration reloaded on "+trigger, *live.Get())
+	default:
+		utils.InfoLog("Configuration reload on %s: no changes", trigger)
+	}
+	if len(restart) > 0 {
+		utils.Log.Warnf("Changes of %s need a restart and are ignored until then", strings.Join(restart, ", "))
+	}
+}
+
+// logConfig logs the configuration with secrets redacted
+func logConfig(msg string, cfg config.Config) {
+	utils.Log.WithField("config", cfg.Redacted()).WithField("config_version", cfg.Version()).Info(msg)
+}
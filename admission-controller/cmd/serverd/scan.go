@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"admissioncontroller/config"
+	"admissioncontroller/scan"
+)
+
+// serviceAccountNamespace is mounted into every pod with a service account token
+const serviceAccountNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// scanLease names the lease of the scans. The replica is identified by its hostname, which is the pod name
+func scanLease(cfg config.Scan) (scan.Lease, error) {
+	lease := scan.Lease{Namespace: cfg.LeaseNamespace, Name: cfg.LeaseName}
+	if lease.Namespace == "" {
+		namespace, err := os.ReadFile(serviceAccountNamespace)
+		if err != nil {
+			return lease, fmt.Errorf("failed to read the namespace of the scan lease: %v", err)
+		}
+		lease.Namespace = strings.TrimSpace(string(namespace))
+	}
+	identity, err := os.Hostname()
+	if err != nil {
+		return lease, fmt.Errorf("failed to get the identity of the replica: %v", err)
+	}
+	lease.Identity = identity
+	return lease, nil
+}
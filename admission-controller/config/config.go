@@ -0,0 +1,292 @@
+// Package config loads the controller settings from flags, environment variables and an optional YAML file.
+// It doesn't import other packages of the controller, they get their sections from main
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Config holds all settings of the controller
+type Config struct {
+	K8sID        string `json:"k8sID"`
+	ObserverMode bool   `json:"observerMode"` // Log and count violations without denying requests
+	Debug        bool   `json:"debug"`
+
+	File          string   `json:"-"`             // Path of the loaded config file, empty if there is none
+	WatchInterval Duration `json:"watchInterval"` // Interval of config file checks for changes, 0 disables them
+
+	Server     Server     `json:"server"`
+	TLS        TLS        `json:"tls"`
+	CertExpiry CertExpiry `json:"certExpiry"`
+	Metrics    Metrics    `json:"metrics"`
+	QueryAPI   QueryAPI   `json:"queryAPI"`
+	ClickHouse ClickHouse `json:"clickhouse"`
+	Audit      Audit      `json:"audit"`
+	Scan       Scan       `json:"scan"`
+}
+
+// Server holds the settings of the validation server
+type Server struct {
+	Port              string   `json:"port"`
+	ReadHeaderTimeout Duration `json:"readHeaderTimeout"`
+	ReadTimeout       Duration `json:"readTimeout"`
+	WriteTimeout      Duration `json:"writeTimeout"`
+	IdleTimeout       Duration `json:"idleTimeout"`
+	MaxRequestBodyMB  int      `json:"maxRequestBodyMB"`
+	AdmissionTimeout  Duration `json:"admissionTimeout"`
+	TimeoutPolicy     string   `json:"timeoutPolicy"` // fail-open or fail-closed
+	DrainDelay        Duration `json:"drainDelay"`
+	ShutdownTimeout   Duration `json:"shutdownTimeout"`
+	EvaluateTokens    []string `json:"evaluateTokens"` // Bearer tokens of /v1/evaluate, disabled if empty
+}
+
+// TLS holds the certificate paths and TLS parameters of the validation server
+type TLS struct {
+	CertPath     string   `json:"certPath"`
+	KeyPath      string   `json:"keyPath"`
+	CAPath       string   `json:"caPath"`       // CA bundle checked for expiry
+	ClientCAPath string   `json:"clientCAPath"` // CA of kube-apiserver client certificates, disabled if empty
+	MinVersion   string   `json:"minVersion"`
+	CipherSuites []string `json:"cipherSuites"`
+}
+
+// CertExpiry holds the certificate expiry monitoring settings
+type CertExpiry struct {
+	Gate          string   `json:"gate"` // none, healthz or readyz
+	WarningDays   int      `json:"warningDays"`
+	CriticalDays  int      `json:"criticalDays"`
+	CheckInterval Duration `json:"checkInterval"`
+}
+
+// Metrics holds the Prometheus settings
+type Metrics struct {
+	Port               string    `json:"port"`
+	LatencyBuckets     []float64 `json:"latencyBuckets"` // Built-in buckets if empty
+	NativeHistograms   bool      `json:"nativeHistograms"`
+	UsernameLabel      string    `json:"usernameLabel"`  // keep, drop or group
+	UsernameGroups     string    `json:"usernameGroups"` // name=pattern pairs
+	NamespaceAllowlist []string  `json:"namespaceAllowlist"`
+	MaxNamespaces      int       `json:"maxNamespaces"`
+}
+
+// QueryAPI holds the decision history API settings
+type QueryAPI struct {
+	Port     string   `json:"port"` // Disabled if empty
+	Tokens   []string `json:"tokens"`
+	MaxLimit int      `json:"maxLimit"`
+	Timeout  Duration `json:"timeout"`
+}
+
+// ClickHouse holds the connection and writer settings of the ClickHouse audit sink
+type ClickHouse struct {
+	Host          string   `json:"host"` // The sink is disabled if empty
+	Port          string   `json:"port"`
+	User          string   `json:"user"`
+	Password      string   `json:"password"`
+	Required      bool     `json:"required"` // Fail readiness while ClickHouse is unavailable
+	Database      string   `json:"database"`
+	Table         string   `json:"table"`
+	TTLDays       int      `json:"ttlDays"`
+	BatchSize     int      `json:"batchSize"`
+	FlushInterval Duration `json:"flushInterval"`
+	QueueSize     int      `json:"queueSize"`
+	QueuePolicy   string   `json:"queuePolicy"` // drop or block
+	SpoolPath     string   `json:"spoolPath"`
+	SpoolMaxMB    int      `json:"spoolMaxMB"`
+	RetryMax      Duration `json:"retryMax"`
+}
+
+// Audit holds the settings of the file and HTTP audit sinks and of object snapshots
+type Audit struct {
+	FilePath           string   `json:"filePath"` // The file sink is disabled if empty
+	FileMaxMB          int      `json:"fileMaxMB"`
+	FileMaxBackups     int      `json:"fileMaxBackups"`
+	FileQueueSize      int      `json:"fileQueueSize"`
+	HTTPURL            string   `json:"httpURL"` // The HTTP sink is disabled if empty
+	HTTPToken          string   `json:"httpToken"`
+	HTTPTimeout        Duration `json:"httpTimeout"`
+	HTTPBatchSize      int      `json:"httpBatchSize"`
+	HTTPFlushInterval  Duration `json:"httpFlushInterval"`
+	HTTPQueueSize      int      `json:"httpQueueSize"`
+	Snapshot           string   `json:"snapshot"` // off or denied
+	SnapshotSampleRate float64  `json:"snapshotSampleRate"`
+	SnapshotMaxKB      int      `json:"snapshotMaxKB"`
+	SnapshotRedact     string   `json:"snapshotRedact"`
+}
+
+// Scan holds the settings of the cluster scans, which run existing objects through the checks
+type Scan struct {
+	Interval       Duration `json:"interval"`       // Scans are disabled if 0
+	LeaseName      string   `json:"leaseName"`      // Lease electing the single replica which scans
+	LeaseNamespace string   `json:"leaseNamespace"` // Namespace of the service account if empty
+}
+
+// Default returns the settings used when nothing is configured
+func Default() Config {
+	return Config{
+		K8sID:         "default-cluster",
+		WatchInterval: Duration(10 * time.Second),
+		Server: Server{
+			Port:              "8443",
+			ReadHeaderTimeout: Duration(5 * time.Second),
+			ReadTimeout:       Duration(10 * time.Second),
+			WriteTimeout:      Duration(15 * time.Second),
+			IdleTimeout:       Duration(60 * time.Second),
+			MaxRequestBodyMB:  4,
+			AdmissionTimeout:  Duration(8 * time.Second),
+			TimeoutPolicy:     "fail-open",
+			DrainDelay:        Duration(10 * time.Second),
+			ShutdownTimeout:   Duration(15 * time.Second),
+		},
+		TLS: TLS{
+			CertPath:   "/etc/certs/tls.crt",
+			KeyPath:    "/etc/certs/tls.key",
+			MinVersion: "1.2",
+		},
+		CertExpiry: CertExpiry{
+			Gate:          "none",
+			WarningDays:   30,
+			CriticalDays:  7,
+			CheckInterval: Duration(time.Hour),
+		},
+		Metrics: Metrics{
+			Port:          "9090",
+			UsernameLabel: "keep",
+		},
+		QueryAPI: QueryAPI{
+			MaxLimit: 1000,
+			Timeout:  Duration(10 * time.Second),
+		},
+		ClickHouse: ClickHouse{
+			Port:          "9000",
+			User:          "admission-controller",
+			Password:      "none",
+			Database:      "default",
+			Table:         "admission_events",
+			BatchSize:     500,
+			FlushInterval: Duration(2 * time.Second),
+			QueueSize:     10000,
+			QueuePolicy:   "drop",
+			SpoolMaxMB:    256,
+			RetryMax:      Duration(time.Minute),
+		},
+		Audit: Audit{
+			FileMaxMB:         100,
+			FileMaxBackups:    5,
+			FileQueueSize:     10000,
+			HTTPTimeout:       Duration(5 * time.Second),
+			HTTPBatchSize:     100,
+			HTTPFlushInterval: Duration(2 * time.Second),
+			HTTPQueueSize:     10000,
+			Snapshot:          "off",
+			SnapshotMaxKB:     64,
+		},
+		Scan: Scan{
+			LeaseName: "admission-controller-scanner",
+		},
+	}
+}
+
+// Validate checks the settings and returns all problems at once
+func (cfg Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	oneOf := func(name, value string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		errs = append(errs, fmt.Errorf("%s: unknown value %q, expected one of %v", name, value, allowed))
+	}
+	port := func(name, value string) {
+		n, err := strconv.Atoi(value)
+		check(err == nil && n > 0 && n < 65536, "%s: invalid port %q", name, value)
+	}
+
+	check(cfg.K8sID != "", "k8sID must not be empty")
+	check(cfg.WatchInterval >= 0, "watchInterval must not be negative")
+
+	port("server.port", cfg.Server.Port)
+	check(cfg.Server.MaxRequestBodyMB > 0, "server.maxRequestBodyMB must be positive")
+	check(cfg.Server.AdmissionTimeout >= 0, "server.admissionTimeout must not be negative")
+	oneOf("server.timeoutPolicy", cfg.Server.TimeoutPolicy, "fail-open", "fail-closed")
+	check(cfg.Server.ReadHeaderTimeout >= 0 && cfg.Server.ReadTimeout >= 0 && cfg.Server.WriteTimeout >= 0 &&
+		cfg.Server.IdleTimeout >= 0 && cfg.Server.DrainDelay >= 0 && cfg.Server.ShutdownTimeout >= 0,
+		"server timeouts and delays must not be negative")
+
+	check(cfg.TLS.CertPath != "" && cfg.TLS.KeyPath != "", "tls.certPath and tls.keyPath are required")
+	oneOf("tls.minVersion", cfg.TLS.MinVersion, "1.2", "1.3")
+
+	oneOf("certExpiry.gate", cfg.CertExpiry.Gate, "none", "healthz", "readyz")
+	check(cfg.CertExpiry.CriticalDays > 0 && cfg.CertExpiry.CriticalDays <= cfg.CertExpiry.WarningDays,
+		"certExpiry: critical days (%d) must be positive and not greater than warning days (%d)", cfg.CertExpiry.CriticalDays, cfg.CertExpiry.WarningDays)
+	check(cfg.CertExpiry.CheckInterval > 0, "certExpiry.checkInterval must be positive")
+
+	port("metrics.port", cfg.Metrics.Port)
+	for i, bucket := range cfg.Metrics.LatencyBuckets {
+		check(bucket > 0 && (i == 0 || bucket > cfg.Metrics.LatencyBuckets[i-1]), "metrics.latencyBuckets must be positive and increasing")
+	}
+	oneOf("metrics.usernameLabel", cfg.Metrics.UsernameLabel, "keep", "drop", "group")
+	check(cfg.Metrics.UsernameLabel != "group" || cfg.Metrics.UsernameGroups != "", "metrics.usernameGroups are required for the group mode")
+	check(cfg.Metrics.MaxNamespaces >= 0, "metrics.maxNamespaces must not be negative")
+
+	if cfg.QueryAPI.Port != "" {
+		port("queryAPI.port", cfg.QueryAPI.Port)
+		check(len(cfg.QueryAPI.Tokens) > 0, "queryAPI.tokens are required when the query API is enabled")
+	}
+	check(cfg.QueryAPI.MaxLimit > 0, "queryAPI.maxLimit must be positive")
+
+	if cfg.ClickHouse.Host != "" {
+		port("clickhouse.port", cfg.ClickHouse.Port)
+	}
+	check(cfg.ClickHouse.Database != "" && cfg.ClickHouse.Table != "", "clickhouse.database and clickhouse.table must not be empty")
+	check(cfg.ClickHouse.TTLDays >= 0, "clickhouse.ttlDays must not be negative")
+	check(cfg.ClickHouse.BatchSize > 0 && cfg.ClickHouse.QueueSize > 0 && cfg.ClickHouse.FlushInterval > 0,
+		"clickhouse.batchSize, clickhouse.queueSize and clickhouse.flushInterval must be positive")
+	oneOf("clickhouse.queuePolicy", cfg.ClickHouse.QueuePolicy, "drop", "block")
+	check(cfg.ClickHouse.SpoolMaxMB >= 0, "clickhouse.spoolMaxMB must not be negative")
+
+	check(cfg.Audit.FileMaxMB > 0 && cfg.Audit.FileMaxBackups >= 0, "audit.fileMaxMB must be positive and audit.fileMaxBackups not negative")
+	check(cfg.Audit.FileQueueSize > 0, "audit.fileQueueSize must be positive")
+	check(cfg.Audit.HTTPBatchSize > 0 && cfg.Audit.HTTPQueueSize > 0 && cfg.Audit.HTTPFlushInterval > 0,
+		"audit.httpBatchSize, audit.httpQueueSize and audit.httpFlushInterval must be positive")
+	oneOf("audit.snapshot", cfg.Audit.Snapshot, "off", "denied")
+	check(cfg.Audit.SnapshotSampleRate >= 0 && cfg.Audit.SnapshotSampleRate <= 1, "audit.snapshotSampleRate must be between 0 and 1")
+	check(cfg.Audit.SnapshotMaxKB > 0, "audit.snapshotMaxKB must be positive")
+
+	check(cfg.Scan.Interval >= 0, "scan.interval must not be negative")
+	check(cfg.Scan.Interval == 0 || cfg.Scan.LeaseName != "", "scan.leaseName is required when scans are enabled")
+
+	return errors.Join(errs...)
+}
+
+const redacted = "<redacted>"
+
+// Redacted returns a copy of the settings with secrets replaced, for logging
+func (cfg Config) Redacted() Config {
+	if cfg.ClickHouse.Password != "" {
+		cfg.ClickHouse.Password = redacted
+	}
+	if cfg.Audit.HTTPToken != "" {
+		cfg.Audit.HTTPToken = redacted
+	}
+	cfg.QueryAPI.Tokens = redactedList(cfg.QueryAPI.Tokens)
+	cfg.Server.EvaluateTokens = redactedList(cfg.Server.EvaluateTokens)
+	return cfg
+}
+
+func redactedList(values []string) []string {
+	list := make([]string, len(values))
+	for i := range list {
+		list[i] = redacted
+	}
+	return list
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func envMap(values map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := values[name]
+		return value, ok
+	}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := Load(nil, envMap(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != "8443" || cfg.Server.AdmissionTimeout.D() != 8*time.Second || cfg.ObserverMode {
+		t.Errorf("unexpected defaults: %+v", cfg.Server)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+k8sID: from-file
+observerMode: true
+server:
+  port: "9443"
+  admissionTimeout: 3s
+metrics:
+  port: "9191"
+  latencyBuckets: [0.01, 0.1, 1]
+`)
+	env := envMap(map[string]string{
+		"CONFIG_FILE":      path,
+		"SERVER_PORT":      "10443",
+		"K8S_ID":           "from-env",
+		"METRICS_PORT":     "", // Empty variables are ignored
+		"QUERY_API_TOKENS": "a, b,",
+	})
+
+	cfg, err := Load([]string{"-k8s-id", "from-flag", "-admission-timeout=5s"}, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ name, got, want string }{
+		{"k8sID", cfg.K8sID, "from-flag"},
+		{"server.port", cfg.Server.Port, "10443"},
+		{"server.admissionTimeout", cfg.Server.AdmissionTimeout.String(), "5s"},
+		{"metrics.port", cfg.Metrics.Port, "9191"},
+		{"queryAPI.tokens", strings.Join(cfg.QueryAPI.Tokens, "|"), "a|b"},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s = %q, want %q", c.name, c.got, c.want)
+		}
+	}
+	if !cfg.ObserverMode || len(cfg.Metrics.LatencyBuckets) != 3 {
+		t.Errorf("file values are lost: observerMode %v, buckets %v", cfg.ObserverMode, cfg.Metrics.LatencyBuckets)
+	}
+
+	// The -config flag wins over CONFIG_FILE
+	other := writeConfigFile(t, "k8sID: other-file\n")
+	if cfg, err = Load([]string{"-config", other}, env); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.K8sID != "from-env" || cfg.ObserverMode {
+		t.Errorf("got k8sID %q, observerMode %v from -config", cfg.K8sID, cfg.ObserverMode)
+	}
+}
+
+func TestLoadRejectsInvalid(t *testing.T) {
+	for name, step := range map[string]struct {
+		args []string
+		env  map[string]string
+		file string
+	}{
+		"unknown file key": {file: "server:\n  prot: \"8443\"\n"},
+		"bad duration":     {file: "server:\n  admissionTimeout: 5\n"},
+		"bad env value":    {env: map[string]string{"OBSERVER_MODE": "maybe"}},
+		"unknown flag":     {args: []string{"-no-such-flag"}},
+		"invalid setting":  {args: []string{"-timeout-policy", "fail-sometimes"}},
+		"missing tokens":   {args: []string{"-query-api-port", "8444"}},
+	} {
+		env := step.env
+		if step.file != "" {
+			env = map[string]string{"CONFIG_FILE": writeConfigFile(t, step.file)}
+		}
+		if _, err := Load(step.args, envMap(env)); err == nil {
+			t.Errorf("%s: configuration was accepted", name)
+		}
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	cfg := Default()
+	cfg.Server.Port = "http"
+	cfg.Metrics.UsernameLabel = "hash"
+	cfg.Audit.SnapshotSampleRate = 2
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("invalid configuration was accepted")
+	}
+	for _, field := range []string{"server.port", "metrics.usernameLabel", "audit.snapshotSampleRate"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("error %q doesn't mention %s", err, field)
+		}
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := Default()
+	cfg.ClickHouse.Password = "ch-secret"
+	cfg.Audit.HTTPToken = "audit-secret"
+	cfg.QueryAPI.Tokens = []string{"query-secret"}
+	cfg.Server.EvaluateTokens = []string{"evaluate-secret"}
+
+	data, err := json.Marshal(cfg.Redacted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"ch-secret", "audit-secret", "query-secret", "evaluate-secret"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("%s is in the logged configuration", secret)
+		}
+	}
+	if cfg.ClickHouse.Password != "ch-secret" || cfg.QueryAPI.Tokens[0] != "query-secret" {
+		t.Error("Redacted changed the original configuration")
+	}
+}
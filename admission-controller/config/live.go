@@ -0,0 +1,156 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Version returns a short hash of the settings. Equal configurations have equal versions
+func (cfg Config) Version() string {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return "unknown"
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// withReloadable returns cfg with the settings which can change without a restart taken from next:
+// observer mode, log level, metric label policy and object snapshots
+func (cfg Config) withReloadable(next Config) Config {
+	cfg.ObserverMode = next.ObserverMode
+	cfg.Debug = next.Debug
+	cfg.Metrics.UsernameLabel = next.Metrics.UsernameLabel
+	cfg.Metrics.UsernameGroups = next.Metrics.UsernameGroups
+	cfg.Metrics.NamespaceAllowlist = next.Metrics.NamespaceAllowlist
+	cfg.Metrics.MaxNamespaces = next.Metrics.MaxNamespaces
+	cfg.Audit.Snapshot = next.Audit.Snapshot
+	cfg.Audit.SnapshotSampleRate = next.Audit.SnapshotSampleRate
+	cfg.Audit.SnapshotMaxKB = next.Audit.SnapshotMaxKB
+	cfg.Audit.SnapshotRedact = next.Audit.SnapshotRedact
+	return cfg
+}
+
+// Reload results
+const (
+	ReloadApplied   = "applied"
+	ReloadUnchanged = "unchanged"
+	ReloadRejected  = "rejected"
+)
+
+// Live holds the active configuration. Reload swaps it atomically, readers see either the old or the new one
+type Live struct {
+	current atomic.Pointer[Config]
+	load    func() (Config, error)
+	apply   func(Config) error
+	lock    sync.Mutex // Serializes reloads from SIGHUP and the file watch
+
+	rejected atomic.Pointer[error] // Error of the last reload if it was rejected
+}
+
+// NewLive returns the holder of cfg. load reads the configuration again, apply pushes reloadable
+// settings to the other packages and may reject them, in that case the old configuration stays active
+func NewLive(cfg Config, load func() (Config, error), apply func(Config) error) *Live {
+	live := &Live{load: load, apply: apply}
+	live.current.Store(&cfg)
+	return live
+}
+
+// Get returns the active configuration, it must not be modified
+func (l *Live) Get() *Config {
+	return l.current.Load()
+}
+
+// ObserverMode reports whether requests with violations are allowed
+func (l *Live) ObserverMode() bool {
+	return l.Get().ObserverMode
+}
+
+// Ready returns an error while the configuration source is invalid: after a rejected reload, until
+// a reload succeeds. The replica keeps working with the active configuration in the meantime
+func (l *Live) Ready() error {
+	if err := l.rejected.Load(); err != nil {
+		return fmt.Errorf("configuration reload rejected, running version %s: %v", l.Get().Version(), *err)
+	}
+	return nil
+}
+
+// Reload loads and validates the configuration and swaps in its reloadable settings. Changes of other
+// settings are returned in restart, they are ignored until the next start
+func (l *Live) Reload() (result string, restart []string, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	defer func() {
+		if result == ReloadRejected {
+			l.rejected.Store(&err)
+		} else {
+			l.rejected.Store(nil)
+		}
+	}()
+
+	next, err := l.load()
+	if err != nil {
+		return ReloadRejected, nil, err
+	}
+	old := l.Get()
+	cfg := old.withReloadable(next)
+	restart = changedSections(cfg, next)
+	if cfg.Version() == old.Version() {
+		return ReloadUnchanged, restart, nil
+	}
+	if err := l.apply(cfg); err != nil {
+		// Restore the settings of the active configuration in case apply changed some of them
+		if restoreErr := l.apply(*old); restoreErr != nil {
+			err = fmt.Errorf("%v, failed to restore the active configuration: %v", err, restoreErr)
+		}
+		return ReloadRejected, restart, err
+	}
+	l.current.Store(&cfg)
+	return ReloadApplied, restart, nil
+}
+
+// changedSections lists top level sections of next which differ from cfg
+func changedSections(cfg, next Config) []string {
+	var changed []string
+	a, b := reflect.ValueOf(cfg), reflect.ValueOf(next)
+	for i := 0; i < a.NumField(); i++ {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed = append(changed, a.Type().Field(i).Tag.Get("json"))
+		}
+	}
+	return changed
+}
+
+// Watch calls onChange when the content of the file at path changes, checking it every interval until ctx is done.
+// Polling the content also catches Kubernetes ConfigMap updates, which replace a symlink instead of writing the file
+func Watch(ctx context.Context, path string, interval time.Duration, onChange func()) {
+	hash := func() [sha256.Size]byte {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return [sha256.Size]byte{} // A missing file is reported by the reload
+		}
+		return sha256.Sum256(data)
+	}
+	last := hash()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if current := hash(); current != last {
+				last = current
+				onChange()
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLiveReload(t *testing.T) {
+	next, loadErr := Default(), error(nil)
+	var applied []Config
+	applyErr := error(nil)
+	live := NewLive(Default(), func() (Config, error) { return next, loadErr }, func(cfg Config) error {
+		applied = append(applied, cfg)
+		return applyErr
+	})
+	initial := live.Get().Version()
+
+	if result, _, err := live.Reload(); result != ReloadUnchanged || err != nil {
+		t.Errorf("same configuration: got %s, %v", result, err)
+	}
+
+	next.ObserverMode = true
+	next.Server.Port = "9443"
+	result, restart, err := live.Reload()
+	if result != ReloadApplied || err != nil {
+		t.Fatalf("got %s, %v", result, err)
+	}
+	if !live.ObserverMode() || live.Get().Server.Port != "8443" {
+		t.Errorf("observer mode %v, port %s: only reloadable settings must change", live.ObserverMode(), live.Get().Server.Port)
+	}
+	if !reflect.DeepEqual(restart, []string{"server"}) {
+		t.Errorf("restart sections = %v, want [server]", restart)
+	}
+	if live.Get().Version() == initial || len(applied) != 1 {
+		t.Errorf("version %s after reload, %d applies", live.Get().Version(), len(applied))
+	}
+
+	// Invalid configurations keep the active one
+	active := live.Get().Version()
+	next.ObserverMode, loadErr = false, errors.New("invalid")
+	if result, _, err := live.Reload(); result != ReloadRejected || err == nil {
+		t.Errorf("load error: got %s, %v", result, err)
+	}
+	loadErr, applyErr = nil, errors.New("rejected")
+	if result, _, err := live.Reload(); result != ReloadRejected || err == nil {
+		t.Errorf("apply error: got %s, %v", result, err)
+	}
+	if err := live.Ready(); err == nil || !strings.Contains(err.Error(), active) {
+		t.Errorf("readiness after a rejected reload: %v", err)
+	}
+	if live.Get().Version() != active || !live.ObserverMode() {
+		t.Error("rejected configuration was swapped in")
+	}
+	if last := applied[len(applied)-1]; !last.ObserverMode {
+		t.Error("active settings were not restored after a failed apply")
+	}
+
+	applyErr = nil
+	if result, _, err := live.Reload(); result == ReloadRejected || err != nil {
+		t.Errorf("fixed configuration: got %s, %v", result, err)
+	}
+	if err := live.Ready(); err != nil {
+		t.Errorf("readiness after a successful reload: %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := writeConfigFile(t, "debug: false\n")
+	changed := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Watch(ctx, path, 10*time.Millisecond, func() { changed <- struct{}{} })
+
+	time.Sleep(30 * time.Millisecond)
+	select {
+	case <-changed:
+		t.Fatal("change reported for an untouched file")
+	default:
+	}
+
+	if err := os.WriteFile(path, []byte("debug: true\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("file change was not reported")
+	}
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"sigs.k8s.io/yaml"
+)
+
+// option binds a setting to its flag and environment variable. Secrets have no flag,
+// so they don't show up in the process list
+type option struct {
+	flag  string
+	env   string
+	usage string
+	value flag.Value
+}
+
+func (cfg *Config) options() []option {
+	return []option{
+		{"k8s-id", "K8S_ID", "K8S Cluster ID", stringValue{&cfg.K8sID}},
+		{"observer-mode", "OBSERVER_MODE", "Log and count violations without denying requests", boolValue{&cfg.ObserverMode}},
+		{"debug", "DEBUG", "Debug logging, including full admission requests", boolValue{&cfg.Debug}},
+		{"config-watch-interval", "CONFIG_WATCH_INTERVAL", "Interval of config file checks for changes, 0 disables them", &cfg.WatchInterval},
+
+		{"port", "SERVER_PORT", "The port for validation endpoint", stringValue{&cfg.Server.Port}},
+		{"read-header-timeout", "READ_HEADER_TIMEOUT", "Time allowed to read request headers", &cfg.Server.ReadHeaderTimeout},
+		{"read-timeout", "READ_TIMEOUT", "Time allowed to read the whole request", &cfg.Server.ReadTimeout},
+		{"write-timeout", "WRITE_TIMEOUT", "Time allowed to write the response", &cfg.Server.WriteTimeout},
+		{"idle-timeout", "IDLE_TIMEOUT", "Time to keep idle keep-alive connections", &cfg.Server.IdleTimeout},
+		{"max-request-body-mb", "MAX_REQUEST_BODY_MB", "Maximum request body size in MiB", intValue{&cfg.Server.MaxRequestBodyMB}},
+		{"admission-timeout", "ADMISSION_TIMEOUT", "Time budget for admission checks, keep it below the webhook timeoutSeconds", &cfg.Server.AdmissionTimeout},
+		{"timeout-policy", "TIMEOUT_POLICY", "Decision for requests out of the time budget: fail-open or fail-closed", stringValue{&cfg.Server.TimeoutPolicy}},
+		{"drain-delay", "DRAIN_DELAY", "Time between SIGTERM and server shutdown while readiness is failing", &cfg.Server.DrainDelay},
+		{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "Time to wait for in-flight requests on shutdown", &cfg.Server.ShutdownTimeout},
+		{"", "EVALUATE_API_TOKENS", "Comma separated bearer tokens of the /v1/evaluate dry run endpoint, disabled if empty", listValue{&cfg.Server.EvaluateTokens}},
+
+		{"tlscert", "TLS_CERT_PATH", "Path to the TLS certificate", stringValue{&cfg.TLS.CertPath}},
+		{"tlskey", "TLS_KEY_PATH", "Path to the TLS key", stringValue{&cfg.TLS.KeyPath}},
+		{"tlsca", "TLS_CA_PATH", "Path to the CA bundle checked for expiry together with the TLS certificate chain", stringValue{&cfg.TLS.CAPath}},
+		{"tls-client-ca", "TLS_CLIENT_CA_PATH", "Path to the CA used to verify kube-apiserver client certificates, disabled if empty", stringValue{&cfg.TLS.ClientCAPath}},
+		{"tls-min-version", "TLS_MIN_VERSION", "Minimum TLS version: 1.2 or 1.3", stringValue{&cfg.TLS.MinVersion}},
+		{"tls-cipher-suites", "TLS_CIPHER_SUITES", "Comma separated list of TLS 1.2 cipher suites, Go defaults if empty", listValue{&cfg.TLS.CipherSuites}},
+
+		{"cert-expiry-gate", "CERT_EXPIRY_GATE", "Probe endpoint failing once the certificate is past the critical threshold: none, healthz or readyz", stringValue{&cfg.CertExpiry.Gate}},
+		{"cert-warning-days", "CERT_WARNING_DAYS", "Days before certificate expiry to report the warning state", intValue{&cfg.CertExpiry.WarningDays}},
+		{"cert-critical-days", "CERT_CRITICAL_DAYS", "Days before certificate expiry to report the critical state", intValue{&cfg.CertExpiry.CriticalDays}},
+		{"cert-check-interval", "CERT_CHECK_INTERVAL", "Interval between certificate expiry checks", &cfg.CertExpiry.CheckInterval},
+
+		{"metrics-port", "METRICS_PORT", "The port for Prometheus metrics", stringValue{&cfg.Metrics.Port}},
+		{"metrics-latency-buckets", "METRICS_LATENCY_BUCKETS", "Comma separated upper bounds in seconds of the latency histogram buckets, defaults if empty", floatListValue{&cfg.Metrics.LatencyBuckets}},
+		{"metrics-native-histograms", "METRICS_NATIVE_HISTOGRAMS", "Also expose latency histograms as Prometheus native histograms", boolValue{&cfg.Metrics.NativeHistograms}},
+		{"metrics-username-label", "METRICS_USERNAME_LABEL", "Username label of request metrics: keep, drop or group", stringValue{&cfg.Metrics.UsernameLabel}},
+		{"metrics-username-groups", "METRICS_USERNAME_GROUPS", "Comma separated name=pattern pairs for the group mode of the username label", stringValue{&cfg.Metrics.UsernameGroups}},
+		{"metrics-namespace-allowlist", "METRICS_NAMESPACE_ALLOWLIST", "Comma separated namespace patterns always kept in metric labels", listValue{&cfg.Metrics.NamespaceAllowlist}},
+		{"metrics-max-namespaces", "METRICS_MAX_NAMESPACES", "Distinct namespaces outside the allowlist kept in metric labels, the rest become \"other\". 0 means no limit", intValue{&cfg.Metrics.MaxNamespaces}},
+
+		{"query-api-port", "QUERY_API_PORT", "The port for the decision history API, disabled if empty", stringValue{&cfg.QueryAPI.Port}},
+		{"", "QUERY_API_TOKENS", "Comma separated bearer tokens of the decision history API", listValue{&cfg.QueryAPI.Tokens}},
+		{"query-api-max-limit", "QUERY_API_MAX_LIMIT", "Maximum page size of the decision history API", intValue{&cfg.QueryAPI.MaxLimit}},
+		{"query-api-timeout", "QUERY_API_TIMEOUT", "Time limit for a decision history query", &cfg.QueryAPI.Timeout},
+
+		{"clickhouse-host", "CLICKHOUSE_HOST", "ClickHouse host, the ClickHouse sink is disabled if empty", stringValue{&cfg.ClickHouse.Host}},
+		{"clickhouse-port", "CLICKHOUSE_PORT", "ClickHouse native protocol port", stringValue{&cfg.ClickHouse.Port}},
+		{"clickhouse-user", "CLICKHOUSE_USER", "ClickHouse user", stringValue{&cfg.ClickHouse.User}},
+		{"", "CLICKHOUSE_PASSWORD", "ClickHouse password", stringValue{&cfg.ClickHouse.Password}},
+		{"clickhouse-required", "CLICKHOUSE_REQUIRED", "Fail readiness while ClickHouse is unavailable", boolValue{&cfg.ClickHouse.Required}},
+		{"clickhouse-database", "CLICKHOUSE_DATABASE", "ClickHouse database, may contain {k8s_id}", stringValue{&cfg.ClickHouse.Database}},
+		{"clickhouse-table", "CLICKHOUSE_TABLE", "ClickHouse events table, may contain {k8s_id}", stringValue{&cfg.ClickHouse.Table}},
+		{"clickhouse-ttl-days", "CLICKHOUSE_TTL_DAYS", "Retention of ClickHouse events in days, 0 keeps them forever", intValue{&cfg.ClickHouse.TTLDays}},
+		{"clickhouse-batch-size", "CLICKHOUSE_BATCH_SIZE", "Rows per ClickHouse INSERT", intValue{&cfg.ClickHouse.BatchSize}},
+		{"clickhouse-flush-interval", "CLICKHOUSE_FLUSH_INTERVAL", "Maximum time a row waits for a batch to fill up", &cfg.ClickHouse.FlushInterval},
+		{"clickhouse-queue-size", "CLICKHOUSE_QUEUE_SIZE", "Rows buffered in memory", intValue{&cfg.ClickHouse.QueueSize}},
+		{"clickhouse-queue-policy", "CLICKHOUSE_QUEUE_POLICY", "drop new rows or block the request when the queue is full", stringValue{&cfg.ClickHouse.QueuePolicy}},
+		{"clickhouse-spool-path", "CLICKHOUSE_SPOOL_PATH", "Spool file for rows while ClickHouse is unavailable, disabled if empty", stringValue{&cfg.ClickHouse.SpoolPath}},
+		{"clickhouse-spool-max-mb", "CLICKHOUSE_SPOOL_MAX_MB", "Size limit of the spool file in MiB", intValue{&cfg.ClickHouse.SpoolMaxMB}},
+		{"clickhouse-retry-max", "CLICKHOUSE_RETRY_MAX", "Maximum reconnect backoff", &cfg.ClickHouse.RetryMax},
+
+		{"audit-file-path", "AUDIT_FILE_PATH", "JSONL audit file, disabled if empty", stringValue{&cfg.Audit.FilePath}},
+		{"audit-file-max-mb", "AUDIT_FILE_MAX_MB", "Audit file size before rotation in MiB", intValue{&cfg.Audit.FileMaxMB}},
+		{"audit-file-max-backups", "AUDIT_FILE_MAX_BACKUPS", "Rotated audit files to keep", intValue{&cfg.Audit.FileMaxBackups}},
+		{"audit-file-queue-size", "AUDIT_FILE_QUEUE_SIZE", "Audit events buffered for the file sink", intValue{&cfg.Audit.FileQueueSize}},
+		{"audit-http-url", "AUDIT_HTTP_URL", "Endpoint receiving audit event batches, disabled if empty", stringValue{&cfg.Audit.HTTPURL}},
+		{"", "AUDIT_HTTP_TOKEN", "Bearer token of the audit HTTP endpoint", stringValue{&cfg.Audit.HTTPToken}},
+		{"audit-http-timeout", "AUDIT_HTTP_TIMEOUT", "Timeout of an audit HTTP request", &cfg.Audit.HTTPTimeout},
+		{"audit-http-batch-size", "AUDIT_HTTP_BATCH_SIZE", "Audit events per HTTP request", intValue{&cfg.Audit.HTTPBatchSize}},
+		{"audit-http-flush-interval", "AUDIT_HTTP_FLUSH_INTERVAL", "Maximum time an audit event waits for a batch to fill up", &cfg.Audit.HTTPFlushInterval},
+		{"audit-http-queue-size", "AUDIT_HTTP_QUEUE_SIZE", "Audit events buffered for the HTTP sink", intValue{&cfg.Audit.HTTPQueueSize}},
+		{"audit-snapshot", "AUDIT_SNAPSHOT", "Object snapshots in audit events: off or denied", stringValue{&cfg.Audit.Snapshot}},
+		{"audit-snapshot-sample-rate", "AUDIT_SNAPSHOT_SAMPLE_RATE", "Share of allowed requests with snapshots, 0..1", floatValue{&cfg.Audit.SnapshotSampleRate}},
+		{"audit-snapshot-max-kb", "AUDIT_SNAPSHOT_MAX_KB", "Size limit of a snapshot in KiB", intValue{&cfg.Audit.SnapshotMaxKB}},
+		{"audit-snapshot-redact", "AUDIT_SNAPSHOT_REDACT", "Additional redacted paths per kind, e.g. ConfigMap:data;*:metadata.labels.owner", stringValue{&cfg.Audit.SnapshotRedact}},
+
+		{"scan-interval", "SCAN_INTERVAL", "Interval between scans of existing cluster objects, 0 disables them", &cfg.Scan.Interval},
+		{"scan-lease-name", "SCAN_LEASE_NAME", "Lease electing the replica which runs the cluster scans", stringValue{&cfg.Scan.LeaseName}},
+		{"scan-lease-namespace", "SCAN_LEASE_NAMESPACE", "Namespace of the scan lease, the namespace of the service account if empty", stringValue{&cfg.Scan.LeaseNamespace}},
+	}
+}
+
+// newFlagSet binds the flags to cfg
+func newFlagSet(cfg *Config, configPath *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("serverd", flag.ContinueOnError)
+	fs.StringVar(configPath, "config", *configPath, "Path to a YAML config file (CONFIG_FILE)")
+	for _, opt := range cfg.options() {
+		if opt.flag != "" {
+			fs.Var(opt.value, opt.flag, fmt.Sprintf("%s (%s)", opt.usage, opt.env))
+		}
+	}
+	return fs
+}
+
+// Load builds the configuration from defaults, the config file (-config or CONFIG_FILE),
+// environment variables and flags, each overriding the previous one. Empty variables are ignored
+func Load(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	env := func(name string) (string, bool) {
+		value, ok := lookupEnv(name)
+		return value, ok && value != ""
+	}
+
+	// The first pass only finds the config file
+	configPath, _ := env("CONFIG_FILE")
+	scratch := Default()
+	fs := newFlagSet(&scratch, &configPath)
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			fs.SetOutput(os.Stderr)
+			fs.Usage()
+		}
+		return Config{}, err
+	}
+
+	cfg := Default()
+	if configPath != "" {
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			return Config{}, fmt.Errorf("failed to read config file: %v", err)
+		}
+		if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+			return Config{}, fmt.Errorf("invalid config file %s: %v", configPath, err)
+		}
+	}
+	for _, opt := range cfg.options() {
+		if value, ok := env(opt.env); ok {
+			if err := opt.value.Set(value); err != nil {
+				return Config{}, fmt.Errorf("invalid %s value %q: %v", opt.env, value, err)
+			}
+		}
+	}
+	fs = newFlagSet(&cfg, &configPath)
+	fs.SetOutput(io.Discard) // Already reported by the first pass
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	cfg.File = configPath
+	return cfg, cfg.Validate()
+}
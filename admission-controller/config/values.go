@@ -0,0 +1,143 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration written as "10s" in the config file
+type Duration time.Duration
+
+// D returns the value as time.Duration
+func (d Duration) D() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Set implements flag.Value
+func (d *Duration) Set(value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\": %v", err)
+	}
+	return d.Set(value)
+}
+
+// flag.Value implementations bound to the fields of Config
+
+type stringValue struct{ p *string }
+
+func (v stringValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return *v.p
+}
+func (v stringValue) Set(value string) error { *v.p = value; return nil }
+
+type intValue struct{ p *int }
+
+func (v intValue) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.Itoa(*v.p)
+}
+func (v intValue) Set(value string) (err error) {
+	*v.p, err = strconv.Atoi(value)
+	return err
+}
+
+type boolValue struct{ p *bool }
+
+func (v boolValue) String() string {
+	if v.p == nil {
+		return "false"
+	}
+	return strconv.FormatBool(*v.p)
+}
+func (v boolValue) Set(value string) (err error) {
+	*v.p, err = strconv.ParseBool(value)
+	return err
+}
+func (v boolValue) IsBoolFlag() bool { return true }
+
+type floatValue struct{ p *float64 }
+
+func (v floatValue) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.FormatFloat(*v.p, 'f', -1, 64)
+}
+func (v floatValue) Set(value string) (err error) {
+	*v.p, err = strconv.ParseFloat(value, 64)
+	return err
+}
+
+// listValue is a comma separated list, empty items are skipped
+type listValue struct{ p *[]string }
+
+func (v listValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strings.Join(*v.p, ",")
+}
+func (v listValue) Set(value string) error {
+	*v.p = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v.p = append(*v.p, item)
+		}
+	}
+	return nil
+}
+
+// floatListValue is a comma separated list of numbers
+type floatListValue struct{ p *[]float64 }
+
+func (v floatListValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	items := make([]string, len(*v.p))
+	for i, f := range *v.p {
+		items[i] = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strings.Join(items, ",")
+}
+func (v floatListValue) Set(value string) error {
+	var values []float64
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			return err
+		}
+		values = append(values, f)
+	}
+	*v.p = values
+	return nil
+}
@@ -0,0 +1,235 @@
+package evaluate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"admissioncontroller"
+)
+
+// Diff collects the replayed requests whose decision changed
+type Diff struct {
+	Replayed  int
+	Unchanged int
+	Skipped   map[string]int // Reason -> stored requests which could not be replayed
+	Changes   []Replayed     // In the order of replay
+}
+
+// NewDiff creates an empty diff
+func NewDiff() *Diff {
+	return &Diff{Skipped: map[string]int{}}
+}
+
+// Add counts a replayed request, changed ones are kept for the report
+func (d *Diff) Add(r Replayed) {
+	d.Replayed++
+	if r.Change() == ChangeNone {
+		d.Unchanged++
+		return
+	}
+	d.Changes = append(d.Changes, r)
+}
+
+// Skip counts a stored request which could not be replayed
+func (d *Diff) Skip(reason error) {
+	d.Skipped[reason.Error()]++
+}
+
+// Count returns the number of changes of a kind
+func (d *Diff) Count(change string) int {
+	var n int
+	for _, r := range d.Changes {
+		if r.Change() == change {
+			n++
+		}
+	}
+	return n
+}
+
+// affected counts the changes of a kind by namespace and by user
+func (d *Diff) affected(change string) (namespaces, users map[string]int) {
+	namespaces, users = map[string]int{}, map[string]int{}
+	for _, r := range d.Changes {
+		if r.Change() == change {
+			namespaces[r.Recorded.Request.Namespace]++
+			users[r.Recorded.User()]++
+		}
+	}
+	return namespaces, users
+}
+
+// Diff formats
+const (
+	DiffText = "text"
+	DiffJSON = "json"
+)
+
+// WriteDiff writes the diff as text for people or as JSON for scripts
+func WriteDiff(w io.Writer, format string, d *Diff) error {
+	switch format {
+	case DiffText:
+		return writeDiffText(w, d)
+	case DiffJSON:
+		return writeDiffJSON(w, d)
+	}
+	return fmt.Errorf("unknown diff format %q, expected %s or %s", format, DiffText, DiffJSON)
+}
+
+var changeTitles = map[string]string{
+	ChangeNewlyDenied:   "NEWLY DENIED  ",
+	ChangeNewlyAllowed:  "NEWLY ALLOWED ",
+	ChangeChecksChanged: "CHECKS CHANGED",
+	ChangeNowDenied:     "NOW DENIED    ",
+}
+
+func checkList(checks []string) string {
+	if len(checks) == 0 {
+		return "none"
+	}
+	return strings.Join(checks, ", ")
+}
+
+func writeDiffText(w io.Writer, d *Diff) error {
+	for _, r := range d.Changes {
+		rec := r.Recorded
+		fmt.Fprintf(w, "%s %s %s by %s (%s)", changeTitles[r.Change()], rec.Request.Operation, rec.Ref(), rec.User(), rec.Source)
+		if !rec.Time.IsZero() {
+			fmt.Fprintf(w, " at %s", rec.Time.UTC().Format(time.RFC3339))
+		}
+		fmt.Fprintln(w)
+		if rec.ChecksKnown {
+			fmt.Fprintf(w, "  checks: %s -> %s\n", checkList(rec.Checks), checkList(r.Checks))
+		}
+		if r.Err != nil {
+			fmt.Fprintf(w, "  error: %v\n", r.Err)
+		}
+		if change := r.Change(); change == ChangeNewlyDenied || change == ChangeNowDenied {
+			for _, v := range r.Violations {
+				fmt.Fprintf(w, "  [%s] %s: %s\n", v.CheckID, v.FieldPath, v.Message)
+			}
+		}
+	}
+
+	for _, change := range []string{ChangeNewlyDenied, ChangeNewlyAllowed} {
+		namespaces, users := d.affected(change)
+		if len(namespaces) == 0 {
+			continue
+		}
+		title := map[string]string{ChangeNewlyDenied: "Newly denied", ChangeNewlyAllowed: "Newly allowed"}[change]
+		fmt.Fprintf(w, "\n%s by namespace: %s\n", title, topCounts(namespaces))
+		fmt.Fprintf(w, "%s by user: %s\n", title, topCounts(users))
+	}
+
+	fmt.Fprintf(w, "\n%d requests replayed: %d newly denied, %d newly allowed, %d denied by other checks, %d unchanged\n",
+		d.Replayed, d.Count(ChangeNewlyDenied), d.Count(ChangeNewlyAllowed), d.Count(ChangeChecksChanged), d.Unchanged)
+	if n := d.Count(ChangeNowDenied); n > 0 {
+		fmt.Fprintf(w, "%d captured reviews were allowed and are denied now, the response doesn't show whether by the observer mode\n", n)
+	}
+	if len(d.Skipped) > 0 {
+		reasons := make([]string, 0, len(d.Skipped))
+		for reason, n := range d.Skipped {
+			reasons = append(reasons, fmt.Sprintf("%s %d", reason, n))
+		}
+		sort.Strings(reasons)
+		_, err := fmt.Fprintf(w, "Skipped: %s\n", strings.Join(reasons, ", "))
+		return err
+	}
+	return nil
+}
+
+// topCounts formats counts as "key n" pairs, the largest first
+func topCounts(counts map[string]int) string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = fmt.Sprintf("%s %d", key, counts[key])
+	}
+	return strings.Join(pairs, ", ")
+}
+
+type jsonDecision struct {
+	Denied     bool                            `json:"denied"`
+	Checks     []string                        `json:"checks"`
+	Violations []admissioncontroller.Violation `json:"violations,omitempty"`
+	Error      string                          `json:"error,omitempty"`
+}
+
+type jsonChange struct {
+	Change    string       `json:"change"`
+	Source    string       `json:"source"`
+	Time      *time.Time   `json:"time,omitempty"`
+	RequestID string       `json:"request_id"`
+	Operation string       `json:"operation"`
+	Kind      string       `json:"kind"`
+	Namespace string       `json:"namespace"`
+	Name      string       `json:"name"`
+	User      string       `json:"user"`
+	Before    jsonDecision `json:"before"`
+	After     jsonDecision `json:"after"`
+}
+
+type jsonAffected struct {
+	Namespaces map[string]int `json:"namespaces"`
+	Users      map[string]int `json:"users"`
+}
+
+type jsonDiff struct {
+	Replayed  int                     `json:"replayed"`
+	Unchanged int                     `json:"unchanged"`
+	Skipped   map[string]int          `json:"skipped"`
+	Changes   []jsonChange            `json:"changes"`
+	Affected  map[string]jsonAffected `json:"affected"` // By change: newly_denied and newly_allowed
+}
+
+func writeDiffJSON(w io.Writer, d *Diff) error {
+	out := jsonDiff{
+		Replayed:  d.Replayed,
+		Unchanged: d.Unchanged,
+		Skipped:   d.Skipped,
+		Changes:   []jsonChange{},
+		Affected:  map[string]jsonAffected{},
+	}
+	for _, r := range d.Changes {
+		rec := r.Recorded
+		change := jsonChange{
+			Change:    r.Change(),
+			Source:    rec.Source,
+			RequestID: string(rec.Request.UID),
+			Operation: string(rec.Request.Operation),
+			Kind:      rec.Request.Kind.Kind,
+			Namespace: rec.Request.Namespace,
+			Name:      rec.Request.Name,
+			User:      rec.User(),
+			Before:    jsonDecision{Denied: rec.Denied, Checks: rec.Checks},
+			After:     jsonDecision{Denied: r.Denied, Checks: r.Checks, Violations: r.Violations},
+		}
+		if !rec.Time.IsZero() {
+			change.Time = &rec.Time
+		}
+		if r.Err != nil {
+			change.After.Error = r.Err.Error()
+		}
+		out.Changes = append(out.Changes, change)
+	}
+	for _, change := range []string{ChangeNewlyDenied, ChangeNewlyAllowed} {
+		namespaces, users := d.affected(change)
+		out.Affected[change] = jsonAffected{Namespaces: namespaces, Users: users}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(out)
+}
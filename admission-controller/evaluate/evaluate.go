@@ -0,0 +1,102 @@
+package evaluate
+
+import (
+	"context"
+	"encoding/json"
+
+	"admissioncontroller"
+	"admissioncontroller/validation"
+
+	v1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// Options describe the simulated admission request
+type Options struct {
+	Operation v1.Operation // CREATE if empty
+	Namespace string       // Namespace of objects which don't set one, "default" if empty
+	UserInfo  authenticationv1.UserInfo
+}
+
+// Result is the decision of the hook for a single object
+type Result struct {
+	Manifest   Manifest
+	Skipped    bool // The hook has no checks for the kind, the webhook doesn't receive such objects
+	Allowed    bool
+	Message    string
+	Violations []admissioncontroller.Violation
+	Err        error // The hook failed, the webhook would answer with an error
+}
+
+// Denied reports whether the object would be rejected
+func (r Result) Denied() bool {
+	return !r.Skipped && (r.Err != nil || !r.Allowed)
+}
+
+// NewRequest builds the admission request the API server would send for the object
+func NewRequest(obj *unstructured.Unstructured, opts Options) (*v1.AdmissionRequest, error) {
+	operation := opts.Operation
+	if operation == "" {
+		operation = v1.Create
+	}
+	if obj.GetNamespace() == "" {
+		obj = obj.DeepCopy()
+		namespace := opts.Namespace
+		if namespace == "" {
+			namespace = metav1.NamespaceDefault
+		}
+		obj.SetNamespace(namespace)
+	}
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	gvk := obj.GroupVersionKind()
+	gvr, _ := meta.UnsafeGuessKindToResource(gvk)
+	request := &v1.AdmissionRequest{
+		UID:       obj.GetUID(), // Set for objects read from the cluster
+		Kind:      metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind},
+		Resource:  metav1.GroupVersionResource{Group: gvr.Group, Version: gvr.Version, Resource: gvr.Resource},
+		Name:      obj.GetName(),
+		Namespace: obj.GetNamespace(),
+		Operation: operation,
+		UserInfo:  opts.UserInfo,
+	}
+	request.Object.Raw = raw
+	if operation == v1.Update {
+		request.OldObject.Raw = raw
+	}
+	return request, nil
+}
+
+// Evaluate runs the manifests through the hook one by one. Kinds the hook has no checks for are skipped
+func Evaluate(ctx context.Context, hook admissioncontroller.Hook, manifests []Manifest, opts Options) []Result {
+	results := make([]Result, 0, len(manifests))
+	for _, manifest := range manifests {
+		result := Result{Manifest: manifest}
+		if !validation.Validates(manifest.Object.GetKind()) {
+			result.Skipped, result.Allowed = true, true
+			results = append(results, result)
+			continue
+		}
+		request, err := NewRequest(manifest.Object, opts)
+		if err != nil {
+			result.Err = err
+			results = append(results, result)
+			continue
+		}
+		decision, err := hook.Execute(ctx, request)
+		switch {
+		case err != nil:
+			result.Err = err
+		case decision != nil:
+			result.Allowed, result.Message, result.Violations = decision.Allowed, decision.Msg, decision.Violations
+		}
+		results = append(results, result)
+	}
+	return results
+}
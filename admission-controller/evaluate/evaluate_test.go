@@ -0,0 +1,197 @@
+package evaluate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"admissioncontroller/validation"
+)
+
+const manifests = `# Source: app/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: app:latest
+--- # comment after the separator
+# Only a comment
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: settings
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: web
+    namespace: prod
+  spec:
+    type: ClusterIP
+`
+
+func TestParseManifests(t *testing.T) {
+	parsed, err := ParseManifests([]byte(manifests), "app.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		ref  string
+		line int
+	}{
+		{"Deployment/web", 1},
+		{"ConfigMap/settings", 15},
+		{"Service/prod/web", 15},
+	}
+	if len(parsed) != len(want) {
+		t.Fatalf("got %d manifests, want %d", len(parsed), len(want))
+	}
+	for i, m := range parsed {
+		if m.Ref() != want[i].ref || m.Line != want[i].line {
+			t.Errorf("manifest %d: %s at line %d, want %s at line %d", i, m.Ref(), m.Line, want[i].ref, want[i].line)
+		}
+	}
+	if parsed[0].Template != "app/templates/deployment.yaml" || parsed[1].Template != "" {
+		t.Errorf("templates: %q, %q", parsed[0].Template, parsed[1].Template)
+	}
+
+	if parsed, err := ParseManifests([]byte(`{"apiVersion": "v1", "kind": "Service", "metadata": {"name": "json"}}`), "svc.json"); err != nil || len(parsed) != 1 {
+		t.Errorf("JSON manifest: %d objects, %v", len(parsed), err)
+	}
+	if _, err := ParseManifests([]byte("metadata:\n  name: no-kind\n"), "bad.yaml"); err == nil || !strings.Contains(err.Error(), "bad.yaml:1") {
+		t.Errorf("manifest without kind: %v", err)
+	}
+}
+
+func evaluateManifests(t *testing.T) []Result {
+	t.Helper()
+	parsed, err := ParseManifests([]byte(manifests), "app.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := validation.NewValidationHook(func() bool { return false })
+	return Evaluate(context.Background(), hook, parsed, Options{Namespace: "ci"})
+}
+
+func TestEvaluate(t *testing.T) {
+	results := evaluateManifests(t)
+	deployment, configMap, service := results[0], results[1], results[2]
+
+	if !deployment.Denied() || len(deployment.Violations) != 2 {
+		t.Errorf("deployment: denied %v with %d violations, want 2", deployment.Denied(), len(deployment.Violations))
+	}
+	if !configMap.Skipped || configMap.Denied() {
+		t.Errorf("config map must be skipped: %+v", configMap)
+	}
+	if service.Denied() || service.Skipped {
+		t.Errorf("service must be allowed: %+v", service)
+	}
+
+	request, err := NewRequest(deployment.Manifest.Object, Options{Namespace: "ci"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Namespace != "ci" || request.Operation != "CREATE" || request.Resource.Resource != "deployments" {
+		t.Errorf("request: namespace %q, operation %s, resource %s", request.Namespace, request.Operation, request.Resource.Resource)
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	results := evaluateManifests(t)
+
+	var text bytes.Buffer
+	if err := WriteReport(&text, FormatText, results); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text.String(), "DENIED Deployment/web app.yaml:1") || !strings.Contains(text.String(), "2 objects checked, 1 denied, 1 skipped") {
+		t.Errorf("text report:\n%s", text.String())
+	}
+
+	var junit bytes.Buffer
+	if err := WriteReport(&junit, FormatJUnit, results); err != nil {
+		t.Fatal(err)
+	}
+	var suites junitTestSuites
+	if err := xml.Unmarshal(junit.Bytes(), &suites); err != nil {
+		t.Fatalf("invalid JUnit XML: %v", err)
+	}
+	if suites.Tests != 3 || suites.Failures != 1 || suites.Skipped != 1 {
+		t.Errorf("JUnit totals: %d tests, %d failures, %d skipped", suites.Tests, suites.Failures, suites.Skipped)
+	}
+
+	var sarif bytes.Buffer
+	if err := WriteReport(&sarif, FormatSARIF, results); err != nil {
+		t.Fatal(err)
+	}
+	var log sarifLog
+	if err := json.Unmarshal(sarif.Bytes(), &log); err != nil {
+		t.Fatalf("invalid SARIF: %v", err)
+	}
+	run := log.Runs[0]
+	if len(run.Results) != 2 || len(run.Tool.Driver.Rules) != 2 {
+		t.Fatalf("SARIF: %d results, %d rules, want 2 and 2", len(run.Results), len(run.Tool.Driver.Rules))
+	}
+	if r := run.Results[0]; r.Level != "error" || r.Locations[0].PhysicalLocation.Region.StartLine != 1 {
+		t.Errorf("SARIF result: %+v", r)
+	}
+
+	if err := WriteReport(&text, "html", results); err == nil {
+		t.Error("unknown format was accepted")
+	}
+}
+
+func TestWriteReportClean(t *testing.T) {
+	parsed, err := ParseManifests([]byte(`{"apiVersion":"v1","kind":"Service","metadata":{"name":"web"},"spec":{"type":"ClusterIP"}}`), "ok.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := validation.NewValidationHook(func() bool { return false })
+	results := Evaluate(context.Background(), hook, parsed, Options{})
+
+	var sarif bytes.Buffer
+	if err := WriteReport(&sarif, FormatSARIF, results); err != nil {
+		t.Fatal(err)
+	}
+	var log struct {
+		Runs []struct {
+			Tool struct {
+				Driver struct {
+					Rules json.RawMessage `json:"rules"`
+				} `json:"driver"`
+			} `json:"tool"`
+			Results json.RawMessage `json:"results"`
+		} `json:"runs"`
+	}
+	if err := json.Unmarshal(sarif.Bytes(), &log); err != nil {
+		t.Fatalf("invalid SARIF: %v", err)
+	}
+	if run := log.Runs[0]; string(run.Tool.Driver.Rules) != "[]" || string(run.Results) != "[]" {
+		t.Errorf("SARIF of a clean run needs empty arrays, got rules %s and results %s", run.Tool.Driver.Rules, run.Results)
+	}
+
+	var junit bytes.Buffer
+	if err := WriteReport(&junit, FormatJUnit, results); err != nil {
+		t.Fatal(err)
+	}
+	var suites junitTestSuites
+	if err := xml.Unmarshal(junit.Bytes(), &suites); err != nil {
+		t.Fatalf("invalid JUnit XML: %v", err)
+	}
+	if suites.Tests != 1 || suites.Failures != 0 || suites.Skipped != 0 || len(suites.Suites) != 1 || suites.Suites[0].Cases[0].Failure != nil {
+		t.Errorf("JUnit of a clean run: %+v", suites)
+	}
+	if !strings.Contains(junit.String(), `failures="0"`) {
+		t.Errorf("JUnit report has no failure count:\n%s", junit.String())
+	}
+}
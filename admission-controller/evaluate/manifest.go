@@ -0,0 +1,139 @@
+// Package evaluate runs Kubernetes objects through the admission hook outside of the webhook:
+// manifests from files for CI, objects read from the cluster and stored requests replayed against new checks
+package evaluate
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// Manifest is a single object read from a file
+type Manifest struct {
+	File     string // Path of the file, "-" for stdin
+	Line     int    // First line of the YAML document in the file
+	Template string // Helm template the document was rendered from, taken from the "# Source:" comment
+	Object   *unstructured.Unstructured
+}
+
+// Ref returns the object reference used in reports: Kind/namespace/name
+func (m Manifest) Ref() string {
+	if m.Object.GetNamespace() == "" {
+		return m.Object.GetKind() + "/" + m.Object.GetName()
+	}
+	return m.Object.GetKind() + "/" + m.Object.GetNamespace() + "/" + m.Object.GetName()
+}
+
+var (
+	documentSeparatorRe = regexp.MustCompile(`^---\s*(#.*)?$`)
+	helmSourceRe        = regexp.MustCompile(`^#\s*Source:\s*(\S+)`)
+)
+
+// manifestExtensions are the files read from directories
+var manifestExtensions = map[string]bool{".yaml": true, ".yml": true, ".json": true}
+
+// ReadManifests reads manifests from files and directories, which are walked recursively.
+// "-" reads stdin, e.g. the output of helm template
+func ReadManifests(paths []string) ([]Manifest, error) {
+	var manifests []Manifest
+	for _, path := range paths {
+		if path == "-" {
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read stdin: %v", err)
+			}
+			parsed, err := ParseManifests(data, path)
+			if err != nil {
+				return nil, err
+			}
+			manifests = append(manifests, parsed...)
+			continue
+		}
+		err := filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() || (file != path && !manifestExtensions[strings.ToLower(filepath.Ext(file))]) {
+				return nil
+			}
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			parsed, err := ParseManifests(data, file)
+			if err != nil {
+				return err
+			}
+			manifests = append(manifests, parsed...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return manifests, nil
+}
+
+// ParseManifests splits a multi-document YAML or a JSON file into objects. Empty documents are skipped
+// and lists (kind: List, as printed by kubectl get -o yaml) are expanded into their items
+func ParseManifests(data []byte, file string) ([]Manifest, error) {
+	var manifests []Manifest
+	var doc []string
+	start, template := 1, ""
+
+	flush := func() error {
+		defer func() { doc, template = nil, "" }()
+		content := strings.Join(doc, "\n")
+		if strings.TrimSpace(content) == "" {
+			return nil
+		}
+		jsonData, err := yaml.YAMLToJSON([]byte(content))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", file, start, err)
+		}
+		if string(jsonData) == "null" { // Only comments
+			return nil
+		}
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(jsonData); err != nil {
+			return fmt.Errorf("%s:%d: %v", file, start, err)
+		}
+		if obj.IsList() {
+			list, err := obj.ToList()
+			if err != nil {
+				return fmt.Errorf("%s:%d: %v", file, start, err)
+			}
+			for i := range list.Items {
+				manifests = append(manifests, Manifest{File: file, Line: start, Template: template, Object: &list.Items[i]})
+			}
+			return nil
+		}
+		manifests = append(manifests, Manifest{File: file, Line: start, Template: template, Object: obj})
+		return nil
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		if documentSeparatorRe.MatchString(strings.TrimRight(line, "\r")) {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			start = i + 2
+			continue
+		}
+		if match := helmSourceRe.FindStringSubmatch(line); match != nil && template == "" {
+			template = match[1]
+		}
+		doc = append(doc, line)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return manifests, nil
+}
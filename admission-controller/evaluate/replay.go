@@ -0,0 +1,235 @@
+package evaluate
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"admissioncontroller"
+	"admissioncontroller/utils"
+
+	v1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Reasons why a stored request can't be replayed
+var (
+	ErrNoSnapshot        = errors.New("no object snapshot")
+	ErrSnapshotTruncated = errors.New("snapshot truncated")
+	ErrNoDecision        = errors.New("decision not made by the checks") // error, timeout and tracked events
+	ErrNoResponse        = errors.New("admission review without a response")
+	ErrInvalidRecord     = errors.New("invalid JSON") // Also objects which are not Kubernetes objects
+)
+
+// Recorded is a stored admission request with the decision made for it at the time
+type Recorded struct {
+	Source  string // file:line, or the request ID for events read from ClickHouse
+	Time    time.Time
+	Request *v1.AdmissionRequest
+	Denied  bool     // Denied, or allowed with violations because of the observer mode
+	Checks  []string // Failed checks, sorted
+
+	ChecksKnown   bool // False for admission reviews, their response has no check IDs
+	DecisionKnown bool // False for allowed admission reviews, their response doesn't tell observer mode allows apart
+}
+
+// User returns the user name of the request, or the user ID if there is none
+func (r Recorded) User() string {
+	if names := r.Request.UserInfo.Extra["username"]; len(names) > 0 && names[0] != "" {
+		return names[0]
+	}
+	return r.Request.UserInfo.Username
+}
+
+// Ref returns Kind/namespace/name of the requested object
+func (r Recorded) Ref() string {
+	if r.Request.Namespace == "" {
+		return r.Request.Kind.Kind + "/" + r.Request.Name
+	}
+	return r.Request.Kind.Kind + "/" + r.Request.Namespace + "/" + r.Request.Name
+}
+
+// RecordFromEvent rebuilds the admission request of an audit event from its object snapshot.
+// Snapshots are redacted, so checks of redacted fields (env values, Secret data) see [REDACTED]
+func RecordFromEvent(event utils.AuditEvent, source string) (Recorded, error) {
+	switch {
+	case event.Result != utils.AuditAllowed && event.Result != utils.AuditAllowedObserver && event.Result != utils.AuditDenied:
+		return Recorded{}, ErrNoDecision
+	case event.SnapshotTruncated:
+		return Recorded{}, ErrSnapshotTruncated
+	case len(event.Object) == 0:
+		return Recorded{}, ErrNoSnapshot
+	}
+
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(event.Object); err != nil {
+		return Recorded{}, ErrInvalidRecord
+	}
+	operation := v1.Operation(strings.ToUpper(event.RequestType))
+	if event.RequestType == utils.RequestTypeAudit {
+		operation = v1.Create // Cluster scans simulate creation
+	}
+	gvk := obj.GroupVersionKind()
+	gvr, _ := meta.UnsafeGuessKindToResource(gvk)
+	request := &v1.AdmissionRequest{
+		UID:       types.UID(event.RequestID),
+		Kind:      metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: event.TargetKind},
+		Resource:  metav1.GroupVersionResource{Group: gvr.Group, Version: gvr.Version, Resource: gvr.Resource},
+		Name:      event.TargetName,
+		Namespace: event.TargetNamespace,
+		Operation: operation,
+		UserInfo:  authenticationv1.UserInfo{Username: event.UserID, Groups: event.UserGroups},
+	}
+	if event.UserName != "" {
+		request.UserInfo.Extra = map[string]authenticationv1.ExtraValue{"username": {event.UserName}}
+	}
+	request.Object.Raw = event.Object
+	if operation == v1.Update {
+		request.OldObject.Raw = event.OldObject
+		if len(event.OldObject) == 0 {
+			request.OldObject.Raw = event.Object
+		}
+	}
+
+	record := Recorded{
+		Source:  source,
+		Time:    event.Time,
+		Request: request,
+		Denied:  event.Result != utils.AuditAllowed,
+
+		ChecksKnown:   true,
+		DecisionKnown: true,
+	}
+	for _, v := range event.Violations {
+		record.Checks = append(record.Checks, v.CheckID)
+	}
+	record.Checks = uniqueSorted(record.Checks)
+	return record, nil
+}
+
+// RecordFromReview uses a captured AdmissionReview with the response of the webhook
+func RecordFromReview(review v1.AdmissionReview, source string) (Recorded, error) {
+	switch {
+	case review.Request == nil || len(review.Request.Object.Raw) == 0:
+		return Recorded{}, ErrNoSnapshot
+	case review.Response == nil:
+		return Recorded{}, ErrNoResponse
+	}
+	denied := !review.Response.Allowed
+	return Recorded{Source: source, Request: review.Request, Denied: denied, DecisionKnown: denied}, nil
+}
+
+// ReadRecords reads JSONL with an audit event (the file audit sink) or an AdmissionReview per line.
+// fn gets every line, with an error if it can't be replayed. Only read errors and errors of fn are returned
+func ReadRecords(r io.Reader, file string, fn func(Recorded, error) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20) // Snapshots make lines long
+	for line := 1; scanner.Scan(); line++ {
+		data := scanner.Bytes()
+		if len(strings.TrimSpace(string(data))) == 0 {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", file, line)
+
+		var probe struct {
+			Request json.RawMessage `json:"request"`
+		}
+		var review v1.AdmissionReview
+		var event utils.AuditEvent
+		record, err := Recorded{}, ErrInvalidRecord
+		switch {
+		case json.Unmarshal(data, &probe) != nil:
+		case probe.Request != nil:
+			if json.Unmarshal(data, &review) == nil {
+				record, err = RecordFromReview(review, source)
+			}
+		default:
+			if json.Unmarshal(data, &event) == nil {
+				record, err = RecordFromEvent(event, source)
+			}
+		}
+		if err := fn(record, err); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %v", file, err)
+	}
+	return nil
+}
+
+// Kinds of changes between the recorded and the replayed decision
+const (
+	ChangeNone          = "unchanged"
+	ChangeNewlyDenied   = "newly_denied"
+	ChangeNewlyAllowed  = "newly_allowed"
+	ChangeChecksChanged = "checks_changed" // Denied before and now, by other checks
+	ChangeNowDenied     = "now_denied"     // Allowed in a captured review, maybe in observer mode, and denied now
+)
+
+// Replayed is the decision of the candidate checks for a recorded request
+type Replayed struct {
+	Recorded   Recorded
+	Denied     bool // Would be denied with enforcement on
+	Checks     []string
+	Violations []admissioncontroller.Violation
+	Err        error // The hook failed, counted as denied like in the webhook
+}
+
+// Change compares the decisions
+func (r Replayed) Change() string {
+	switch {
+	case r.Denied && !r.Recorded.Denied && !r.Recorded.DecisionKnown:
+		return ChangeNowDenied
+	case r.Denied && !r.Recorded.Denied:
+		return ChangeNewlyDenied
+	case !r.Denied && r.Recorded.Denied:
+		return ChangeNewlyAllowed
+	case r.Denied && r.Recorded.ChecksKnown && strings.Join(r.Checks, ",") != strings.Join(r.Recorded.Checks, ","):
+		return ChangeChecksChanged
+	}
+	return ChangeNone
+}
+
+// Replay runs a recorded request through the hook. The hook should have enforcement on, so requests
+// allowed only by the observer mode count as denied on both sides
+func Replay(ctx context.Context, hook admissioncontroller.Hook, record Recorded) Replayed {
+	replayed := Replayed{Recorded: record}
+	decision, err := hook.Execute(ctx, record.Request)
+	switch {
+	case err != nil:
+		replayed.Denied, replayed.Err = true, err
+	case decision != nil:
+		replayed.Denied = !decision.Allowed || len(decision.Violations) > 0
+		replayed.Violations = decision.Violations
+		for _, v := range decision.Violations {
+			replayed.Checks = append(replayed.Checks, v.CheckID)
+		}
+		replayed.Checks = uniqueSorted(replayed.Checks)
+	}
+	return replayed
+}
+
+func uniqueSorted(values []string) []string {
+	sort.Strings(values)
+	unique := values[:0]
+	for i, v := range values {
+		if i == 0 || v != values[i-1] {
+			unique = append(unique, v)
+		}
+	}
+	if len(unique) == 0 {
+		return nil
+	}
+	return unique
+}
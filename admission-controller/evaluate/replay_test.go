@@ -0,0 +1,145 @@
+package evaluate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"admissioncontroller/validation"
+)
+
+const (
+	latestDeployment = `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"prod"},"spec":{"template":{"spec":{"containers":[{"name":"app","image":"app:latest"}]}}}}`
+	clusterIPService = `{"apiVersion":"v1","kind":"Service","metadata":{"name":"web","namespace":"dev"},"spec":{"type":"ClusterIP"}}`
+	nodePortService  = `{"apiVersion":"v1","kind":"Service","metadata":{"name":"node","namespace":"dev"},"spec":{"type":"NodePort"}}`
+)
+
+// storedRequests has audit events of the file sink and a captured AdmissionReview
+var storedRequests = strings.Join([]string{
+	`{"time":"2024-05-01T10:00:00Z","request_id":"1","request_type":"create","user_id":"u-1","user_name":"alice","target_namespace":"prod","target_kind":"Deployment","target_name":"web","admission_result":"allowed","object":` + latestDeployment + `}`,
+	`{"time":"2024-05-01T10:01:00Z","request_id":"2","request_type":"update","user_id":"u-2","user_name":"bob","target_namespace":"dev","target_kind":"Service","target_name":"web","admission_result":"denied","violations":[{"check_id":"service-nodeport"}],"object":` + clusterIPService + `}`,
+	`{"time":"2024-05-01T10:02:00Z","request_id":"3","request_type":"create","user_id":"u-1","user_name":"alice","target_namespace":"prod","target_kind":"Deployment","target_name":"web","admission_result":"allowed_observer","violations":[{"check_id":"probes"}],"object":` + latestDeployment + `}`,
+	`{"time":"2024-05-01T10:03:00Z","request_id":"4","request_type":"create","target_kind":"Deployment","admission_result":"timeout","object":` + latestDeployment + `}`,
+	`{"time":"2024-05-01T10:04:00Z","request_id":"5","request_type":"create","target_kind":"Deployment","admission_result":"allowed"}`,
+	``,
+	`{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1","request":{"uid":"6","kind":{"version":"v1","kind":"Service"},"namespace":"dev","name":"node","operation":"CREATE","userInfo":{"username":"carol"},"object":` + nodePortService + `},"response":{"uid":"6","allowed":false}}`,
+	`not json`,
+}, "\n")
+
+func replayStored(t *testing.T) *Diff {
+	t.Helper()
+	hook := validation.NewValidationHook(func() bool { return false })
+	diff := NewDiff()
+	err := ReadRecords(strings.NewReader(storedRequests), "audit.jsonl", func(record Recorded, err error) error {
+		if err != nil {
+			diff.Skip(err)
+			return nil
+		}
+		diff.Add(Replay(context.Background(), hook, record))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return diff
+}
+
+func TestReplay(t *testing.T) {
+	diff := replayStored(t)
+	if diff.Replayed != 4 || diff.Unchanged != 1 {
+		t.Errorf("replayed %d, unchanged %d, want 4 and 1", diff.Replayed, diff.Unchanged)
+	}
+	if diff.Skipped[ErrNoDecision.Error()] != 1 || diff.Skipped[ErrNoSnapshot.Error()] != 1 || len(diff.Skipped) != 3 {
+		t.Errorf("skipped: %v", diff.Skipped)
+	}
+
+	want := []struct{ source, change string }{
+		{"audit.jsonl:1", ChangeNewlyDenied},
+		{"audit.jsonl:2", ChangeNewlyAllowed},
+		{"audit.jsonl:3", ChangeChecksChanged},
+	}
+	if len(diff.Changes) != len(want) {
+		t.Fatalf("got %d changes, want %d", len(diff.Changes), len(want))
+	}
+	for i, r := range diff.Changes {
+		if r.Recorded.Source != want[i].source || r.Change() != want[i].change {
+			t.Errorf("change %d: %s %s, want %s %s", i, r.Recorded.Source, r.Change(), want[i].source, want[i].change)
+		}
+	}
+	if request := diff.Changes[1].Recorded.Request; request.Operation != "UPDATE" || string(request.OldObject.Raw) != clusterIPService {
+		t.Errorf("update request: operation %s, old object %s", request.Operation, request.OldObject.Raw)
+	}
+}
+
+func TestWriteDiff(t *testing.T) {
+	diff := replayStored(t)
+
+	var text bytes.Buffer
+	if err := WriteDiff(&text, DiffText, diff); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"NEWLY DENIED   CREATE Deployment/prod/web by alice (audit.jsonl:1) at 2024-05-01T10:00:00Z",
+		"Newly denied by namespace: prod 1",
+		"Newly allowed by user: bob 1",
+		"4 requests replayed: 1 newly denied, 1 newly allowed, 1 denied by other checks, 1 unchanged",
+	} {
+		if !strings.Contains(text.String(), line) {
+			t.Errorf("text diff has no %q:\n%s", line, text.String())
+		}
+	}
+
+	var out bytes.Buffer
+	if err := WriteDiff(&out, DiffJSON, diff); err != nil {
+		t.Fatal(err)
+	}
+	var parsed jsonDiff
+	if err := json.Unmarshal(out.Bytes(), &parsed); err != nil {
+		t.Fatalf("invalid JSON diff: %v", err)
+	}
+	if len(parsed.Changes) != 3 || parsed.Affected[ChangeNewlyDenied].Users["alice"] != 1 {
+		t.Errorf("JSON diff: %d changes, affected %v", len(parsed.Changes), parsed.Affected)
+	}
+
+	if err := WriteDiff(&out, "html", diff); err == nil {
+		t.Error("unknown format was accepted")
+	}
+}
+
+func TestReplayAllowedReview(t *testing.T) {
+	// The webhook answers observer mode allows like clean ones, so the recorded decision is unknown
+	review := `{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1","request":{"uid":"7","kind":{"version":"v1","kind":"Service"},"namespace":"dev","name":"node","operation":"CREATE","userInfo":{"username":"carol"},"object":` + nodePortService + `},"response":{"uid":"7","allowed":true}}`
+	hook := validation.NewValidationHook(func() bool { return false })
+	diff := NewDiff()
+	err := ReadRecords(strings.NewReader(review), "reviews.jsonl", func(record Recorded, err error) error {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.DecisionKnown {
+			t.Error("decision of an allowed review is known")
+		}
+		diff.Add(Replay(context.Background(), hook, record))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Changes) != 1 || diff.Changes[0].Change() != ChangeNowDenied || diff.Count(ChangeNewlyDenied) != 0 {
+		t.Fatalf("changes: %+v", diff.Changes)
+	}
+
+	var text bytes.Buffer
+	if err := WriteDiff(&text, DiffText, diff); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"NOW DENIED     CREATE Service/dev/node by carol (reviews.jsonl:1)",
+		"1 captured reviews were allowed and are denied now",
+	} {
+		if !strings.Contains(text.String(), line) {
+			t.Errorf("text diff has no %q:\n%s", line, text.String())
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package evaluate
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"admissioncontroller"
+)
+
+// Report formats
+const (
+	FormatText  = "text"
+	FormatJUnit = "junit"
+	FormatSARIF = "sarif"
+)
+
+// WriteReport writes the results in one of the report formats
+func WriteReport(w io.Writer, format string, results []Result) error {
+	switch format {
+	case FormatText:
+		return writeText(w, results)
+	case FormatJUnit:
+		return writeJUnit(w, results)
+	case FormatSARIF:
+		return writeSARIF(w, results)
+	}
+	return fmt.Errorf("unknown report format %q, expected %s, %s or %s", format, FormatText, FormatJUnit, FormatSARIF)
+}
+
+// location returns file:line of the manifest, with the Helm template if known
+func (m Manifest) location() string {
+	location := fmt.Sprintf("%s:%d", m.File, m.Line)
+	if m.Template != "" {
+		location += " (" + m.Template + ")"
+	}
+	return location
+}
+
+// failureText lists the violations of a denied object, or the error or message if there are none
+func (r Result) failureText() string {
+	switch {
+	case r.Err != nil:
+		return r.Err.Error()
+	case len(r.Violations) > 0:
+		return strings.TrimPrefix(admissioncontroller.FormatViolations(r.Violations), "\n")
+	}
+	return r.Message
+}
+
+func writeText(w io.Writer, results []Result) error {
+	var denied, skipped int
+	for _, r := range results {
+		switch {
+		case r.Skipped:
+			skipped++
+		case r.Denied():
+			denied++
+			fmt.Fprintf(w, "DENIED %s %s\n", r.Manifest.Ref(), r.Manifest.location())
+			for _, v := range r.Violations {
+				fmt.Fprintf(w, "  [%s] %s: %s\n", v.CheckID, v.FieldPath, v.Message)
+				if v.Remediation != "" {
+					fmt.Fprintf(w, "    fix: %s\n", v.Remediation)
+				}
+			}
+			if len(r.Violations) == 0 {
+				fmt.Fprintf(w, "  %s\n", r.failureText())
+			}
+		case len(r.Violations) > 0: // Allowed in observer mode
+			fmt.Fprintf(w, "WARN   %s %s\n%s\n", r.Manifest.Ref(), r.Manifest.location(), r.failureText())
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d objects checked, %d denied, %d skipped (no checks for the kind)\n", len(results)-skipped, denied, skipped)
+	return err
+}
+
+// JUnit XML: a test suite per file and a test case per object
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+func writeJUnit(w io.Writer, results []Result) error {
+	report := junitTestSuites{Name: "admissionctl validate"}
+	suites := map[string]*junitTestSuite{}
+	var files []string
+	for _, r := range results {
+		suite, ok := suites[r.Manifest.File]
+		if !ok {
+			suite = &junitTestSuite{Name: r.Manifest.File}
+			suites[r.Manifest.File] = suite
+			files = append(files, r.Manifest.File)
+		}
+		tc := junitTestCase{Name: r.Manifest.Ref(), Classname: r.Manifest.location()}
+		switch {
+		case r.Skipped:
+			tc.Skipped = &junitSkipped{Message: "no checks for " + r.Manifest.Object.GetKind()}
+			suite.Skipped++
+		case r.Denied():
+			tc.Failure = &junitFailure{Message: "denied by admission checks", Text: r.failureText()}
+			suite.Failures++
+		}
+		suite.Tests++
+		suite.Cases = append(suite.Cases, tc)
+	}
+	for _, file := range files {
+		suite := suites[file]
+		report.Tests += suite.Tests
+		report.Failures += suite.Failures
+		report.Skipped += suite.Skipped
+		report.Suites = append(report.Suites, *suite)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// SARIF 2.1.0 with a rule per check, for code scanning annotations in CI
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name  string      `json:"name"`
+	Rules []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string        `json:"id"`
+	ShortDescription sarifMessage  `json:"shortDescription"`
+	Help             *sarifMessage `json:"help,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text,omitempty"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+	LogicalLocations []sarifLogical        `json:"logicalLocations,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifact `json:"artifactLocation"`
+	Region           sarifRegion   `json:"region"`
+}
+
+type sarifArtifact struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine int `json:"startLine"`
+}
+
+type sarifLogical struct {
+	FullyQualifiedName string `json:"fullyQualifiedName"`
+}
+
+// errorRuleID is the rule of objects the hook failed on or denied without violations
+const errorRuleID = "admission-error"
+
+func writeSARIF(w io.Writer, results []Result) error {
+	rules := map[string]sarifRule{}
+	// Empty lists rather than null, the schema requires arrays even for a clean run
+	run := sarifRun{Tool: sarifTool{Driver: sarifDriver{Name: "admissionctl", Rules: []sarifRule{}}}, Results: []sarifResult{}}
+	add := func(r Result, ruleID, level, message, remediation, fieldPath string) {
+		if _, ok := rules[ruleID]; !ok {
+			rule := sarifRule{ID: ruleID, ShortDescription: sarifMessage{Text: "Admission check " + ruleID}}
+			if remediation != "" {
+				rule.Help = &sarifMessage{Text: remediation}
+			}
+			rules[ruleID] = rule
+		}
+		location := sarifLocation{PhysicalLocation: sarifPhysicalLocation{
+			ArtifactLocation: sarifArtifact{URI: r.Manifest.File},
+			Region:           sarifRegion{StartLine: r.Manifest.Line},
+		}}
+		name := r.Manifest.Ref()
+		if fieldPath != "" {
+			name += "/" + fieldPath
+		}
+		location.LogicalLocations = []sarifLogical{{FullyQualifiedName: name}}
+		run.Results = append(run.Results, sarifResult{
+			RuleID:    ruleID,
+			Level:     level,
+			Message:   sarifMessage{Text: fmt.Sprintf("%s: %s", r.Manifest.Ref(), message)},
+			Locations: []sarifLocation{location},
+		})
+	}
+
+	for _, r := range results {
+		if r.Skipped {
+			continue
+		}
+		for _, v := range r.Violations {
+			level := "error"
+			if !r.Denied() || v.Severity == admissioncontroller.SeverityWarning {
+				level = "warning"
+			}
+			add(r, v.CheckID, level, v.Message, v.Remediation, v.FieldPath)
+		}
+		if r.Denied() && len(r.Violations) == 0 {
+			add(r, errorRuleID, "error", r.failureText(), "", "")
+		}
+	}
+
+	ids := make([]string, 0, len(rules))
+	for id := range rules {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, rules[id])
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	})
+}
@@ -1,6 +1,7 @@
 package admissioncontroller
 
 import (
+	"context"
 	"fmt"
 
 	v1 "k8s.io/api/admission/v1"
@@ -8,13 +9,15 @@ import (
 
 // Result contains the result of an admission request
 type Result struct {
-	Allowed  bool
-	Msg      string
-	PatchOps []PatchOperation
+	Allowed    bool
+	Msg        string
+	PatchOps   []PatchOperation
+	Violations []Violation
+	Checks     []string // IDs of the checks which ran, passed ones are those without violations
 }
 
-// AdmitFunc defines how to process an admission request
-type AdmitFunc func(request *v1.AdmissionRequest) (*Result, error)
+// AdmitFunc defines how to process an admission request. The context is cancelled when the request runs out of its time budget
+type AdmitFunc func(ctx context.Context, request *v1.AdmissionRequest) (*Result, error)
 
 // Hook represents the set of functions for each operation in an admission webhook.
 type Hook struct {
@@ -25,25 +28,25 @@ type Hook struct {
 }
 
 // Execute evaluates the request and try to execute the function for operation specified in the request.
-func (h *Hook) Execute(r *v1.AdmissionRequest) (*Result, error) {
+func (h *Hook) Execute(ctx context.Context, r *v1.AdmissionRequest) (*Result, error) {
 	switch r.Operation {
 	case v1.Create:
-		return wrapperExecution(h.Create, r)
+		return wrapperExecution(ctx, h.Create, r)
 	case v1.Update:
-		return wrapperExecution(h.Update, r)
+		return wrapperExecution(ctx, h.Update, r)
 	case v1.Delete:
-		return wrapperExecution(h.Delete, r)
+		return wrapperExecution(ctx, h.Delete, r)
 	case v1.Connect:
-		return wrapperExecution(h.Connect, r)
+		return wrapperExecution(ctx, h.Connect, r)
 	}
 
 	return &Result{Msg: fmt.Sprintf("Invalid operation: %s", r.Operation)}, nil
 }
 
-func wrapperExecution(fn AdmitFunc, r *v1.AdmissionRequest) (*Result, error) {
+func wrapperExecution(ctx context.Context, fn AdmitFunc, r *v1.AdmissionRequest) (*Result, error) {
 	if fn == nil {
 		return nil, fmt.Errorf("operation %s is not registered", r.Operation)
 	}
 
-	return fn(r)
+	return fn(ctx, r)
 }
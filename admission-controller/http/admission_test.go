@@ -0,0 +1,137 @@
+package http
+
+import (
+	"admissioncontroller/utils"
+	"admissioncontroller/utils/audittest"
+	"admissioncontroller/validation"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// go test ./http -update rewrites the golden files with the current responses
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+// newTestWebhook serves the validation hook like /validate, without TLS
+func newTestWebhook(t *testing.T, observer bool) *httptest.Server {
+	cfg := ServerConfig{
+		TimeoutPolicy: TimeoutFailClosed,
+		ObserverMode:  func() bool { return observer },
+	}
+	ts := httptest.NewServer(newAdmissionHandler(cfg).Serve(validation.NewValidationHook(cfg.ObserverMode)))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// TestAdmissionGolden sends the AdmissionReviews of testdata/admission/<fixture>.json to the webhook and
+// compares the responses with <fixture>.golden, or <fixture>.observer.golden in observer mode
+func TestAdmissionGolden(t *testing.T) {
+	sink := audittest.Install(t)
+	enforcing, observing := newTestWebhook(t, false), newTestWebhook(t, true)
+
+	cases := []struct {
+		fixture  string
+		observer bool
+		audit    string // Result of the audit event
+	}{
+		{"deployment-valid", false, utils.AuditAllowed},
+		{"deployment-no-probes", false, utils.AuditDenied},
+		{"deployment-image-latest", false, utils.AuditDenied},
+		{"deployment-image-pull-policy", false, utils.AuditDenied},
+		{"deployment-update-image-latest", false, utils.AuditDenied},
+		{"statefulset-valid", false, utils.AuditAllowed},
+		{"statefulset-run-as-root", false, utils.AuditDenied},
+		{"service-clusterip", false, utils.AuditAllowed},
+		{"service-nodeport", false, utils.AuditDenied},
+		{"configmap-unhandled", false, utils.AuditDenied},
+
+		{"deployment-valid", true, utils.AuditAllowed},
+		{"deployment-no-probes", true, utils.AuditAllowedObserver},
+		{"deployment-update-image-latest", true, utils.AuditAllowedObserver},
+		{"statefulset-run-as-root", true, utils.AuditAllowedObserver},
+		{"service-nodeport", true, utils.AuditAllowedObserver},
+	}
+	for _, c := range cases {
+		golden := c.fixture + ".golden"
+		ts := enforcing
+		if c.observer {
+			golden = c.fixture + ".observer.golden"
+			ts = observing
+		}
+		t.Run(golden, func(t *testing.T) {
+			review, err := os.ReadFile(filepath.Join("testdata", "admission", c.fixture+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.Post(ts.URL, "application/json", bytes.NewReader(review))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d: %s", resp.StatusCode, body)
+			}
+
+			var got bytes.Buffer
+			if err := json.Indent(&got, body, "", "  "); err != nil {
+				t.Fatalf("response is not JSON: %v\n%s", err, body)
+			}
+			got.WriteByte('\n')
+			path := filepath.Join("testdata", "admission", golden)
+			if *update {
+				if err := os.WriteFile(path, got.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v, run the test with -update to create it", err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("response differs from %s:\n%s", path, got.String())
+			}
+
+			events := sink.Take()
+			if len(events) != 1 || events[0].Result != c.audit {
+				t.Fatalf("audit events %+v, want one with result %s", events, c.audit)
+			}
+			if events[0].ObserverMode != c.observer || events[0].UserName != "alice" {
+				t.Errorf("audit event: observer mode %t, user name %q", events[0].ObserverMode, events[0].UserName)
+			}
+		})
+	}
+}
+
+func TestAdmissionRejectsInvalidRequests(t *testing.T) {
+	ts := newTestWebhook(t, false)
+
+	for name, send := range map[string]func() (*http.Response, error){
+		"GET":          func() (*http.Response, error) { return http.Get(ts.URL) },
+		"content type": func() (*http.Response, error) { return http.Post(ts.URL, "text/plain", bytes.NewReader([]byte("{}"))) },
+		"no request": func() (*http.Response, error) {
+			return http.Post(ts.URL, "application/json", bytes.NewReader([]byte(`{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview"}`)))
+		},
+		"not JSON": func() (*http.Response, error) {
+			return http.Post(ts.URL, "application/json", bytes.NewReader([]byte("review")))
+		},
+	} {
+		resp, err := send()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("%s: status %d, want 400 or 405", name, resp.StatusCode)
+		}
+	}
+}
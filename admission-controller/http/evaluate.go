@@ -0,0 +1,154 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"admissioncontroller"
+	"admissioncontroller/evaluate"
+	"admissioncontroller/utils"
+	"admissioncontroller/validation"
+
+	v1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+// Modes of the decision in /v1/evaluate
+const (
+	modeEnforce  = "enforce"
+	modeObserver = "observer"
+)
+
+// Exemptions which let an object through without or despite failed checks
+const (
+	exemptionObserverMode = "observer_mode"      // Failed checks are reported, the request is allowed
+	exemptionKind         = "kind_not_validated" // The webhook doesn't receive the kind
+)
+
+// checkResult is the outcome of a single check
+type checkResult struct {
+	ID         string                          `json:"id"`
+	Passed     bool                            `json:"passed"`
+	Violations []admissioncontroller.Violation `json:"violations,omitempty"`
+}
+
+// evaluation is the decision of the webhook for one object of the manifest
+type evaluation struct {
+	Object    string        `json:"object"` // Kind/namespace/name
+	Line      int           `json:"line"`   // First line of the YAML document
+	Operation string        `json:"operation"`
+	User      string        `json:"user"`
+	Mode      string        `json:"mode"`
+	Allowed   bool          `json:"allowed"`
+	Message   string        `json:"message,omitempty"`
+	Exemption string        `json:"exemption,omitempty"`
+	Checks    []checkResult `json:"checks"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// evaluateResponse is the response of /v1/evaluate
+type evaluateResponse struct {
+	ConfigVersion string       `json:"config_version"`
+	Results       []evaluation `json:"results"`
+}
+
+// ServeEvaluate returns the handler of /v1/evaluate. It takes a raw manifest (YAML or JSON, several documents
+// are allowed) and the simulated request in the query string: namespace, operation (CREATE or UPDATE),
+// user and repeated group. Objects go through the hook of the webhook with the same time budget and observer
+// mode, but are neither audited nor counted in the request metrics
+func (h *admissionHandler) ServeEvaluate(hook admissioncontroller.Hook) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		params := r.URL.Query()
+		operation := v1.Operation(strings.ToUpper(params.Get("operation")))
+		if operation == "" {
+			operation = v1.Create
+		}
+		if operation != v1.Create && operation != v1.Update {
+			http.Error(w, fmt.Sprintf("unknown operation %q, expected CREATE or UPDATE", operation), http.StatusBadRequest)
+			return
+		}
+		opts := evaluate.Options{
+			Operation: operation,
+			Namespace: params.Get("namespace"),
+			UserInfo:  authenticationv1.UserInfo{Username: params.Get("user"), Groups: params["group"]},
+		}
+
+		body, ok := h.readBody(w, r)
+		if !ok {
+			return
+		}
+		manifests, err := evaluate.ParseManifests(body, "manifest")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not parse manifest: %v", err), http.StatusBadRequest)
+			return
+		}
+		if len(manifests) == 0 {
+			http.Error(w, "no objects in the manifest", http.StatusBadRequest)
+			return
+		}
+
+		mode := modeEnforce
+		if h.observerMode() {
+			mode = modeObserver
+		}
+		ctx := utils.WithRequestType(r.Context(), utils.RequestTypeDryRun)
+		response := evaluateResponse{ConfigVersion: utils.GetConfigVersion(), Results: []evaluation{}}
+		for _, manifest := range manifests {
+			result := evaluation{
+				Object:    manifest.Ref(),
+				Line:      manifest.Line,
+				Operation: string(operation),
+				User:      opts.UserInfo.Username,
+				Mode:      mode,
+				Checks:    []checkResult{},
+			}
+			if !validation.Validates(manifest.Object.GetKind()) {
+				result.Allowed, result.Exemption = true, exemptionKind
+				response.Results = append(response.Results, result)
+				continue
+			}
+			request, err := evaluate.NewRequest(manifest.Object, opts)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%s: %v", manifest.Ref(), err), http.StatusBadRequest)
+				return
+			}
+			result.Object = request.Kind.Kind + "/" + request.Namespace + "/" + request.Name // With the simulated namespace
+
+			decision, err := h.execute(ctx, hook, request)
+			switch {
+			case err != nil:
+				// The webhook answers with an error, the API server applies the failurePolicy of the webhook
+				result.Error = err.Error()
+			case decision != nil:
+				result.Allowed, result.Message = decision.Allowed, decision.Msg
+				result.Checks = checkResults(decision)
+				if decision.Allowed && len(decision.Violations) > 0 {
+					result.Exemption = exemptionObserverMode
+				}
+			}
+			response.Results = append(response.Results, result)
+		}
+		writeJSON(w, response)
+	}
+}
+
+// checkResults lists every check which ran with its violations
+func checkResults(decision *admissioncontroller.Result) []checkResult {
+	results := []checkResult{}
+	for _, id := range decision.Checks {
+		check := checkResult{ID: id}
+		for _, v := range decision.Violations {
+			if v.CheckID == id {
+				check.Violations = append(check.Violations, v)
+			}
+		}
+		check.Passed = len(check.Violations) == 0
+		results = append(results, check)
+	}
+	return results
+}
@@ -0,0 +1,131 @@
+package http
+
+import (
+	"admissioncontroller/utils"
+	"admissioncontroller/utils/audittest"
+	"admissioncontroller/validation"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const evaluateManifest = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: app:latest
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: dev
+spec:
+  type: ClusterIP
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+`
+
+func newTestEvaluateServer(t *testing.T, observer bool) *httptest.Server {
+	server, err := NewServer(ServerConfig{
+		TimeoutPolicy:  TimeoutFailClosed,
+		ObserverMode:   func() bool { return observer },
+		EvaluateTokens: []string{"secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server.Handler)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func postManifest(t *testing.T, url, token, manifest string) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestEvaluate(t *testing.T) {
+	sink := audittest.Install(t)
+	ts := newTestEvaluateServer(t, false)
+
+	if resp := postManifest(t, ts.URL+"/v1/evaluate", "wrong", evaluateManifest); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("invalid token: status %d, want 401", resp.StatusCode)
+	}
+	if resp := postManifest(t, ts.URL+"/v1/evaluate?operation=DELETE", "secret", evaluateManifest); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("DELETE: status %d, want 400", resp.StatusCode)
+	}
+
+	resp := postManifest(t, ts.URL+"/v1/evaluate?namespace=prod&user=alice&group=dev", "secret", evaluateManifest)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+	var response evaluateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Results) != 3 {
+		t.Fatalf("got %d results, want 3", len(response.Results))
+	}
+
+	deployment := response.Results[0]
+	if deployment.Object != "Deployment/prod/web" || deployment.User != "alice" || deployment.Mode != modeEnforce || deployment.Allowed {
+		t.Errorf("deployment: %+v", deployment)
+	}
+	passed := map[string]bool{}
+	for _, check := range deployment.Checks {
+		passed[check.ID] = check.Passed
+	}
+	if len(passed) != 3 || passed[validation.CheckImageLatest] || passed[validation.CheckProbes] || !passed[validation.CheckImagePullPolicy] {
+		t.Errorf("deployment checks: %+v", deployment.Checks)
+	}
+
+	service := response.Results[1]
+	if service.Object != "Service/dev/web" || !service.Allowed || len(service.Checks) != 1 || !service.Checks[0].Passed {
+		t.Errorf("service: %+v", service)
+	}
+	if configMap := response.Results[2]; !configMap.Allowed || configMap.Exemption != exemptionKind {
+		t.Errorf("config map: %+v", configMap)
+	}
+	if events := sink.Events(); len(events) != 0 {
+		t.Errorf("dry run emitted %d audit events", len(events))
+	}
+	if !utils.InFlightRequests.DeleteLabelValues("/v1/evaluate", utils.GetK8SId()) {
+		t.Error("/v1/evaluate is not counted in in_flight_requests")
+	}
+}
+
+func TestEvaluateObserverMode(t *testing.T) {
+	ts := newTestEvaluateServer(t, true)
+
+	resp := postManifest(t, ts.URL+"/v1/evaluate?operation=update", "secret", evaluateManifest)
+	var response evaluateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	deployment := response.Results[0]
+	if deployment.Operation != "UPDATE" || deployment.Mode != modeObserver || !deployment.Allowed || deployment.Exemption != exemptionObserverMode {
+		t.Errorf("deployment: %+v", deployment)
+	}
+}
@@ -2,12 +2,14 @@ package http
 
 import (
 	"admissioncontroller/utils"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"strconv"
+	"time"
 
 	"admissioncontroller"
 
@@ -27,16 +29,7 @@ import (
 	discoveryv1 "k8s.io/api/discovery/v1"       // Для EndpointSlice
 )
 
-var observerMode bool
-
 func init() {
-	observerModeValue := getEnv("OBSERVER_MODE", "false")
-	var err error
-	observerMode, err = strconv.ParseBool(observerModeValue)
-	if err != nil {
-		observerMode = false
-		utils.ErrorLog("Error parsing OBSERVER_MODE value: %s", err)
-	}
 	v1.AddToScheme(scheme.Scheme)
 	appsv1.AddToScheme(scheme.Scheme)
 	discoveryv1.AddToScheme(scheme.Scheme)
@@ -46,11 +39,15 @@ func init() {
 
 // admissionHandler represents the HTTP handler for an admission webhook
 type admissionHandler struct {
-	decoder runtime.Decoder
+	decoder         runtime.Decoder
+	maxBodyBytes    int64
+	timeout         time.Duration // Time budget for the hook, 0 means no limit
+	timeoutFailOpen bool          // Decision for requests which ran out of the time budget
+	observerMode    func() bool   // Reported in metrics and audit events, the hook applies it
 }
 
 // newAdmissionHandler returns an instance of AdmissionHandler
-func newAdmissionHandler() *admissionHandler {
+func newAdmissionHandler(cfg ServerConfig) *admissionHandler {
 	sch := runtime.NewScheme()
 	corev1.AddToScheme(sch)
 	appsv1.AddToScheme(sch)
@@ -62,17 +59,96 @@ func newAdmissionHandler() *admissionHandler {
 	scheme.AddToScheme(sch)
 
 	return &admissionHandler{
-		decoder: serializer.NewCodecFactory(sch).UniversalDeserializer(),
+		decoder:         serializer.NewCodecFactory(sch).UniversalDeserializer(),
+		maxBodyBytes:    cfg.MaxBodyBytes,
+		timeout:         cfg.AdmissionTimeout,
+		timeoutFailOpen: cfg.TimeoutPolicy == TimeoutFailOpen,
+		observerMode:    cfg.ObserverMode,
 	}
 }
 
-// getEnv gets an environment variable by name and if it doesn't exist, returns a default value
-func getEnv(name string, defaultValue string) string {
-	value := os.Getenv(name)
-	if value == "" {
-		return defaultValue
+// execute runs the hook within the time budget. A request which runs out of it resolves to the configured decision
+func (h *admissionHandler) execute(ctx context.Context, hook admissioncontroller.Hook, request *v1.AdmissionRequest) (*admissioncontroller.Result, error) {
+	if h.timeout <= 0 {
+		return hook.Execute(ctx, request)
 	}
-	return value
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	ctx = utils.WithAuditClaim(ctx)
+
+	type execution struct {
+		result *admissioncontroller.Result
+		err    error
+	}
+	done := make(chan execution, 1) // Buffered, so an abandoned execution doesn't leak the goroutine
+	go func() {
+		result, err := hook.Execute(ctx, request)
+		done <- execution{result, err}
+	}()
+
+	var e execution
+	finished := false
+	select {
+	case e = <-done:
+		if ctx.Err() == nil {
+			return e.result, e.err
+		}
+		finished = true
+	case <-ctx.Done():
+	}
+
+	decision := "deny"
+	if h.timeoutFailOpen {
+		decision = "allow"
+	}
+	msg := fmt.Sprintf("admission checks did not finish within %s", h.timeout)
+	if utils.RequestType(ctx, request) == utils.RequestTypeDryRun {
+		return &admissioncontroller.Result{Allowed: h.timeoutFailOpen, Msg: msg}, nil // Dry runs are not counted nor audited
+	}
+	if !utils.ClaimAudit(ctx) {
+		// The hook audited its decision right at the deadline, answer with it so the response matches the audit
+		if !finished {
+			e = <-done
+		}
+		return e.result, e.err
+	}
+	utils.TimeoutRequests.WithLabelValues(request.Kind.Kind, string(request.Operation), decision, utils.GetK8SId()).Inc()
+
+	event := utils.NewAuditEvent(request)
+	event.Result = utils.AuditTimeout
+	event.Reason = fmt.Sprintf("%s (%v), resolved as %s", msg, ctx.Err(), decision)
+	event.ProcessingTime = h.timeout
+	event.ObserverMode = h.observerMode()
+	utils.EmitAudit(event)
+	utils.Log.WithFields(log.Fields{
+		"request_id":       event.RequestID,
+		"request_type":     event.RequestType,
+		"target_namespace": event.TargetNamespace,
+		"target_kind":      event.TargetKind,
+		"target_name":      event.TargetName,
+		"admission_result": event.Result,
+		"admission_reason": event.Reason,
+	}).Error("Admission timed out")
+
+	return &admissioncontroller.Result{Allowed: h.timeoutFailOpen, Msg: msg}, nil
+}
+
+// readBody reads the request body up to maxBodyBytes and writes an error response if it fails
+func (h *admissionHandler) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	if h.maxBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.maxBodyBytes)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("request body is larger than %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		http.Error(w, fmt.Sprintf("could not read request body: %v", err), http.StatusBadRequest)
+		return nil, false
+	}
+	return body, true
 }
 
 // Serve returns a http.HandlerFunc for an admission webhook
@@ -89,9 +165,8 @@ func (h *admissionHandler) Serve(hook admissioncontroller.Hook) http.HandlerFunc
 			return
 		}
 
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("could not read request body: %v", err), http.StatusBadRequest)
+		body, ok := h.readBody(w, r)
+		if !ok {
 			return
 		}
 
@@ -107,15 +182,8 @@ func (h *admissionHandler) Serve(hook admissioncontroller.Hook) http.HandlerFunc
 			return
 		}
 
-		// Get DEBUG env var
-		debugMode, err := strconv.ParseBool(getEnv("DEBUG", "false"))
-		if err != nil {
-			utils.ErrorLog("Error parsing DEBUG value: %s", err)
-			debugMode = false // в случае ошибки считаем, что DEBUG=false
-		}
-
 		// log everything if debug=true
-		if debugMode {
+		if utils.DebugEnabled() {
 			requestLog, err := json.Marshal(review.Request)
 			if err != nil {
 				utils.ErrorLog("Failed to serialize request: %v", err)
@@ -124,7 +192,7 @@ func (h *admissionHandler) Serve(hook admissioncontroller.Hook) http.HandlerFunc
 			}
 		}
 
-		result, err := hook.Execute(review.Request)
+		result, err := h.execute(r.Context(), hook, review.Request)
 		if err != nil {
 			utils.ErrorLog("Internal Server Error: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -145,7 +213,7 @@ func (h *admissionHandler) Serve(hook admissioncontroller.Hook) http.HandlerFunc
 			resourceKind,
 			username,
 			string(operation),
-			strconv.FormatBool(observerMode),
+			strconv.FormatBool(h.observerMode()),
 			utils.GetK8SId(), // Добавляем k8s_id
 		).Inc()
 
@@ -176,11 +244,52 @@ func (h *admissionHandler) Serve(hook admissioncontroller.Hook) http.HandlerFunc
 
 func healthz() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if utils.CertExpiryGateFailed(utils.CertGateHealthz) {
+			http.Error(w, "degraded: certificate is past the critical expiry threshold", http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("ok"))
 	}
 }
 
+// readyz reports whether every registered component is ready. Use ?format=json for per-component details
+func readyz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ready, components := utils.CheckReadiness()
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+
+		if r.URL.Query().Get("format") == "json" {
+			res, err := json.Marshal(struct {
+				Ready      bool                    `json:"ready"`
+				Components []utils.ComponentStatus `json:"components"`
+			}{ready, components})
+			if err != nil {
+				http.Error(w, fmt.Sprintf("could not marshal response: %v", err), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			w.Write(res)
+			return
+		}
+
+		w.WriteHeader(status)
+		if ready {
+			w.Write([]byte("ok"))
+			return
+		}
+		for _, component := range components {
+			if !component.Ready {
+				fmt.Fprintf(w, "%s: %s\n", component.Name, component.Message)
+			}
+		}
+	}
+}
+
 func (h *admissionHandler) ServeTrack() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -189,9 +298,8 @@ func (h *admissionHandler) ServeTrack() http.HandlerFunc {
 			return
 		}
 
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Could not read request body: %v", err), http.StatusBadRequest)
+		body, ok := h.readBody(w, r)
+		if !ok {
 			return
 		}
 
@@ -234,21 +342,21 @@ func (h *admissionHandler) ServeTrack() http.HandlerFunc {
 			return
 		}
 
-		var username string
-		if usernames, ok := review.Request.UserInfo.Extra["username"]; ok && len(usernames) > 0 {
-			username = usernames[0]
-		}
+		event := utils.NewAuditEvent(review.Request)
+		event.Result = utils.AuditTracked
+		event.ObserverMode = h.observerMode()
+		utils.EmitAudit(event)
 
 		// Log request
 		utils.Log.WithFields(log.Fields{
-			"user_name":        username,
-			"user_id":          review.Request.UserInfo.Username,
-			"user_groups":      review.Request.UserInfo.Groups,
-			"request_type":     string(review.Request.Operation),
-			"request_id":       string(review.Request.UID),
-			"target_namespace": review.Request.Namespace,
-			"target_kind":      review.Request.Kind.Kind,
-			"target_name":      review.Request.Name,
+			"user_name":        event.UserName,
+			"user_id":          event.UserID,
+			"user_groups":      event.UserGroups,
+			"request_type":     event.RequestType,
+			"request_id":       event.RequestID,
+			"target_namespace": event.TargetNamespace,
+			"target_kind":      event.TargetKind,
+			"target_name":      event.TargetName,
 			"k8s_id":           utils.GetK8SId(),
 		}).Info("Received tracked request")
 
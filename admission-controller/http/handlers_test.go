@@ -0,0 +1,184 @@
+package http
+
+import (
+	"admissioncontroller"
+	"admissioncontroller/utils"
+	"admissioncontroller/utils/audittest"
+	"admissioncontroller/utils/certtest"
+	"admissioncontroller/validation"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/admission/v1"
+)
+
+func TestReadyz(t *testing.T) {
+	var configErr atomic.Pointer[error]
+	utils.RegisterReadinessCheck("test-tls", func() error { return nil })
+	utils.RegisterReadinessCheck("test-config", func() error {
+		if err := configErr.Load(); err != nil {
+			return *err
+		}
+		return nil
+	})
+	t.Cleanup(func() { configErr.Store(nil) }) // The registry is global, leave the components ready
+	ts := httptest.NewServer(readyz())
+	t.Cleanup(ts.Close)
+
+	resp, body := getBody(t, ts.URL)
+	if resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("ready: status %d, body %q", resp.StatusCode, body)
+	}
+
+	err := errors.New("configuration reload rejected")
+	configErr.Store(&err)
+	resp, body = getBody(t, ts.URL)
+	if resp.StatusCode != http.StatusServiceUnavailable || body != "test-config: configuration reload rejected\n" {
+		t.Errorf("not ready: status %d, body %q", resp.StatusCode, body)
+	}
+
+	resp, body = getBody(t, ts.URL+"?format=json")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("JSON: status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var report struct {
+		Ready      bool                    `json:"ready"`
+		Components []utils.ComponentStatus `json:"components"`
+	}
+	if err := json.Unmarshal([]byte(body), &report); err != nil {
+		t.Fatalf("invalid JSON %q: %v", body, err)
+	}
+	components := map[string]utils.ComponentStatus{}
+	for _, c := range report.Components {
+		components[c.Name] = c
+	}
+	if report.Ready || !components["test-tls"].Ready || components["test-tls"].Message != "" {
+		t.Errorf("JSON report: %s", body)
+	}
+	if c := components["test-config"]; c.Ready || c.Message != "configuration reload rejected" {
+		t.Errorf("failing component: %+v", c)
+	}
+	if !strings.Contains(body, `{"name":"test-tls","ready":true}`) {
+		t.Errorf("ready component is reported with a message: %s", body)
+	}
+}
+
+func TestCertExpiryGateProbes(t *testing.T) {
+	var served atomic.Pointer[utils.ServingCert]
+	utils.RegisterReadinessCheck("test-cert", func() error {
+		if s := served.Load(); s != nil {
+			return s.Ready()
+		}
+		return nil
+	})
+	t.Cleanup(func() {
+		served.Store(nil) // The registry is global, leave the component ready
+		utils.SetCertExpiryGate(utils.CertGateNone)
+		valid := certtest.Write(t, 365*24*time.Hour, 365*24*time.Hour)
+		utils.UpdateCertExpiryMetric(valid.Cert, "")
+	})
+	healthzServer, readyzServer := httptest.NewServer(healthz()), httptest.NewServer(readyz())
+	t.Cleanup(healthzServer.Close)
+	t.Cleanup(readyzServer.Close)
+
+	critical := certtest.Write(t, 24*time.Hour, 365*24*time.Hour)
+	s, err := utils.NewServingCert(critical.Cert, critical.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served.Store(s)
+	utils.UpdateCertExpiryMetric(critical.Cert, critical.CA)
+	for _, c := range []struct {
+		gate           string
+		healthz, ready int
+	}{
+		{utils.CertGateNone, http.StatusOK, http.StatusOK},
+		{utils.CertGateHealthz, http.StatusServiceUnavailable, http.StatusOK},
+		{utils.CertGateReadyz, http.StatusOK, http.StatusServiceUnavailable},
+	} {
+		if err := utils.SetCertExpiryGate(c.gate); err != nil {
+			t.Fatal(err)
+		}
+		if resp, body := getBody(t, healthzServer.URL); resp.StatusCode != c.healthz {
+			t.Errorf("gate %s: /healthz status %d, want %d: %s", c.gate, resp.StatusCode, c.healthz, body)
+		}
+		resp, body := getBody(t, readyzServer.URL)
+		if resp.StatusCode != c.ready {
+			t.Errorf("gate %s: /readyz status %d, want %d: %s", c.gate, resp.StatusCode, c.ready, body)
+		}
+		if c.ready != http.StatusOK && !strings.Contains(body, "test-cert: certificate chain is past the critical expiry threshold") {
+			t.Errorf("gate %s: /readyz body %q", c.gate, body)
+		}
+	}
+}
+
+func TestExecuteTimeoutAuditsOnce(t *testing.T) {
+	sink := audittest.Install(t)
+	raw, err := os.ReadFile(filepath.Join("testdata", "admission", "deployment-no-probes.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var review v1.AdmissionReview
+	if err := json.Unmarshal(raw, &review); err != nil {
+		t.Fatal(err)
+	}
+	h := newAdmissionHandler(ServerConfig{
+		AdmissionTimeout: 10 * time.Millisecond,
+		TimeoutPolicy:    TimeoutFailClosed,
+		ObserverMode:     func() bool { return false },
+	})
+	validate := validation.NewValidationHook(func() bool { return false })
+
+	for name, create := range map[string]admissioncontroller.AdmitFunc{
+		// The hook sees the expired context and gives up, the handler answers with the timeout policy
+		"checks outlive the deadline": func(ctx context.Context, r *v1.AdmissionRequest) (*admissioncontroller.Result, error) {
+			<-ctx.Done()
+			return validate.Create(ctx, r)
+		},
+		// The hook decides at the deadline and races the handler for the answer
+		"decision at the deadline": func(ctx context.Context, r *v1.AdmissionRequest) (*admissioncontroller.Result, error) {
+			<-ctx.Done()
+			return validate.Create(context.WithoutCancel(ctx), r)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				result, err := h.execute(context.Background(), admissioncontroller.Hook{Create: create}, review.Request)
+				if err != nil || result.Allowed {
+					t.Fatalf("result %+v, error %v: want a denial", result, err)
+				}
+				time.Sleep(20 * time.Millisecond) // Let an abandoned hook finish
+				events := sink.Take()
+				if len(events) != 1 {
+					t.Fatalf("got %d audit events for a timed out request, want 1: %+v", len(events), events)
+				}
+				if timedOut := strings.Contains(result.Msg, "did not finish"); timedOut != (events[0].Result == utils.AuditTimeout) {
+					t.Errorf("response %q was audited as %s", result.Msg, events[0].Result)
+				}
+			}
+		})
+	}
+}
+
+func getBody(t *testing.T, url string) (*http.Response, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
@@ -0,0 +1,199 @@
+package http
+
+import (
+	"admissioncontroller/utils"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QueryServerConfig holds the settings of the decision history API
+type QueryServerConfig struct {
+	Port         string
+	Tokens       []string      // Accepted bearer tokens, at least one is required
+	MaxLimit     int           // Upper bound of the page size
+	QueryTimeout time.Duration // Time limit for a single ClickHouse query
+	// Key pair served to clients, shared with the validation server
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+const defaultPageSize = 100
+
+// NewQueryServer creates the server of the decision history API
+func NewQueryServer(cfg QueryServerConfig, store utils.EventStore) (*http.Server, error) {
+	if store == nil {
+		return nil, fmt.Errorf("no event store, ClickHouse is not configured")
+	}
+	var tokens []string
+	for _, token := range cfg.Tokens {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("at least one API token is required")
+	}
+	if cfg.MaxLimit <= 0 {
+		cfg.MaxLimit = 1000
+	}
+
+	qh := &queryHandler{store: store, maxLimit: cfg.MaxLimit, timeout: cfg.QueryTimeout}
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", healthz())
+	mux.Handle("/api/v1/events", tokenAuth(tokens, http.HandlerFunc(qh.events)))
+	mux.Handle("/api/v1/stats/top-checks", tokenAuth(tokens, http.HandlerFunc(qh.topChecks)))
+	mux.Handle("/api/v1/stats/top-users", tokenAuth(tokens, http.HandlerFunc(qh.topUsers)))
+
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%s", cfg.Port),
+		Handler:           mux,
+		TLSConfig:         &tls.Config{GetCertificate: cfg.GetCertificate},
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      cfg.QueryTimeout + 5*time.Second,
+	}, nil
+}
+
+// tokenAuth rejects requests without one of the bearer tokens
+func tokenAuth(tokens []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok {
+			for _, token := range tokens {
+				if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1 {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+		utils.ErrorLog("Rejected request to %s from %s: missing or invalid API token", r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "invalid API token", http.StatusUnauthorized)
+	})
+}
+
+// queryHandler serves the read-only history endpoints
+type queryHandler struct {
+	store    utils.EventStore
+	maxLimit int
+	timeout  time.Duration
+}
+
+// eventsPage is the response of /api/v1/events
+type eventsPage struct {
+	Events     []utils.EventRecord `json:"events"`
+	Limit      int                 `json:"limit"`
+	Offset     int                 `json:"offset"`
+	NextOffset *int                `json:"next_offset,omitempty"` // Set if there may be more events
+}
+
+func (qh *queryHandler) events(w http.ResponseWriter, r *http.Request) {
+	filter, limit, offset, ok := qh.parse(w, r, defaultPageSize)
+	if !ok {
+		return
+	}
+	ctx, cancel := qh.context(r)
+	defer cancel()
+	events, err := qh.store.Events(ctx, filter, limit, offset)
+	if err != nil {
+		qh.fail(w, r, err)
+		return
+	}
+	page := eventsPage{Events: events, Limit: limit, Offset: offset}
+	if len(events) == limit {
+		next := offset + limit
+		page.NextOffset = &next
+	}
+	writeJSON(w, page)
+}
+
+func (qh *queryHandler) topChecks(w http.ResponseWriter, r *http.Request) {
+	qh.counts(w, r, qh.store.TopChecks)
+}
+
+func (qh *queryHandler) topUsers(w http.ResponseWriter, r *http.Request) {
+	qh.counts(w, r, qh.store.TopUsers)
+}
+
+func (qh *queryHandler) counts(w http.ResponseWriter, r *http.Request, query func(ctx context.Context, filter utils.EventFilter, limit int) ([]utils.EventCount, error)) {
+	filter, limit, _, ok := qh.parse(w, r, 10)
+	if !ok {
+		return
+	}
+	ctx, cancel := qh.context(r)
+	defer cancel()
+	counts, err := query(ctx, filter, limit)
+	if err != nil {
+		qh.fail(w, r, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"items": counts})
+}
+
+// parse reads the filter and pagination from the query string, writing a 400 response on errors
+func (qh *queryHandler) parse(w http.ResponseWriter, r *http.Request, defaultLimit int) (filter utils.EventFilter, limit, offset int, ok bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return filter, 0, 0, false
+	}
+	params := r.URL.Query()
+	filter = utils.EventFilter{
+		K8sID:     params.Get("k8s_id"),
+		Namespace: params.Get("namespace"),
+		Kind:      params.Get("kind"),
+		User:      params.Get("user"),
+		Result:    params.Get("result"),
+		CheckID:   params.Get("check"),
+	}
+
+	var err error
+	badRequest := func(format string, args ...interface{}) {
+		http.Error(w, fmt.Sprintf(format, args...), http.StatusBadRequest)
+	}
+	for name, target := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := params.Get(name); value != "" {
+			if *target, err = time.Parse(time.RFC3339, value); err != nil {
+				badRequest("invalid %s, expected RFC 3339 time: %v", name, err)
+				return filter, 0, 0, false
+			}
+		}
+	}
+	limit, offset = defaultLimit, 0
+	if value := params.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > qh.maxLimit {
+			badRequest("limit must be between 1 and %d", qh.maxLimit)
+			return filter, 0, 0, false
+		}
+	}
+	if value := params.Get("offset"); value != "" {
+		if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+			badRequest("offset must be a non-negative integer")
+			return filter, 0, 0, false
+		}
+	}
+	return filter, limit, offset, true
+}
+
+func (qh *queryHandler) context(r *http.Request) (context.Context, context.CancelFunc) {
+	if qh.timeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), qh.timeout)
+}
+
+func (qh *queryHandler) fail(w http.ResponseWriter, r *http.Request, err error) {
+	utils.ErrorLog("Query %s failed: %v", r.URL.Path, err)
+	http.Error(w, "query failed", http.StatusBadGateway)
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		utils.ErrorLog("Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package http
+
+import (
+	"admissioncontroller/utils"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeEventStore returns a fixed number of events and records the last filter
+type fakeEventStore struct {
+	total  int
+	filter utils.EventFilter
+}
+
+func (store *fakeEventStore) Events(ctx context.Context, filter utils.EventFilter, limit, offset int) ([]utils.EventRecord, error) {
+	store.filter = filter
+	events := []utils.EventRecord{}
+	for i := offset; i < store.total && len(events) < limit; i++ {
+		events = append(events, utils.EventRecord{RequestID: string(rune('a' + i))})
+	}
+	return events, nil
+}
+
+func (store *fakeEventStore) TopChecks(ctx context.Context, filter utils.EventFilter, limit int) ([]utils.EventCount, error) {
+	store.filter = filter
+	return []utils.EventCount{{Key: "probes", Count: 7}}, nil
+}
+
+func (store *fakeEventStore) TopUsers(ctx context.Context, filter utils.EventFilter, limit int) ([]utils.EventCount, error) {
+	store.filter = filter
+	return []utils.EventCount{{Key: "alice", Count: 3}}, nil
+}
+
+func newTestQueryServer(t *testing.T, store utils.EventStore) *httptest.Server {
+	server, err := NewQueryServer(QueryServerConfig{Tokens: []string{"secret", " other "}, MaxLimit: 50}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server.Handler)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func get(t *testing.T, url, token string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestQueryServerRequiresToken(t *testing.T) {
+	ts := newTestQueryServer(t, &fakeEventStore{})
+
+	for _, token := range []string{"", "wrong"} {
+		if resp := get(t, ts.URL+"/api/v1/events", token); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("token %q: status %d, want 401", token, resp.StatusCode)
+		}
+	}
+	if resp := get(t, ts.URL+"/api/v1/events", "other"); resp.StatusCode != http.StatusOK {
+		t.Errorf("second token: status %d, want 200", resp.StatusCode)
+	}
+	if resp := get(t, ts.URL+"/healthz", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("healthz: status %d, want 200", resp.StatusCode)
+	}
+
+	if _, err := NewQueryServer(QueryServerConfig{Tokens: []string{""}}, &fakeEventStore{}); err == nil {
+		t.Error("server without tokens was created")
+	}
+}
+
+func TestQueryServerEventsPagination(t *testing.T) {
+	store := &fakeEventStore{total: 5}
+	ts := newTestQueryServer(t, store)
+
+	resp := get(t, ts.URL+"/api/v1/events?namespace=team-a&check=probes&from=2024-05-01T00:00:00Z&limit=2&offset=2", "secret")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	var page eventsPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Events) != 2 || page.Events[0].RequestID != "c" || page.NextOffset == nil || *page.NextOffset != 4 {
+		t.Errorf("page = %+v", page)
+	}
+	want := utils.EventFilter{Namespace: "team-a", CheckID: "probes", From: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)}
+	if store.filter != want {
+		t.Errorf("filter = %+v, want %+v", store.filter, want)
+	}
+
+	resp = get(t, ts.URL+"/api/v1/events?offset=4&limit=2", "secret")
+	page = eventsPage{}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Events) != 1 || page.NextOffset != nil {
+		t.Errorf("last page = %+v", page)
+	}
+}
+
+func TestQueryServerRejectsInvalidParameters(t *testing.T) {
+	ts := newTestQueryServer(t, &fakeEventStore{})
+	for _, query := range []string{"limit=0", "limit=51", "offset=-1", "from=yesterday"} {
+		if resp := get(t, ts.URL+"/api/v1/events?"+query, "secret"); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestQueryServerAggregations(t *testing.T) {
+	store := &fakeEventStore{}
+	ts := newTestQueryServer(t, store)
+
+	for path, key := range map[string]string{"/api/v1/stats/top-checks": "probes", "/api/v1/stats/top-users": "alice"} {
+		resp := get(t, ts.URL+path+"?k8s_id=prod", "secret")
+		var body struct {
+			Items []utils.EventCount `json:"items"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body.Items) != 1 || body.Items[0].Key != key {
+			t.Errorf("%s: items = %+v", path, body.Items)
+		}
+		if store.filter.K8sID != "prod" {
+			t.Errorf("%s: filter = %+v", path, store.filter)
+		}
+	}
+}
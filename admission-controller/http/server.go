@@ -3,24 +3,76 @@ package http
 import (
 	"admissioncontroller/utils"
 	"admissioncontroller/validation"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ServerConfig holds the settings of the validation HTTPS server
+type ServerConfig struct {
+	Port              string
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxBodyBytes      int64         // The API server limits reviews to about 3MB
+	TLSMinVersion     string        // "1.2" or "1.3"
+	TLSCipherSuites   []string      // Names as in crypto/tls, applied to TLS 1.2 only. Empty means Go defaults
+	ClientCAPath      string        // If set, /validate and /track require a client certificate signed by this CA
+	AdmissionTimeout  time.Duration // Time budget for the checks, keep it below the webhook timeoutSeconds
+	TimeoutPolicy     string        // TimeoutFailOpen or TimeoutFailClosed
+	ObserverMode      func() bool   // Allow requests with violations, may change on config reload
+	EvaluateTokens    []string      // Bearer tokens of the /v1/evaluate dry run endpoint, it is disabled if empty
+	// Key pair served to clients, see utils.ServingCert. Start the server with ListenAndServeTLS("", "")
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// Decisions for requests which ran out of the time budget
+const (
+	TimeoutFailOpen   = "fail-open"
+	TimeoutFailClosed = "fail-closed"
 )
 
 // NewServer creates and return main http.Server
-func NewServer(port string) *http.Server {
-	validationHook := validation.NewValidationHook()
+func NewServer(cfg ServerConfig) (*http.Server, error) {
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TimeoutPolicy != TimeoutFailOpen && cfg.TimeoutPolicy != TimeoutFailClosed {
+		return nil, fmt.Errorf("unknown timeout policy %q, expected %s or %s", cfg.TimeoutPolicy, TimeoutFailOpen, TimeoutFailClosed)
+	}
 
-	ah := newAdmissionHandler()
+	if cfg.ObserverMode == nil {
+		cfg.ObserverMode = func() bool { return false }
+	}
+
+	validationHook := validation.NewValidationHook(cfg.ObserverMode)
+
+	ah := newAdmissionHandler(cfg)
+	requireClientCert := cfg.ClientCAPath != ""
 	mux := http.NewServeMux()
 	mux.Handle("/healthz", healthz())
-	mux.Handle("/validate", ah.Serve(validationHook)) // Main validation endpoint
-	mux.Handle("/track", ah.ServeTrack())             // Tracking endpoint, no validation
+	mux.Handle("/readyz", readyz())
+	mux.Handle("/validate", trackInFlight("/validate", clientCertAuth(requireClientCert, ah.Serve(validationHook)))) // Main validation endpoint
+	mux.Handle("/track", trackInFlight("/track", clientCertAuth(requireClientCert, ah.ServeTrack())))                // Tracking endpoint, no validation
+	if len(cfg.EvaluateTokens) > 0 {
+		mux.Handle("/v1/evaluate", trackInFlight("/v1/evaluate", tokenAuth(cfg.EvaluateTokens, ah.ServeEvaluate(validationHook)))) // Dry run of raw manifests for kubectl and CI
+	}
 
 	return &http.Server{
-		Addr:    fmt.Sprintf(":%s", port),
-		Handler: mux,
-	}
+		Addr:              fmt.Sprintf(":%s", cfg.Port),
+		Handler:           mux,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}, nil
 }
 
 // NewMetricsServer creates and return Prometheus metrics server
@@ -29,7 +81,76 @@ func NewMetricsServer(metricsPort string) *http.Server {
 	mux.Handle("/metrics", utils.ServeMetrics()) // Metrics endpoint
 
 	return &http.Server{
-		Addr:    fmt.Sprintf(":%s", metricsPort),
-		Handler: mux,
+		Addr:              fmt.Sprintf(":%s", metricsPort),
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
 	}
 }
+
+func newTLSConfig(cfg ServerConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{GetCertificate: cfg.GetCertificate}
+
+	switch cfg.TLSMinVersion {
+	case "1.2", "":
+		tlsConfig.MinVersion = tls.VersionTLS12
+	case "1.3":
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported TLS min version %q, expected 1.2 or 1.3", cfg.TLSMinVersion)
+	}
+
+	if len(cfg.TLSCipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range cfg.TLSCipherSuites {
+			id, ok := suites[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure TLS cipher suite %q", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+
+	if cfg.ClientCAPath != "" {
+		caPEM, err := os.ReadFile(cfg.ClientCAPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in client CA %s", cfg.ClientCAPath)
+		}
+		tlsConfig.ClientCAs = pool
+		// Probes from kubelet come without a client certificate, so it is enforced per endpoint in clientCertAuth
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// clientCertAuth rejects requests without a verified client certificate when required is true
+func clientCertAuth(required bool, next http.Handler) http.Handler {
+	if !required {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			utils.ErrorLog("Rejected request to %s from %s: no verified client certificate", r.URL.Path, r.RemoteAddr)
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// trackInFlight counts requests being processed by the handler
+func trackInFlight(path string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gauge := utils.InFlightRequests.WithLabelValues(path, utils.GetK8SId())
+		gauge.Inc()
+		defer gauge.Dec()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,136 @@
+package http
+
+import (
+	"admissioncontroller/utils"
+	"admissioncontroller/utils/certtest"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	files := certtest.Write(t, 24*time.Hour, 24*time.Hour)
+	empty := filepath.Join(t.TempDir(), "empty.crt")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		cfg  ServerConfig
+		err  string // Part of the expected error, empty if the config is valid
+	}{
+		{name: "defaults", cfg: ServerConfig{}},
+		{name: "TLS 1.3", cfg: ServerConfig{TLSMinVersion: "1.3"}},
+		{name: "unknown min version", cfg: ServerConfig{TLSMinVersion: "1.1"}, err: "unsupported TLS min version"},
+		{name: "cipher suites", cfg: ServerConfig{TLSCipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", " TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}}},
+		{name: "insecure cipher suite", cfg: ServerConfig{TLSCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, err: "unknown or insecure TLS cipher suite"},
+		{name: "unknown cipher suite", cfg: ServerConfig{TLSCipherSuites: []string{"TLS_FAST"}}, err: "unknown or insecure TLS cipher suite"},
+		{name: "client CA", cfg: ServerConfig{ClientCAPath: files.CA}},
+		{name: "missing client CA", cfg: ServerConfig{ClientCAPath: filepath.Join(t.TempDir(), "ca.crt")}, err: "failed to read client CA"},
+		{name: "empty client CA", cfg: ServerConfig{ClientCAPath: empty}, err: "no certificates found in client CA"},
+	} {
+		tlsConfig, err := newTLSConfig(c.cfg)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: error %v, want %q", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if want := map[string]uint16{"": tls.VersionTLS12, "1.3": tls.VersionTLS13}[c.cfg.TLSMinVersion]; tlsConfig.MinVersion != want {
+			t.Errorf("%s: min version %x, want %x", c.name, tlsConfig.MinVersion, want)
+		}
+		if len(tlsConfig.CipherSuites) != len(c.cfg.TLSCipherSuites) {
+			t.Errorf("%s: %d cipher suites, want %d", c.name, len(tlsConfig.CipherSuites), len(c.cfg.TLSCipherSuites))
+		}
+		// Probes come without a client certificate, the handshake must not require it
+		if c.cfg.ClientCAPath != "" && (tlsConfig.ClientAuth != tls.VerifyClientCertIfGiven || tlsConfig.ClientCAs == nil) {
+			t.Errorf("%s: client auth %v", c.name, tlsConfig.ClientAuth)
+		}
+	}
+}
+
+// TestServerClientCertAuth runs the validation server over TLS with a client CA
+func TestServerClientCertAuth(t *testing.T) {
+	files := certtest.Write(t, 24*time.Hour, 24*time.Hour)
+	served, err := utils.NewServingCert(files.Cert, files.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(ServerConfig{
+		MaxBodyBytes:   1024,
+		ClientCAPath:   files.CA,
+		TimeoutPolicy:  TimeoutFailClosed,
+		GetCertificate: served.GetCertificate,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(listener, "", "")
+	t.Cleanup(func() { server.Close() })
+
+	caPEM, err := os.ReadFile(files.CA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	clientCert, err := tls.LoadX509KeyPair(files.Cert, files.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			ServerName:   certtest.LeafSubject,
+			Certificates: certs,
+		}}}
+	}
+	anonymous, authenticated := client(), client(clientCert)
+	url := "https://" + listener.Addr().String()
+
+	for _, c := range []struct {
+		name   string
+		client *http.Client
+		method string
+		path   string
+		body   []byte
+		status int
+	}{
+		{"healthz without certificate", anonymous, http.MethodGet, "/healthz", nil, http.StatusOK},
+		{"readyz without certificate", anonymous, http.MethodGet, "/readyz", nil, http.StatusOK},
+		{"validate without certificate", anonymous, http.MethodPost, "/validate", []byte("{}"), http.StatusUnauthorized},
+		{"track without certificate", anonymous, http.MethodPost, "/track", []byte("{}"), http.StatusUnauthorized},
+		{"validate with certificate", authenticated, http.MethodPost, "/validate", []byte("{}"), http.StatusBadRequest},
+		{"body over the limit", authenticated, http.MethodPost, "/validate", bytes.Repeat([]byte(" "), 2048), http.StatusRequestEntityTooLarge},
+	} {
+		req, err := http.NewRequest(c.method, url+c.path, bytes.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := c.client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: status %d, want %d", c.name, resp.StatusCode, c.status)
+		}
+	}
+}
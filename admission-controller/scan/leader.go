@@ -0,0 +1,67 @@
+package scan
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"admissioncontroller/utils"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Lease names the coordination.k8s.io Lease held by the replica which runs the scans
+type Lease struct {
+	Namespace string
+	Name      string
+	Identity  string // Unique per replica, the pod name
+}
+
+// Election timings: a replica which stops renewing the lease loses it after leaseDuration
+var (
+	leaseDuration = 30 * time.Second
+	renewDeadline = 20 * time.Second
+	retryPeriod   = 5 * time.Second
+)
+
+// RunElected runs the scans like Run, but only while the replica holds the lease. Every replica of the
+// deployment competes for it, so the sinks and the scan metrics get a single copy of each scan.
+// It returns when the context is cancelled
+func (s *Scanner) RunElected(ctx context.Context, lease Lease, interval time.Duration) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: lease.Namespace, Name: lease.Name},
+		Client:     s.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: lease.Identity},
+	}
+	for ctx.Err() == nil {
+		var leading atomic.Bool // Set by the goroutine of OnStartedLeading
+		stopped := make(chan struct{})
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   leaseDuration,
+			RenewDeadline:   renewDeadline,
+			RetryPeriod:     retryPeriod,
+			ReleaseOnCancel: true, // The next replica takes over right away on shutdown
+			Name:            lease.Name,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					leading.Store(true)
+					defer close(stopped)
+					utils.InfoLog("Acquired lease %s/%s, scanning cluster objects every %s", lease.Namespace, lease.Name, interval)
+					utils.ScanLeader.WithLabelValues(utils.GetK8SId()).Set(1)
+					s.Run(ctx, interval)
+				},
+				OnStoppedLeading: func() {
+					if !leading.Load() {
+						return // Called on return even if the lease was never acquired
+					}
+					<-stopped // The context is already cancelled, the last scan doesn't publish after the cleanup
+					utils.InfoLog("Released lease %s/%s, cluster scans stopped", lease.Namespace, lease.Name)
+					unpublish()
+				},
+			},
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package scan
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"admissioncontroller/utils/audittest"
+	"admissioncontroller/validation"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRunElectedScansOnOneReplica(t *testing.T) {
+	leaseDuration, renewDeadline, retryPeriod = 2*time.Second, time.Second, 100*time.Millisecond // Leases are stored in whole seconds
+	t.Cleanup(func() { leaseDuration, renewDeadline, retryPeriod = 30*time.Second, 20*time.Second, 5*time.Second })
+	sink := audittest.Install(t)
+
+	client := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "prod"}}, deployment("prod"))
+	hook := validation.NewValidationHook(func() bool { return false })
+	cancels := map[string]context.CancelFunc{}
+	for _, identity := range []string{"replica-a", "replica-b"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		cancels[identity] = cancel
+		lease := Lease{Namespace: "admission-controller", Name: "scanner", Identity: identity}
+		go NewScanner(client, hook).RunElected(ctx, lease, time.Hour)
+	}
+
+	// Each scan audits the single deployment once
+	waitForEvents := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for len(sink.Events()) < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("got %d audit events, want %d", len(sink.Events()), n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForEvents(1)
+	time.Sleep(3 * retryPeriod)
+	if got := len(sink.Events()); got != 1 {
+		t.Fatalf("got %d audit events, want 1: both replicas scanned", got)
+	}
+
+	// The leader releases the lease on shutdown, the other replica takes over
+	lease, err := client.CoordinationV1().Leases("admission-controller").Get(context.Background(), "scanner", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader := *lease.Spec.HolderIdentity
+	cancels[leader]()
+	waitForEvents(2)
+	lease, err = client.CoordinationV1().Leases("admission-controller").Get(context.Background(), "scanner", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder := *lease.Spec.HolderIdentity; holder == leader || holder == "" {
+		t.Errorf("lease holder %q after %s released it", holder, leader)
+	}
+}
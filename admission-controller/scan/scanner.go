@@ -0,0 +1,219 @@
+// Package scan runs the objects which already exist in the cluster through the admission hook. It finds
+// objects created before a check was added, in observer mode or while the webhook was unavailable
+package scan
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"admissioncontroller"
+	"admissioncontroller/evaluate"
+	"admissioncontroller/utils"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/pager"
+)
+
+// User is the user of the simulated admission requests
+const User = "system:admission-controller:scanner"
+
+// excludedNamespaces selects the namespaces skipped by the namespaceSelector of the webhook
+const excludedNamespaces = "admission-control=false"
+
+// lister lists the objects of a kind in all namespaces
+type lister struct {
+	gvk  schema.GroupVersionKind
+	list func(ctx context.Context, client kubernetes.Interface, opts metav1.ListOptions) (runtime.Object, error)
+}
+
+// listers cover validation.ValidatedKinds, a new kind needs a lister and list permissions in the chart
+var listers = []lister{
+	{
+		gvk: schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+		list: func(ctx context.Context, client kubernetes.Interface, opts metav1.ListOptions) (runtime.Object, error) {
+			return client.AppsV1().Deployments(metav1.NamespaceAll).List(ctx, opts)
+		},
+	},
+	{
+		gvk: schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"},
+		list: func(ctx context.Context, client kubernetes.Interface, opts metav1.ListOptions) (runtime.Object, error) {
+			return client.AppsV1().StatefulSets(metav1.NamespaceAll).List(ctx, opts)
+		},
+	},
+	{
+		gvk: schema.GroupVersionKind{Version: "v1", Kind: "Service"},
+		list: func(ctx context.Context, client kubernetes.Interface, opts metav1.ListOptions) (runtime.Object, error) {
+			return client.CoreV1().Services(metav1.NamespaceAll).List(ctx, opts)
+		},
+	},
+}
+
+// Summary counts the results of a scan
+type Summary struct {
+	Objects    map[string]map[string]int // Kind -> result (allowed, allowed_observer, denied or error) -> objects
+	Violations map[string]map[string]int // Kind -> check -> violations
+	Duration   time.Duration
+}
+
+func (s Summary) add(kind string, result evaluate.Result) {
+	if s.Objects[kind] == nil {
+		s.Objects[kind] = map[string]int{}
+		s.Violations[kind] = map[string]int{}
+	}
+	s.Objects[kind][resultLabel(result)]++
+	for _, v := range result.Violations {
+		s.Violations[kind][v.CheckID]++
+	}
+}
+
+// resultLabel maps the result to the audit result of the decision
+func resultLabel(result evaluate.Result) string {
+	switch {
+	case result.Err != nil:
+		return utils.AuditError
+	case result.Denied():
+		return utils.AuditDenied
+	case len(result.Violations) > 0:
+		return utils.AuditAllowedObserver
+	}
+	return utils.AuditAllowed
+}
+
+// Scanner lists the objects and evaluates them with the same hook as the webhook. The decisions are
+// audited with the request type "audit"
+type Scanner struct {
+	client kubernetes.Interface
+	hook   admissioncontroller.Hook
+}
+
+// NewScanner creates a scanner, the client needs to list namespaces and the validated kinds
+func NewScanner(client kubernetes.Interface, hook admissioncontroller.Hook) *Scanner {
+	return &Scanner{client: client, hook: hook}
+}
+
+// Scan evaluates all objects of the validated kinds outside of the excluded namespaces
+func (s *Scanner) Scan(ctx context.Context) (Summary, error) {
+	startTime := time.Now()
+	summary := Summary{Objects: map[string]map[string]int{}, Violations: map[string]map[string]int{}}
+
+	excluded, err := s.excludedNamespaces(ctx)
+	if err != nil {
+		return summary, err
+	}
+	evalCtx := utils.WithRequestType(ctx, utils.RequestTypeAudit)
+	opts := evaluate.Options{Operation: v1.Create, UserInfo: authenticationv1.UserInfo{Username: User}}
+
+	for _, l := range listers {
+		list := pager.New(func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+			return l.list(ctx, s.client, opts)
+		})
+		err := list.EachListItem(ctx, metav1.ListOptions{}, func(obj runtime.Object) error {
+			content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+			if err != nil {
+				return err
+			}
+			object := &unstructured.Unstructured{Object: content}
+			if excluded[object.GetNamespace()] {
+				return nil
+			}
+			object.SetGroupVersionKind(l.gvk) // Items of typed lists have no kind
+			manifest := evaluate.Manifest{Object: object}
+			for _, result := range evaluate.Evaluate(evalCtx, s.hook, []evaluate.Manifest{manifest}, opts) {
+				summary.add(l.gvk.Kind, result)
+			}
+			return ctx.Err()
+		})
+		if err != nil {
+			return summary, fmt.Errorf("failed to list %s objects: %v", l.gvk.Kind, err)
+		}
+	}
+	summary.Duration = time.Since(startTime)
+	return summary, nil
+}
+
+func (s *Scanner) excludedNamespaces(ctx context.Context) (map[string]bool, error) {
+	namespaces, err := s.client.CoreV1().Namespaces().List(ctx, metav1.ListOptions{LabelSelector: excludedNamespaces})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %v", err)
+	}
+	excluded := make(map[string]bool, len(namespaces.Items))
+	for _, namespace := range namespaces.Items {
+		excluded[namespace.Name] = true
+	}
+	return excluded, nil
+}
+
+// Run scans right away and then every interval until the context is cancelled
+func (s *Scanner) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.scanAndReport(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Scanner) scanAndReport(ctx context.Context) {
+	summary, err := s.Scan(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		utils.ScanFailures.WithLabelValues(utils.GetK8SId()).Inc()
+		utils.ErrorLog("Cluster scan failed: %v", err)
+		return
+	}
+	publish(summary)
+
+	totals := map[string]int{}
+	for _, results := range summary.Objects {
+		for result, n := range results {
+			totals[result] += n
+		}
+	}
+	fields := log.Fields{"scan_duration": summary.Duration.String()}
+	for result, n := range totals {
+		fields["objects_"+result] = n
+	}
+	utils.Log.WithFields(fields).Info("Cluster scan finished")
+}
+
+// publish replaces the metrics of the previous scan
+func publish(summary Summary) {
+	k8sID := utils.GetK8SId()
+	utils.ScanObjects.Reset()
+	for kind, results := range summary.Objects {
+		for result, n := range results {
+			utils.ScanObjects.WithLabelValues(kind, result, k8sID).Set(float64(n))
+		}
+	}
+	utils.ScanViolations.Reset()
+	for kind, checks := range summary.Violations {
+		for check, n := range checks {
+			utils.ScanViolations.WithLabelValues(check, kind, k8sID).Set(float64(n))
+		}
+	}
+	utils.ScanDuration.WithLabelValues(k8sID).Set(summary.Duration.Seconds())
+	utils.ScanLastSuccess.WithLabelValues(k8sID).SetToCurrentTime()
+}
+
+// unpublish removes the scan metrics of a replica which stopped scanning, so only the current leader reports them
+func unpublish() {
+	utils.ScanObjects.Reset()
+	utils.ScanViolations.Reset()
+	utils.ScanDuration.Reset()
+	utils.ScanLastSuccess.Reset()
+	utils.ScanLeader.WithLabelValues(utils.GetK8SId()).Set(0)
+}
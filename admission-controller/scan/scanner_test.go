@@ -0,0 +1,88 @@
+package scan
+
+import (
+	"context"
+	"testing"
+
+	"admissioncontroller/utils"
+	"admissioncontroller/utils/audittest"
+	"admissioncontroller/validation"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// deployment has two containers without probes, one of them with the latest tag
+func deployment(namespace string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: namespace, UID: types.UID("uid-" + namespace)},
+		Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "app", Image: "app:1.0"},
+			{Name: "sidecar", Image: "proxy:latest"},
+		}}}},
+	}
+}
+
+func TestScan(t *testing.T) {
+	sink := audittest.Install(t)
+
+	client := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system", Labels: map[string]string{"admission-control": "false"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "prod"}},
+		deployment("prod"),
+		deployment("kube-system"),
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "prod"},
+			Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeClusterIP},
+		},
+	)
+	scanner := NewScanner(client, validation.NewValidationHook(func() bool { return false }))
+
+	summary, err := scanner.Scan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := summary.Objects["Deployment"][utils.AuditDenied]; got != 1 {
+		t.Errorf("denied deployments = %d, want 1: the excluded namespace must be skipped", got)
+	}
+	if got := summary.Objects["Service"][utils.AuditAllowed]; got != 1 {
+		t.Errorf("allowed services = %d, want 1", got)
+	}
+	if got := summary.Violations["Deployment"][validation.CheckProbes]; got != 2 {
+		t.Errorf("probes violations = %d, want 2", got)
+	}
+
+	events := sink.Events()
+	if len(events) != 2 {
+		t.Fatalf("got %d audit events, want 2", len(events))
+	}
+	for _, event := range events {
+		if event.RequestType != utils.RequestTypeAudit || event.UserID != User || event.TargetNamespace != "prod" {
+			t.Errorf("audit event: request type %q, user %q, namespace %q", event.RequestType, event.UserID, event.TargetNamespace)
+		}
+	}
+	if event := events[0]; event.RequestID != "uid-prod" || event.Result != utils.AuditDenied {
+		t.Errorf("deployment audit event: request id %q, result %s", event.RequestID, event.Result)
+	}
+
+	publish(summary)
+	if got := testutil.ToFloat64(utils.ScanObjects.WithLabelValues("Deployment", utils.AuditDenied, utils.GetK8SId())); got != 1 {
+		t.Errorf("scan_objects for denied deployments = %v, want 1", got)
+	}
+}
+
+func TestListersCoverValidatedKinds(t *testing.T) {
+	listed := map[string]bool{}
+	for _, l := range listers {
+		listed[l.gvk.Kind] = true
+	}
+	for _, kind := range validation.ValidatedKinds {
+		if !listed[kind] {
+			t.Errorf("%s is validated but not scanned", kind)
+		}
+	}
+}
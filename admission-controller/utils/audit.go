@@ -0,0 +1,219 @@
+package utils
+
+import (
+	"admissioncontroller"
+	"admissioncontroller/config"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v1 "k8s.io/api/admission/v1"
+)
+
+// Results of an admission decision in AuditEvent.Result
+const (
+	AuditAllowed         = "allowed"
+	AuditAllowedObserver = "allowed_observer" // Had violations, allowed because observer mode is on
+	AuditDenied          = "denied"
+	AuditError           = "error"   // The request could not be evaluated
+	AuditTimeout         = "timeout" // Checks didn't finish in time, the decision was made by the timeout policy
+	AuditTracked         = "tracked" // Requests to /track, always allowed
+)
+
+// Request types of evaluations which don't come from the API server. They are left out of the request metrics
+const (
+	RequestTypeAudit  = "audit"   // Existing objects checked by the cluster scanner
+	RequestTypeDryRun = "dry_run" // Manifests sent to /v1/evaluate, not audited
+)
+
+type requestTypeKey struct{}
+
+// WithRequestType marks the requests evaluated with the context, e.g. as RequestTypeAudit
+func WithRequestType(ctx context.Context, requestType string) context.Context {
+	return context.WithValue(ctx, requestTypeKey{}, requestType)
+}
+
+// RequestType returns the request type set with WithRequestType or the lower case operation of the request
+func RequestType(ctx context.Context, r *v1.AdmissionRequest) string {
+	if requestType, ok := ctx.Value(requestTypeKey{}).(string); ok {
+		return requestType
+	}
+	return strings.ToLower(string(r.Operation))
+}
+
+type auditClaimKey struct{}
+
+// WithAuditClaim lets exactly one of the parties which can answer the request with the context audit it:
+// the hook with its decision or the HTTP handler after the timeout
+func WithAuditClaim(ctx context.Context) context.Context {
+	return context.WithValue(ctx, auditClaimKey{}, new(atomic.Bool))
+}
+
+// ClaimAudit reports whether the caller is the first to claim the audit event of the request.
+// Without WithAuditClaim every caller gets it
+func ClaimAudit(ctx context.Context) bool {
+	claim, ok := ctx.Value(auditClaimKey{}).(*atomic.Bool)
+	return !ok || claim.CompareAndSwap(false, true)
+}
+
+// AuditEvent describes a single admission decision
+type AuditEvent struct {
+	Time            time.Time     `json:"time"`
+	K8sID           string        `json:"k8s_id"`
+	RequestID       string        `json:"request_id"`
+	RequestType     string        `json:"request_type"` // Lower case operation: create, update..., or audit for cluster scans
+	UserID          string        `json:"user_id"`
+	UserName        string        `json:"user_name"`
+	UserGroups      []string      `json:"user_groups"`
+	TargetNamespace string        `json:"target_namespace"`
+	TargetKind      string        `json:"target_kind"`
+	TargetName      string        `json:"target_name"`
+	Result          string        `json:"admission_result"`
+	Reason          string        `json:"admission_reason"`
+	ProcessingTime  time.Duration `json:"processing_time_ns"`
+	ObserverMode    bool          `json:"observer_mode"`
+	ConfigVersion   string        `json:"config_version"` // Version of the configuration which made the decision
+
+	Violations []admissioncontroller.Violation `json:"violations,omitempty"` // Set for denied and allowed_observer requests
+
+	// Redacted request objects, see SnapshotConfig
+	Object            json.RawMessage `json:"object,omitempty"`
+	OldObject         json.RawMessage `json:"old_object,omitempty"`
+	SnapshotTruncated bool            `json:"snapshot_truncated,omitempty"` // An object was left out because of its size
+
+	request *v1.AdmissionRequest // Source of the snapshot, set by NewAuditEvent
+}
+
+// NewAuditEvent fills the request fields of an event
+func NewAuditEvent(r *v1.AdmissionRequest) AuditEvent {
+	var username string
+	if usernames, ok := r.UserInfo.Extra["username"]; ok && len(usernames) > 0 {
+		username = usernames[0]
+	}
+	groups := r.UserInfo.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	return AuditEvent{
+		Time:            time.Now().UTC(),
+		K8sID:           k8sID,
+		RequestID:       string(r.UID),
+		RequestType:     strings.ToLower(string(r.Operation)),
+		UserID:          r.UserInfo.Username,
+		UserName:        username,
+		UserGroups:      groups,
+		TargetNamespace: r.Namespace,
+		TargetKind:      r.Kind.Kind,
+		TargetName:      r.Name,
+		ConfigVersion:   GetConfigVersion(),
+		request:         r,
+	}
+}
+
+// AuditSink receives audit events. Write is called on the request path, so it must not block on slow backends
+type AuditSink interface {
+	Write(event AuditEvent)
+	// Close flushes buffered events until the context is done
+	Close(ctx context.Context) error
+}
+
+// MultiAuditSink sends every event to all of its sinks
+type MultiAuditSink []AuditSink
+
+func (m MultiAuditSink) Write(event AuditEvent) {
+	for _, sink := range m {
+		sink.Write(event)
+	}
+}
+
+func (m MultiAuditSink) Close(ctx context.Context) error {
+	var errs []error
+	for _, sink := range m {
+		errs = append(errs, sink.Close(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+var (
+	auditLock  sync.RWMutex
+	auditSinks MultiAuditSink
+)
+
+// AddAuditSink adds a sink which receives every following event
+func AddAuditSink(sink AuditSink) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	auditSinks = append(auditSinks, sink)
+}
+
+// EmitAudit sends the event to all configured sinks
+func EmitAudit(event AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if event.UserGroups == nil {
+		event.UserGroups = []string{}
+	}
+	if event.request != nil {
+		captureSnapshot(&event, event.request)
+	}
+	auditLock.RLock()
+	defer auditLock.RUnlock()
+	auditSinks.Write(event)
+}
+
+// ConnectAuditSinks starts the configured sinks: ClickHouse (clickhouse.host), a JSONL file (audit.filePath)
+// and an HTTP endpoint (audit.httpURL). Any number of them can be active.
+// ClickHouse names may depend on the cluster ID, so it is called after SetK8SId. Object snapshots
+// are set up separately with SetSnapshotConfig, they can change on config reload
+func ConnectAuditSinks(cfg config.Config) {
+	connectToClickHouse(cfg.ClickHouse)
+
+	if path := cfg.Audit.FilePath; path != "" {
+		sink, err := NewFileAuditSink(FileAuditSinkConfig{
+			Path:       path,
+			MaxBytes:   int64(cfg.Audit.FileMaxMB) << 20,
+			MaxBackups: cfg.Audit.FileMaxBackups,
+			QueueSize:  cfg.Audit.FileQueueSize,
+		})
+		if err != nil {
+			ErrorLog("Failed to open audit file: %v", err)
+		} else {
+			InfoLog("Writing audit events to %s", path)
+			AddAuditSink(sink)
+		}
+	}
+
+	if url := cfg.Audit.HTTPURL; url != "" {
+		sink, err := NewHTTPAuditSink(HTTPAuditSinkConfig{
+			URL:           url,
+			Token:         cfg.Audit.HTTPToken,
+			Timeout:       cfg.Audit.HTTPTimeout.D(),
+			BatchSize:     cfg.Audit.HTTPBatchSize,
+			FlushInterval: cfg.Audit.HTTPFlushInterval.D(),
+			QueueSize:     cfg.Audit.HTTPQueueSize,
+		})
+		if err != nil {
+			ErrorLog("Failed to start audit HTTP sink: %v", err)
+		} else {
+			InfoLog("Sending audit events over HTTP")
+			AddAuditSink(sink)
+		}
+	}
+}
+
+// CloseAuditSinks flushes and closes all sinks
+func CloseAuditSinks(ctx context.Context) {
+	auditLock.Lock()
+	sinks := auditSinks
+	auditSinks = nil
+	auditLock.Unlock()
+
+	if err := sinks.Close(ctx); err != nil {
+		ErrorLog("Failed to flush audit events: %v", err)
+	}
+}
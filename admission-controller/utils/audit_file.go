@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// FileAuditSinkConfig holds settings of the JSONL file sink
+type FileAuditSinkConfig struct {
+	Path       string
+	MaxBytes   int64 // The file is rotated once it grows past this size
+	MaxBackups int   // Rotated files kept as Path.1 (newest) ... Path.N, older ones are removed
+	QueueSize  int   // Events buffered in memory, new events are dropped when it is full
+}
+
+// FileAuditSink writes events as JSON lines from a background goroutine and rotates the file by size,
+// so a slow volume doesn't hold up admission requests
+type FileAuditSink struct {
+	cfg   FileAuditSinkConfig
+	queue chan AuditEvent
+	done  chan struct{}
+
+	lock   sync.RWMutex // Held for reading by Write, so Close never closes the queue under a sender
+	closed bool
+
+	file *os.File // Used by the writer goroutine only
+	size int64
+}
+
+func NewFileAuditSink(cfg FileAuditSinkConfig) (*FileAuditSink, error) {
+	if cfg.MaxBytes <= 0 {
+		return nil, fmt.Errorf("audit file size limit must be positive")
+	}
+	if cfg.MaxBackups < 0 {
+		return nil, fmt.Errorf("number of audit file backups must not be negative")
+	}
+	if cfg.QueueSize <= 0 {
+		return nil, fmt.Errorf("audit file queue size must be positive")
+	}
+	s := &FileAuditSink{
+		cfg:   cfg,
+		queue: make(chan AuditEvent, cfg.QueueSize),
+		done:  make(chan struct{}),
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *FileAuditSink) open() error {
+	file, err := os.OpenFile(s.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+func (s *FileAuditSink) Write(event AuditEvent) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		auditDroppedEvents.WithLabelValues("file", "closed", k8sID).Inc()
+		return
+	}
+	select {
+	case s.queue <- event:
+	default:
+		auditDroppedEvents.WithLabelValues("file", "queue_full", k8sID).Inc()
+	}
+}
+
+func (s *FileAuditSink) run() {
+	defer close(s.done)
+	for event := range s.queue {
+		s.write(event)
+	}
+	if s.file != nil {
+		if err := s.file.Close(); err != nil {
+			Log.Warnf("Failed to close audit file %s: %v", s.cfg.Path, err)
+		}
+		s.file = nil
+	}
+}
+
+func (s *FileAuditSink) write(event AuditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		auditDroppedEvents.WithLabelValues("file", "write_error", k8sID).Inc()
+		return
+	}
+	line = append(line, '\n')
+
+	if s.file != nil && s.size > 0 && s.size+int64(len(line)) > s.cfg.MaxBytes {
+		if err := s.rotate(); err != nil {
+			Log.Warnf("Failed to rotate audit file %s: %v", s.cfg.Path, err)
+		}
+	}
+	if s.file == nil {
+		// Rotation failed after closing the file, keep appending to it
+		if err := s.open(); err != nil {
+			auditDroppedEvents.WithLabelValues("file", "write_error", k8sID).Inc()
+			return
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		Log.Warnf("Failed to write audit event to %s: %v", s.cfg.Path, err)
+		auditDroppedEvents.WithLabelValues("file", "write_error", k8sID).Inc()
+	}
+}
+
+// rotate shifts Path.N-1 to Path.N ... Path to Path.1 and opens a new file
+func (s *FileAuditSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	if s.cfg.MaxBackups == 0 {
+		if err := os.Remove(s.cfg.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return s.open()
+	}
+	for i := s.cfg.MaxBackups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", s.cfg.Path, i), fmt.Sprintf("%s.%d", s.cfg.Path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(s.cfg.Path, s.cfg.Path+".1"); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+// Close writes queued events and closes the file. Events still queued when the context is done are lost
+func (s *FileAuditSink) Close(ctx context.Context) error {
+	s.lock.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.lock.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("audit file sink: %v", ctx.Err())
+	}
+}
@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HTTPAuditSinkConfig holds settings of the HTTP sink
+type HTTPAuditSinkConfig struct {
+	URL           string
+	Token         string        // Sent as a bearer token if set
+	Timeout       time.Duration // Time limit for a single POST
+	BatchSize     int           // Events per POST
+	FlushInterval time.Duration // Maximum time an event waits in a partial batch
+	QueueSize     int           // Events buffered in memory, new events are dropped when it is full
+	Client        *http.Client  // http.DefaultClient with Timeout if not set
+}
+
+// HTTPAuditSink POSTs batches of events as a JSON array from a background goroutine.
+// A batch which still fails after a few attempts is dropped
+type HTTPAuditSink struct {
+	cfg    HTTPAuditSinkConfig
+	client *http.Client
+	queue  chan AuditEvent
+	done   chan struct{}
+	ctx    context.Context // Cancelled when Close gives up, stops retries and requests in flight
+	cancel context.CancelFunc
+
+	lock   sync.RWMutex // Held for reading by Write, so Close never closes the queue under a sender
+	closed bool
+}
+
+const httpAuditAttempts = 3
+
+func NewHTTPAuditSink(cfg HTTPAuditSinkConfig) (*HTTPAuditSink, error) {
+	if cfg.BatchSize <= 0 || cfg.QueueSize <= 0 || cfg.FlushInterval <= 0 || cfg.Timeout <= 0 {
+		return nil, fmt.Errorf("batch size, queue size, flush interval and timeout must be positive")
+	}
+	client := cfg.Client
+	if client == nil {
+		client = &http.Client{Timeout: cfg.Timeout}
+	}
+	s := &HTTPAuditSink{
+		cfg:    cfg,
+		client: client,
+		queue:  make(chan AuditEvent, cfg.QueueSize),
+		done:   make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	go s.run()
+	return s, nil
+}
+
+func (s *HTTPAuditSink) Write(event AuditEvent) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		auditDroppedEvents.WithLabelValues("http", "closed", k8sID).Inc()
+		return
+	}
+	select {
+	case s.queue <- event:
+	default:
+		auditDroppedEvents.WithLabelValues("http", "queue_full", k8sID).Inc()
+	}
+}
+
+// Close sends queued events and stops the sink. When the context is done pending retries are abandoned
+// and events still queued are lost
+func (s *HTTPAuditSink) Close(ctx context.Context) error {
+	s.lock.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.lock.Unlock()
+
+	select {
+	case <-s.done:
+		s.cancel()
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		return fmt.Errorf("audit HTTP sink: %v", ctx.Err())
+	}
+}
+
+func (s *HTTPAuditSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]AuditEvent, 0, s.cfg.BatchSize)
+	for {
+		select {
+		case event, ok := <-s.queue:
+			if !ok {
+				s.send(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= s.cfg.BatchSize {
+				s.send(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			s.send(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (s *HTTPAuditSink) send(batch []AuditEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		auditDroppedEvents.WithLabelValues("http", "write_error", k8sID).Add(float64(len(batch)))
+		return
+	}
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		if s.ctx.Err() != nil {
+			auditDroppedEvents.WithLabelValues("http", "closed", k8sID).Add(float64(len(batch)))
+			return
+		}
+		err = s.post(body)
+		if err == nil {
+			return
+		}
+		if attempt == httpAuditAttempts {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-s.ctx.Done():
+		}
+		backoff *= 2
+	}
+	Log.Warnf("Dropping %d audit events, HTTP sink failed: %v", len(batch), err)
+	auditDroppedEvents.WithLabelValues("http", "write_error", k8sID).Add(float64(len(batch)))
+}
+
+func (s *HTTPAuditSink) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.cfg.Token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
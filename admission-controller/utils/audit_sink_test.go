@@ -0,0 +1,23 @@
+package utils_test
+
+import (
+	"context"
+	"testing"
+
+	"admissioncontroller/utils"
+	"admissioncontroller/utils/audittest"
+)
+
+func TestMultiAuditSink(t *testing.T) {
+	first, second := &audittest.Sink{}, &audittest.Sink{}
+	sink := utils.MultiAuditSink{first, second}
+	sink.Write(utils.AuditEvent{RequestID: "request-1"})
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*audittest.Sink{first, second} {
+		if events := s.Events(); len(events) != 1 || !s.Closed() {
+			t.Errorf("sink got %d events, closed: %t", len(events), s.Closed())
+		}
+	}
+}
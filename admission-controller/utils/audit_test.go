@@ -0,0 +1,210 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func testEvent(i int) AuditEvent {
+	return AuditEvent{
+		Time:       time.Date(2024, 5, 1, 12, 0, i, 0, time.UTC),
+		RequestID:  fmt.Sprintf("request-%d", i),
+		UserGroups: []string{},
+		Result:     AuditAllowed,
+	}
+}
+
+func readAuditFile(t *testing.T, path string) []AuditEvent {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestFileAuditSinkRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	line, _ := json.Marshal(testEvent(0))
+	sink, err := NewFileAuditSink(FileAuditSinkConfig{
+		Path:       path,
+		MaxBytes:   int64(len(line)+1) * 2, // Two events per file
+		MaxBackups: 2,
+		QueueSize:  10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		sink.Write(testEvent(i))
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Events 0 and 1 were in the backup removed by the last rotation
+	for file, want := range map[string][]string{
+		path:        {"request-6"},
+		path + ".1": {"request-4", "request-5"},
+		path + ".2": {"request-2", "request-3"},
+	} {
+		events := readAuditFile(t, file)
+		if len(events) != len(want) {
+			t.Fatalf("%s has %d events, want %d", file, len(events), len(want))
+		}
+		for i, event := range events {
+			if event.RequestID != want[i] {
+				t.Errorf("%s: event %d = %s, want %s", file, i, event.RequestID, want[i])
+			}
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 exists, only 2 backups should be kept", path)
+	}
+}
+
+func TestFileAuditSinkWriteDoesNotBlock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	// The writer is not started yet, like one stuck on a slow volume
+	sink := &FileAuditSink{
+		cfg:   FileAuditSinkConfig{Path: path, MaxBytes: 1 << 20, QueueSize: 2},
+		queue: make(chan AuditEvent, 2),
+		done:  make(chan struct{}),
+	}
+
+	dropped := auditDroppedEvents.WithLabelValues("file", "queue_full", k8sID)
+	before := testutil.ToFloat64(dropped)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		sink.Write(testEvent(i))
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Write blocked for %s", elapsed)
+	}
+	if got := testutil.ToFloat64(dropped) - before; got != 3 {
+		t.Errorf("%v events dropped, want 3", got)
+	}
+
+	// The writer catches up and Close writes what is queued
+	if err := sink.open(); err != nil {
+		t.Fatal(err)
+	}
+	go sink.run()
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if events := readAuditFile(t, path); len(events) != 2 || events[1].RequestID != "request-1" {
+		t.Errorf("file has %d events, want request-0 and request-1", len(events))
+	}
+}
+
+func TestHTTPAuditSinkPostsBatches(t *testing.T) {
+	var lock sync.Mutex
+	var batches [][]AuditEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var batch []AuditEvent
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		batches = append(batches, batch)
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	sink, err := NewHTTPAuditSink(HTTPAuditSinkConfig{
+		URL:           server.URL,
+		Token:         "secret",
+		Timeout:       time.Second,
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+		QueueSize:     10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		sink.Write(testEvent(i))
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(batches) != 3 {
+		t.Fatalf("got %d batches, want 3", len(batches))
+	}
+	var got []string
+	for _, batch := range batches {
+		for _, event := range batch {
+			got = append(got, event.RequestID)
+		}
+	}
+	if fmt.Sprint(got) != "[request-0 request-1 request-2 request-3 request-4]" {
+		t.Errorf("events = %v", got)
+	}
+}
+
+func TestHTTPAuditSinkCloseStopsRetries(t *testing.T) {
+	attempts := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts <- struct{}{}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	sink, err := NewHTTPAuditSink(HTTPAuditSinkConfig{
+		URL:           server.URL,
+		Timeout:       time.Second,
+		BatchSize:     1,
+		FlushInterval: time.Hour,
+		QueueSize:     10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Write(testEvent(0))
+	<-attempts // The first attempt failed, the sink waits a second before the next one
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := sink.Close(ctx); err == nil {
+		t.Error("Close returned no error while a batch was being retried")
+	}
+	select {
+	case <-sink.done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("the sink kept retrying after Close gave up")
+	}
+	if len(attempts) != 0 {
+		t.Errorf("%d more attempts after Close", len(attempts))
+	}
+}
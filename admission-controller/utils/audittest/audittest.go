@@ -0,0 +1,66 @@
+// Package audittest provides a fake audit sink for tests of the packages which emit audit events
+package audittest
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"admissioncontroller/utils"
+)
+
+// Sink records the events written to it. It is safe for concurrent use
+type Sink struct {
+	mu     sync.Mutex
+	events []utils.AuditEvent
+	closed bool
+}
+
+// Write records the event
+func (s *Sink) Write(event utils.AuditEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+}
+
+// Close marks the sink as closed
+func (s *Sink) Close(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// Events returns the events recorded so far
+func (s *Sink) Events() []utils.AuditEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]utils.AuditEvent(nil), s.events...)
+}
+
+// Take returns the events recorded so far and forgets them
+func (s *Sink) Take() []utils.AuditEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := s.events
+	s.events = nil
+	return events
+}
+
+// Closed reports whether Close was called
+func (s *Sink) Closed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Install adds a new sink to the audit sinks of the process. The sinks are closed and removed when the test ends
+func Install(t testing.TB) *Sink {
+	t.Helper()
+	sink := &Sink{}
+	utils.AddAuditSink(sink)
+	t.Cleanup(func() {
+		utils.CloseAuditSinks(context.Background())
+	})
+	return sink
+}
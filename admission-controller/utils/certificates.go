@@ -1,48 +1,281 @@
 package utils
 
 import (
+	"bytes"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
 )
 
-func CheckCertExpiry(certPath string) (time.Time, error) {
+// CertExpiryState describes how close the certificate chain is to expiration
+type CertExpiryState int
+
+const (
+	CertStateOK CertExpiryState = iota
+	CertStateWarning
+	CertStateCritical
+)
+
+func (s CertExpiryState) String() string {
+	switch s {
+	case CertStateWarning:
+		return "warning"
+	case CertStateCritical:
+		return "critical"
+	}
+	return "ok"
+}
+
+// Modes for CERT_EXPIRY_GATE: which probe endpoint reports degraded status past the critical threshold
+const (
+	CertGateNone    = "none"
+	CertGateHealthz = "healthz"
+	CertGateReadyz  = "readyz"
+)
+
+var (
+	certWarningThreshold  = 30 * 24 * time.Hour
+	certCriticalThreshold = 7 * 24 * time.Hour
+	certGate              = CertGateNone
+
+	certStateLock sync.RWMutex
+	certState     = CertStateOK
+)
+
+// SetCertExpiryThresholds sets warning and critical thresholds for the certificate expiry check
+func SetCertExpiryThresholds(warning, critical time.Duration) error {
+	if critical <= 0 || warning <= 0 {
+		return fmt.Errorf("certificate expiry thresholds must be positive")
+	}
+	if critical > warning {
+		return fmt.Errorf("critical threshold (%s) must not be greater than warning threshold (%s)", critical, warning)
+	}
+	certWarningThreshold = warning
+	certCriticalThreshold = critical
+	return nil
+}
+
+// SetCertExpiryGate sets the probe endpoint which fails once the certificate is past the critical threshold
+func SetCertExpiryGate(gate string) error {
+	switch gate {
+	case CertGateNone, CertGateHealthz, CertGateReadyz:
+		certGate = gate
+		return nil
+	}
+	return fmt.Errorf("unknown certificate expiry gate %q, expected one of: %s, %s, %s", gate, CertGateNone, CertGateHealthz, CertGateReadyz)
+}
+
+// CertExpiryGateFailed reports whether the given probe endpoint should report degraded status
+func CertExpiryGateFailed(endpoint string) bool {
+	if certGate != endpoint {
+		return false
+	}
+	return GetCertExpiryState() == CertStateCritical
+}
+
+// GetCertExpiryState returns the state calculated by the last certificate check
+func GetCertExpiryState() CertExpiryState {
+	certStateLock.RLock()
+	defer certStateLock.RUnlock()
+	return certState
+}
+
+// LoadCertChain reads all certificates from a PEM file, leaf first
+func LoadCertChain(certPath string) ([]*x509.Certificate, error) {
 	certPEM, err := os.ReadFile(certPath)
 	if err != nil {
-		return time.Time{}, err
+		return nil, err
 	}
-	block, _ := pem.Decode(certPEM)
-	if block == nil {
-		return time.Time{}, fmt.Errorf("failed to parse certificate PEM")
+
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("failed to parse certificate PEM")
 	}
-	cert, err := x509.ParseCertificate(block.Bytes)
+	return chain, nil
+}
+
+// ServingCert holds the key pair served by the HTTPS servers through tls.Config.GetCertificate. The pair is
+// loaded once and replaced by Reload, so readiness reports the certificate in memory, not the files on disk
+type ServingCert struct {
+	certPath, keyPath string
+	pair              atomic.Pointer[servedPair]
+}
+
+// servedPair is a loaded key pair with its parsed leaf, so probes don't parse it again
+type servedPair struct {
+	cert *tls.Certificate
+	leaf *x509.Certificate
+}
+
+// NewServingCert loads the key pair
+func NewServingCert(certPath, keyPath string) (*ServingCert, error) {
+	c := &ServingCert{certPath: certPath, keyPath: keyPath}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the key pair from the files again. On error the previous pair stays in use
+func (c *ServingCert) Reload() error {
+	pair, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
 	if err != nil {
-		return time.Time{}, err
+		return fmt.Errorf("failed to load key pair: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %v", err)
+	}
+	if previous := c.pair.Swap(&servedPair{cert: &pair, leaf: leaf}); previous != nil && !bytes.Equal(previous.leaf.Raw, leaf.Raw) {
+		InfoLog("Serving the rotated TLS certificate, valid until %s", leaf.NotAfter.UTC().Format(time.RFC3339))
 	}
+	return nil
+}
+
+// GetCertificate returns the pair for tls.Config.GetCertificate
+func (c *ServingCert) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.pair.Load().cert, nil
+}
 
-	return cert.NotAfter, nil
+// Ready verifies that the served certificate is currently valid and, if the readyz gate is enabled,
+// that the chain is not past the critical expiry threshold
+func (c *ServingCert) Ready() error {
+	leaf := c.pair.Load().leaf
+	now := time.Now()
+	if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate is valid from %s to %s", leaf.NotBefore.UTC().Format(time.RFC3339), leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if CertExpiryGateFailed(CertGateReadyz) {
+		return fmt.Errorf("certificate chain is past the critical expiry threshold")
+	}
+	return nil
 }
 
-func UpdateCertExpiryMetric(certPath string) {
-	expiryTime, err := CheckCertExpiry(certPath)
+// CheckCertExpiry returns expiration time of the leaf certificate
+func CheckCertExpiry(certPath string) (time.Time, error) {
+	chain, err := LoadCertChain(certPath)
 	if err != nil {
+		return time.Time{}, err
+	}
+	return chain[0].NotAfter, nil
+}
+
+// UpdateCertExpiryMetric checks the leaf certificate, its chain and optional CA bundle, updates metrics
+// and logs a single event each time the expiry state changes. A certificate which can't be loaded counts as critical
+func UpdateCertExpiryMetric(certPath, caPath string) {
+	chain, err := LoadCertChain(certPath)
+	if err != nil {
+		// A missing or corrupt certificate can't be served after a restart either, so it trips the gate
 		ErrorLog("Error checking certificate expiry: %v", err)
+		setCertExpiryState(CertStateCritical, logrus.Fields{"cert_source": "tls", "cert_error": err.Error()})
 		return
 	}
-	InfoLog("TLS certificate expires on: %v", expiryTime.Format("January 2, 2006 15:04:05"))
+	DebugLog("TLS certificate expires on: %v", chain[0].NotAfter.Format("January 2, 2006 15:04:05"))
+
+	certs := map[string][]*x509.Certificate{"tls": chain}
+	if caPath != "" {
+		caChain, err := LoadCertChain(caPath)
+		if err != nil {
+			ErrorLog("Error checking CA certificate expiry: %v", err)
+		} else {
+			certs["ca"] = caChain
+		}
+	}
 
-	secondsUntilExpiry := time.Until(expiryTime).Seconds()
 	labels := prometheus.Labels{"k8s_id": k8sID}
-	certExpiryMetric.With(labels).Set(secondsUntilExpiry)
+	certExpiryMetric.With(labels).Set(time.Until(chain[0].NotAfter).Seconds())
+	certExpiryThresholdMetric.With(prometheus.Labels{"k8s_id": k8sID, "severity": CertStateWarning.String()}).Set(certWarningThreshold.Seconds())
+	certExpiryThresholdMetric.With(prometheus.Labels{"k8s_id": k8sID, "severity": CertStateCritical.String()}).Set(certCriticalThreshold.Seconds())
 
-	// If less than 30 days till expiration, flood logs every hour (from main.go)
-	if time.Until(expiryTime) <= 30*24*time.Hour {
-		for i := 0; i < 30; i++ {
-			ErrorLog("Certificate expires in less than a month!!!")
+	// The earliest expiring certificate in the chain defines the state
+	earliest := chain[0]
+	earliestSource := "tls"
+	certChainExpiryMetric.Reset() // Subjects change on rotation, drop the old series
+	for source, sourceChain := range certs {
+		for position, cert := range sourceChain {
+			certChainExpiryMetric.With(prometheus.Labels{
+				"k8s_id":   k8sID,
+				"source":   source,
+				"position": strconv.Itoa(position),
+				"subject":  cert.Subject.CommonName,
+			}).Set(time.Until(cert.NotAfter).Seconds())
+			if cert.NotAfter.Before(earliest.NotAfter) {
+				earliest = cert
+				earliestSource = source
+			}
 		}
 	}
+
+	untilExpiry := time.Until(earliest.NotAfter)
+	state := CertStateOK
+	switch {
+	case untilExpiry <= certCriticalThreshold:
+		state = CertStateCritical
+	case untilExpiry <= certWarningThreshold:
+		state = CertStateWarning
+	}
+	setCertExpiryState(state, logrus.Fields{
+		"cert_source":     earliestSource,
+		"cert_subject":    earliest.Subject.CommonName,
+		"cert_not_after":  earliest.NotAfter.UTC().Format(time.RFC3339),
+		"cert_expires_in": untilExpiry.Round(time.Second).String(),
+	})
+}
+
+// setCertExpiryState updates the state and logs a single event with the fields if it changed
+func setCertExpiryState(state CertExpiryState, fields logrus.Fields) {
+	certExpiryStateMetric.With(prometheus.Labels{"k8s_id": k8sID}).Set(float64(state))
+
+	certStateLock.Lock()
+	previous := certState
+	certState = state
+	certStateLock.Unlock()
+
+	if previous == state {
+		return
+	}
+
+	// One structured event per threshold crossing instead of flooding the logs
+	entry := Log.WithFields(fields).WithFields(logrus.Fields{
+		"event":              "cert_expiry",
+		"cert_state":         state.String(),
+		"cert_prev_state":    previous.String(),
+		"warning_threshold":  certWarningThreshold.String(),
+		"critical_threshold": certCriticalThreshold.String(),
+	})
+	_, failed := fields["cert_error"]
+	switch {
+	case failed:
+		entry.Error("Certificate could not be loaded, treated as past the critical threshold")
+	case state == CertStateCritical:
+		entry.Error("Certificate expiry passed the critical threshold")
+	case state == CertStateWarning:
+		entry.Warn("Certificate expiry passed the warning threshold")
+	default:
+		entry.Info("Certificate expiry is back to normal")
+	}
 }
@@ -0,0 +1,285 @@
+package utils
+
+import (
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"admissioncontroller/utils/certtest"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+const day = 24 * time.Hour
+
+// resetCertExpiry starts the test from the ok state with 30 and 7 day thresholds and no gate
+func resetCertExpiry(t *testing.T) {
+	setCertState := func(state CertExpiryState) {
+		certStateLock.Lock()
+		certState = state
+		certStateLock.Unlock()
+	}
+	setCertState(CertStateOK)
+	if err := SetCertExpiryThresholds(30*day, 7*day); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		setCertState(CertStateOK)
+		SetCertExpiryGate(CertGateNone)
+		certChainExpiryMetric.Reset()
+	})
+}
+
+// certExpiryEvents returns the threshold crossing events logged since the last call
+func certExpiryEvents(hook *logtest.Hook) []*logrus.Entry {
+	var events []*logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Data["event"] == "cert_expiry" {
+			events = append(events, entry)
+		}
+	}
+	hook.Reset()
+	return events
+}
+
+// assertSeconds checks a gauge set from time.Until, allowing for the time the test takes
+func assertSeconds(t *testing.T, name string, got float64, want time.Duration) {
+	t.Helper()
+	if math.Abs(got-want.Seconds()) > time.Minute.Seconds() {
+		t.Errorf("%s = %v, want about %v", name, got, want.Seconds())
+	}
+}
+
+func TestCertExpiryStateTransitions(t *testing.T) {
+	resetCertExpiry(t)
+	original := Log.ReplaceHooks(make(logrus.LevelHooks))
+	t.Cleanup(func() { Log.ReplaceHooks(original) })
+	hook := logtest.NewLocal(Log)
+
+	steps := []struct {
+		name      string
+		leafFor   time.Duration
+		state     CertExpiryState
+		event     bool         // A crossing is logged once
+		level     logrus.Level // Of the event
+		prevState CertExpiryState
+	}{
+		{"ok", 60 * day, CertStateOK, false, 0, 0},
+		{"still ok", 59 * day, CertStateOK, false, 0, 0},
+		{"warning", 20 * day, CertStateWarning, true, logrus.WarnLevel, CertStateOK},
+		{"still warning", 19 * day, CertStateWarning, false, 0, 0},
+		{"critical", 3 * day, CertStateCritical, true, logrus.ErrorLevel, CertStateWarning},
+		{"still critical", 2 * day, CertStateCritical, false, 0, 0},
+		{"rotated", 90 * day, CertStateOK, true, logrus.InfoLevel, CertStateCritical},
+		{"ok to critical", day, CertStateCritical, true, logrus.ErrorLevel, CertStateOK},
+		{"critical to warning", 10 * day, CertStateWarning, true, logrus.WarnLevel, CertStateCritical},
+	}
+	for _, step := range steps {
+		files := certtest.Write(t, step.leafFor, 365*day)
+		UpdateCertExpiryMetric(files.Cert, "")
+
+		if got := GetCertExpiryState(); got != step.state {
+			t.Errorf("%s: state %s, want %s", step.name, got, step.state)
+		}
+		if got := testutil.ToFloat64(certExpiryStateMetric.WithLabelValues(k8sID)); got != float64(step.state) {
+			t.Errorf("%s: tls_cert_expiry_state = %v, want %d", step.name, got, step.state)
+		}
+		events := certExpiryEvents(hook)
+		if !step.event {
+			if len(events) != 0 {
+				t.Errorf("%s: got %d events without a crossing", step.name, len(events))
+			}
+			continue
+		}
+		if len(events) != 1 {
+			t.Fatalf("%s: got %d events, want 1", step.name, len(events))
+		}
+		event := events[0]
+		if event.Level != step.level || event.Data["cert_state"] != step.state.String() || event.Data["cert_prev_state"] != step.prevState.String() {
+			t.Errorf("%s: event at %s with fields %v", step.name, event.Level, event.Data)
+		}
+		if event.Data["cert_source"] != "tls" || event.Data["cert_subject"] != certtest.LeafSubject {
+			t.Errorf("%s: event points to %v %v, want the leaf", step.name, event.Data["cert_source"], event.Data["cert_subject"])
+		}
+	}
+}
+
+func TestCertExpiryLoadError(t *testing.T) {
+	resetCertExpiry(t)
+	original := Log.ReplaceHooks(make(logrus.LevelHooks))
+	t.Cleanup(func() { Log.ReplaceHooks(original) })
+	hook := logtest.NewLocal(Log)
+	if err := SetCertExpiryGate(CertGateHealthz); err != nil {
+		t.Fatal(err)
+	}
+
+	files := certtest.Write(t, 60*day, 365*day)
+	valid, err := os.ReadFile(files.Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		name    string
+		content []byte // nil removes the file
+		state   CertExpiryState
+		event   bool
+	}{
+		{"valid", valid, CertStateOK, false},
+		{"removed", nil, CertStateCritical, true},
+		{"still removed", nil, CertStateCritical, false},
+		{"corrupt", []byte("-----BEGIN CERTIFICATE-----\nbroken\n-----END CERTIFICATE-----\n"), CertStateCritical, false},
+		{"restored", valid, CertStateOK, true},
+	}
+	for _, step := range steps {
+		if step.content == nil {
+			os.Remove(files.Cert)
+		} else if err := os.WriteFile(files.Cert, step.content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		UpdateCertExpiryMetric(files.Cert, "")
+
+		if got := GetCertExpiryState(); got != step.state {
+			t.Errorf("%s: state %s, want %s", step.name, got, step.state)
+		}
+		if got := CertExpiryGateFailed(CertGateHealthz); got != (step.state == CertStateCritical) {
+			t.Errorf("%s: healthz gate failed = %t", step.name, got)
+		}
+		events := certExpiryEvents(hook)
+		if got := len(events) == 1; got != step.event || len(events) > 1 {
+			t.Fatalf("%s: got %d events", step.name, len(events))
+		}
+		if step.event && step.state == CertStateCritical && (events[0].Level != logrus.ErrorLevel || events[0].Data["cert_error"] == nil) {
+			t.Errorf("%s: event at %s with fields %v", step.name, events[0].Level, events[0].Data)
+		}
+	}
+}
+
+func TestCertChainExpiryMetrics(t *testing.T) {
+	resetCertExpiry(t)
+
+	// The CA expires first, so it defines the state although the leaf is fine
+	files := certtest.Write(t, 60*day, 20*day)
+	UpdateCertExpiryMetric(files.Cert, files.CA)
+
+	assertSeconds(t, "tls_cert_expiry_seconds", testutil.ToFloat64(certExpiryMetric.WithLabelValues(k8sID)), 60*day)
+	chain := []struct {
+		source, position, subject string
+		validFor                  time.Duration
+	}{
+		{"tls", "0", certtest.LeafSubject, 60 * day},
+		{"tls", "1", certtest.CASubject, 20 * day},
+		{"ca", "0", certtest.CASubject, 20 * day},
+	}
+	if got := testutil.CollectAndCount(certChainExpiryMetric); got != len(chain) {
+		t.Errorf("got %d chain series, want %d", got, len(chain))
+	}
+	for _, cert := range chain {
+		got := testutil.ToFloat64(certChainExpiryMetric.WithLabelValues(k8sID, cert.source, cert.position, cert.subject))
+		assertSeconds(t, "tls_cert_chain_expiry_seconds "+cert.source+"/"+cert.position, got, cert.validFor)
+	}
+	if got := GetCertExpiryState(); got != CertStateWarning {
+		t.Errorf("state %s, want warning from the CA", got)
+	}
+	for severity, threshold := range map[string]time.Duration{"warning": 30 * day, "critical": 7 * day} {
+		if got := testutil.ToFloat64(certExpiryThresholdMetric.WithLabelValues(k8sID, severity)); got != threshold.Seconds() {
+			t.Errorf("%s threshold = %v, want %v", severity, got, threshold.Seconds())
+		}
+	}
+
+	// Without the CA bundle its series are gone
+	UpdateCertExpiryMetric(files.Cert, "")
+	if got := testutil.CollectAndCount(certChainExpiryMetric); got != 2 {
+		t.Errorf("got %d chain series after the CA bundle was removed, want 2", got)
+	}
+}
+
+func TestCertExpiryGate(t *testing.T) {
+	cases := []struct {
+		gate        string
+		leafFor     time.Duration
+		healthzFail bool
+		readyzFail  bool
+	}{
+		{CertGateNone, 3 * day, false, false},
+		{CertGateHealthz, 3 * day, true, false},
+		{CertGateReadyz, 3 * day, false, true},
+		{CertGateHealthz, 20 * day, false, false}, // Warning doesn't trip the gate
+		{CertGateReadyz, 20 * day, false, false},
+		{CertGateReadyz, 60 * day, false, false},
+	}
+	for _, c := range cases {
+		resetCertExpiry(t)
+		if err := SetCertExpiryGate(c.gate); err != nil {
+			t.Fatal(err)
+		}
+		files := certtest.Write(t, c.leafFor, 365*day)
+		UpdateCertExpiryMetric(files.Cert, files.CA)
+
+		if got := CertExpiryGateFailed(CertGateHealthz); got != c.healthzFail {
+			t.Errorf("gate %s, leaf for %s: healthz failed = %t, want %t", c.gate, c.leafFor, got, c.healthzFail)
+		}
+		if got := CertExpiryGateFailed(CertGateReadyz); got != c.readyzFail {
+			t.Errorf("gate %s, leaf for %s: readyz failed = %t, want %t", c.gate, c.leafFor, got, c.readyzFail)
+		}
+		served, err := NewServingCert(files.Cert, files.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := served.Ready(); (err != nil) != c.readyzFail {
+			t.Errorf("gate %s, leaf for %s: tls readiness error %v", c.gate, c.leafFor, err)
+		}
+	}
+
+	if err := SetCertExpiryGate("livez"); err == nil {
+		t.Error("unknown gate was accepted")
+	}
+}
+
+func TestServingCertReadiness(t *testing.T) {
+	resetCertExpiry(t)
+	files := certtest.Write(t, 60*day, 365*day)
+	served, err := NewServingCert(files.Cert, files.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, _ := served.GetCertificate(nil)
+
+	// The files are gone, the server keeps serving the loaded pair and stays ready
+	os.Remove(files.Cert)
+	if err := served.Reload(); err == nil {
+		t.Error("reload without the certificate succeeded")
+	}
+	if current, _ := served.GetCertificate(nil); current != loaded {
+		t.Error("failed reload replaced the served pair")
+	}
+	if err := served.Ready(); err != nil {
+		t.Errorf("ready with the pair in memory: %v", err)
+	}
+
+	// An expired pair is written, readiness follows the served pair, which changes on reload only
+	expired := certtest.Write(t, -time.Minute, 365*day)
+	for _, path := range [][2]string{{expired.Cert, files.Cert}, {expired.Key, files.Key}} {
+		data, err := os.ReadFile(path[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path[1], data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := served.Ready(); err != nil {
+		t.Errorf("readiness checked the files instead of the served pair: %v", err)
+	}
+	if err := served.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := served.GetCertificate(nil); current == loaded {
+		t.Error("reload kept the previous pair")
+	}
+	if err := served.Ready(); err == nil {
+		t.Error("ready with an expired certificate")
+	}
+}
@@ -0,0 +1,98 @@
+// Package certtest writes certificate chains with chosen expiry times for tests of the certificate checks
+package certtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Common names of the certificates
+const (
+	LeafSubject = "admission-controller"
+	CASubject   = "test-ca"
+)
+
+// Files are the paths of a written chain
+type Files struct {
+	Cert string // Leaf followed by the CA, like a mounted TLS secret
+	Key  string // Key of the leaf
+	CA   string // The CA alone, like a CA bundle
+}
+
+// Write writes a CA valid for caValidFor and a leaf signed by it valid for leafValidFor into a temporary directory
+func Write(t testing.TB, leafValidFor, caValidFor time.Duration) Files {
+	t.Helper()
+	now := time.Now()
+
+	caKey := newKey(t)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: CASubject},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidFor),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafKey := newKey(t)
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: LeafSubject},
+		DNSNames:     []string{LeafSubject},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidFor),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}, // Also a client certificate of the CA
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, caTemplate, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	files := Files{
+		Cert: filepath.Join(dir, "tls.crt"),
+		Key:  filepath.Join(dir, "tls.key"),
+		CA:   filepath.Join(dir, "ca.crt"),
+	}
+	writePEM(t, files.Cert, &pem.Block{Type: "CERTIFICATE", Bytes: leafDER}, &pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	writePEM(t, files.Key, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	writePEM(t, files.CA, &pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	return files
+}
+
+func newKey(t testing.TB) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func writePEM(t testing.TB, path string, blocks ...*pem.Block) {
+	var data []byte
+	for _, block := range blocks {
+		data = append(data, pem.EncodeToMemory(block)...)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
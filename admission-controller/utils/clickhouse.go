@@ -1,191 +1,183 @@
 package utils
 
 import (
+	"admissioncontroller/config"
 	"context"
 	"database/sql"
 	"fmt"
-	"os"
-	"strconv"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
 	"time"
-
-	"github.com/ClickHouse/clickhouse-go"
-
-	"github.com/sirupsen/logrus"
 )
 
-type ClickHouseHook struct {
-	db *sql.DB
+// ClickHouseSink is an audit sink which writes events to ClickHouse asynchronously in batches
+type ClickHouseSink struct {
+	writer *clickHouseWriter
 }
 
-func NewClickHouseHook(db *sql.DB) *ClickHouseHook {
-	return &ClickHouseHook{db: db}
+func NewClickHouseSink(writer *clickHouseWriter) *ClickHouseSink {
+	return &ClickHouseSink{writer: writer}
 }
 
-func (hook *ClickHouseHook) Fire(entry *logrus.Entry) error {
-	// Создаем контекст для операций с базой данных
-	ctx := context.Background()
-
-	tx, err := hook.db.Begin()
-	if err != nil {
-		return err
-	}
-
-	stmt, err := tx.Prepare(`
-        INSERT INTO ADMISSION_TABLE (
-            event_date, event_time, k8s_id, level, message, user_id, user_name, user_groups,
-            request_id, request_type, target_namespace, target_kind, target_name,
-            admission_result, admission_reason, processing_time, observer_mode
-        ) VALUES (toDate(?), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-    `)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-	defer stmt.Close()
-
-	logTimeString, ok := entry.Data["@timestamp"].(string)
-	if !ok {
-		logTimeString = time.Now().Format(time.RFC3339) // Fallback if timestamp is missing
-	}
-	logTime, _ := time.Parse(time.RFC3339, logTimeString)
-	logTime = logTime.UTC() // Convert to UTC if not already
-
-	// Fields preparation before sending to Clickhouse. Using log.Printf instead of InfoLog, to avoid cyclical InfoLog execution
-	// log.Printf("User groups in Entry Data: %v", entry.Data["user_groups"])
-	var user_groups_str interface{} // Var for user_groups array
-
-	// check if user_groups is slice of strings
-	if userGroups, ok := entry.Data["user_groups"].([]string); ok {
-		// log.Printf("User groups array: %v", userGroups)
-		user_groups_str = clickhouse.Array(userGroups) // Prepare Clickhouse compatible array
-		// log.Printf("User groups clickhouse array: %v", user_groups_str)
-	} else {
-		// log.Printf("User groups data is not a slice of strings")
-		user_groups_str = clickhouse.Array([]string{}) // init as empty
-	}
-
-	// Preparation for  user_name, request_id & observer_mode
-	// log.Printf("username in Entry Data: %v", entry.Data["user_name"]) // check before extract
-	user_name := safeString(entry.Data, "user_name")
-	// log.Printf("Extracted username: %s", user_name) // log after extraction
+// Write converts the event to a row and queues it
+func (sink *ClickHouseSink) Write(event AuditEvent) {
+	sink.writer.Enqueue(newClickHouseRow(event))
+}
 
-	// log.Printf("Request ID in Entry Data: %v", entry.Data["request_id"]) // check before extract
-	request_id := safeString(entry.Data, "request_id")
-	// log.Printf("Extracted Request ID: %s", request_id) // log after extraction
+// Close flushes queued rows and closes the ClickHouse connection
+func (sink *ClickHouseSink) Close(ctx context.Context) error {
+	return sink.writer.Close(ctx)
+}
 
-	// Get observer mode from env var
-	observerModeEnv := os.Getenv("OBSERVER_MODE")
-	observer_mode := false
-	if observerModeEnv == "true" {
-		observer_mode = true
+// newClickHouseRow maps the event to admission events table columns
+func newClickHouseRow(event AuditEvent) clickHouseRow {
+	level, message := "info", "Admission "+event.Result
+	switch event.Result {
+	case AuditDenied, AuditError, AuditTimeout:
+		level = "error"
+	case AuditAllowedObserver:
+		level = "warning"
 	}
-	observer_mode_str := strconv.FormatBool(observer_mode)
-
-	// Other fields
-	//request_id := entry.Data["request_id"].(string)
-	user_id, _ := entry.Data["user_id"].(string)
-	request_type, _ := entry.Data["request_type"].(string)
-	target_namespace, _ := entry.Data["target_namespace"].(string)
-	target_kind, _ := entry.Data["target_kind"].(string)
-	target_name, _ := entry.Data["target_name"].(string)
-	admission_result, _ := entry.Data["admission_result"].(string)
-	admission_reason, _ := entry.Data["admission_reason"].(string)
-	processing_time, _ := entry.Data["processing_time"].(string)
-	k8s_id, _ := entry.Data["k8s_id"].(string)
-
-	// Request generation and send
-	_, err = stmt.ExecContext(ctx,
-		logTime, logTime, k8s_id, entry.Level.String(), entry.Message,
-		user_id, user_name, user_groups_str,
-		request_id, request_type, target_namespace, target_kind, target_name,
-		admission_result, admission_reason, processing_time, observer_mode_str,
-	)
-	if err != nil {
-		tx.Rollback()
-		return err
+	return clickHouseRow{
+		EventTime:       event.Time.UTC().Truncate(time.Millisecond), // Column is DateTime64(3)
+		K8sID:           event.K8sID,
+		Level:           level,
+		Message:         message,
+		UserID:          event.UserID,
+		UserName:        event.UserName,
+		UserGroups:      event.UserGroups,
+		RequestID:       event.RequestID,
+		RequestType:     event.RequestType,
+		TargetNamespace: event.TargetNamespace,
+		TargetKind:      event.TargetKind,
+		TargetName:      event.TargetName,
+		AdmissionResult: event.Result,
+		AdmissionReason: event.Reason,
+		ProcessingTime:  uint64(max(event.ProcessingTime.Microseconds(), 0)),
+		ObserverMode:    event.ObserverMode,
+		Object:          string(event.Object),
+		OldObject:       string(event.OldObject),
+		Truncated:       event.SnapshotTruncated,
+		ConfigVersion:   event.ConfigVersion,
+		Violations:      event.Violations,
 	}
-
-	return tx.Commit()
 }
 
-func (hook *ClickHouseHook) Levels() []logrus.Level {
-	return []logrus.Level{
-		logrus.InfoLevel,
-		logrus.ErrorLevel,
+var clickhouseSink *ClickHouseSink // nil if ClickHouse is not configured
+
+// clickHouseIdentifierRe matches names which can be used in queries without quoting
+var clickHouseIdentifierRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// clickHouseName expands {k8s_id} in a database or table name template. Characters of the cluster ID
+// which are not allowed in identifiers are replaced with underscores: prod-eu.1 becomes prod_eu_1
+func clickHouseName(template, id string) (string, error) {
+	id = strings.Map(func(r rune) rune {
+		if r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, id)
+	name := strings.ReplaceAll(template, "{k8s_id}", id)
+	if !clickHouseIdentifierRe.MatchString(name) {
+		return "", fmt.Errorf("%q is not a valid ClickHouse identifier", name)
 	}
+	return name, nil
 }
 
-func init() {
-	connectToClickHouse()
+// connectToClickHouse starts the ClickHouse writer and adds it as an audit sink
+func connectToClickHouse(cfg config.ClickHouse) {
+	if cfg.Required {
+		RegisterReadinessCheck("clickhouse", checkClickHouse)
+	}
 
-}
+	if cfg.Host == "" {
+		ErrorLog("ClickHouse host is not set")
+		return
+	}
 
-func connectToClickHouse() {
-	clickhouseHost := getEnv("CLICKHOUSE_HOST", "")
-	if clickhouseHost == "" {
-		ErrorLog("CLICKHOUSE_HOST is not set")
+	var (
+		target ClickHouseTarget
+		err    error
+	)
+	if target.Database, err = clickHouseName(cfg.Database, k8sID); err != nil {
+		ErrorLog("Invalid ClickHouse database: %v", err)
+		return
+	}
+	if target.Table, err = clickHouseName(cfg.Table, k8sID); err != nil {
+		ErrorLog("Invalid ClickHouse table: %v", err)
 		return
 	}
 
-	clickhousePort := getEnv("CLICKHOUSE_PORT", "9000")
-	clickhouseUser := getEnv("CLICKHOUSE_USER", "admission-controller")
-	clickhousePassword := getEnv("CLICKHOUSE_PASSWORD", "none")
+	dataSourceName := (&url.URL{
+		Scheme: "clickhouse",
+		User:   url.UserPassword(cfg.User, cfg.Password),
+		Host:   net.JoinHostPort(cfg.Host, cfg.Port),
+		Path:   target.Database,
+	}).String()
+
+	// Called by the writer at startup and on every reconnect
+	connect := func(ctx context.Context) (*sql.DB, error) {
+		clickhouseConnection, err := sql.Open("clickhouse", dataSourceName)
+		if err != nil {
+			return nil, err
+		}
+		if err = clickhouseConnection.PingContext(ctx); err != nil {
+			clickhouseConnection.Close()
+			return nil, err
+		}
+		if err = MigrateClickHouse(ctx, clickhouseConnection, target); err != nil {
+			clickhouseConnection.Close()
+			return nil, err
+		}
+		if err = setClickHouseTTL(ctx, clickhouseConnection, target.Table, cfg.TTLDays); err != nil {
+			clickhouseConnection.Close()
+			return nil, err
+		}
+		return clickhouseConnection, nil
+	}
 
-	dataSourceName := fmt.Sprintf("tcp://%s:%s?username=%s&password=%s&database=default", clickhouseHost, clickhousePort, clickhouseUser, clickhousePassword)
+	writerConfig := ClickHouseWriterConfig{
+		Table:         target.Table,
+		BatchSize:     cfg.BatchSize,
+		FlushInterval: cfg.FlushInterval.D(),
+		QueueSize:     cfg.QueueSize,
+		QueuePolicy:   cfg.QueuePolicy,
+		SpoolPath:     cfg.SpoolPath,
+		SpoolMaxBytes: int64(cfg.SpoolMaxMB) << 20,
+		RetryMax:      cfg.RetryMax.D(),
+	}
 
-	InfoLog("Connecting to Clickhouse")
-	clickhouseConnection, err := sql.Open("clickhouse", dataSourceName)
+	InfoLog("Connecting to Clickhouse, writing to %s.%s", target.Database, target.Table)
+	writer, err := newClickHouseWriter(connect, writerConfig)
 	if err != nil {
-		ErrorLog("Failed to connect to ClickHouse: %v", err)
+		ErrorLog("Failed to start ClickHouse writer: %v", err)
 		return
 	}
-
-	if err = clickhouseConnection.Ping(); err != nil {
-		ErrorLog("Failed to ping ClickHouse: %v", err)
-		clickhouseConnection = nil // Очистка в случае ошибки
-		return
+	if !writer.Connected() {
+		ErrorLog("ClickHouse is unavailable, reconnecting in the background")
 	}
 
-	EnsureAdmissionTableExists(clickhouseConnection)
-
-	Log.AddHook(NewClickHouseHook(clickhouseConnection))
-}
+	clickhouseSink = NewClickHouseSink(writer)
+	AddAuditSink(clickhouseSink)
 
-func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
+	// Read path of the query API, the pool is opened lazily on the first query
+	readConnection, err := sql.Open("clickhouse", dataSourceName)
+	if err != nil {
+		ErrorLog("Failed to open ClickHouse connection for queries: %v", err)
+		return
 	}
-	return fallback
+	clickhouseEvents = NewClickHouseEventStore(readConnection, target.Table)
 }
 
-func EnsureAdmissionTableExists(db *sql.DB) {
-	InfoLog("Creating ADMISSION_TABLE in clickhouse") // TODO Add mode for separate CH tables for different k8s_id's (or databases)
-	createTableSQL := `
-    CREATE TABLE IF NOT EXISTS ADMISSION_TABLE (
-        event_date Date DEFAULT toDate(event_time),
-        event_time DateTime,
-		k8s_id String,
-        level String,
-        message String,
-        user_id String,
-        user_name String,
-        user_groups Array(String),
-        request_id String,
-        request_type String,
-        target_namespace String,
-        target_kind String,
-        target_name String,
-        admission_result String,
-        admission_reason String,
-        processing_time String,
-        observer_mode String
-    ) ENGINE = MergeTree(event_date, (event_time, level), 8192)
-    `
-
-	if _, err := db.Exec(createTableSQL); err != nil {
-		ErrorLog("Failed to create table ADMISSION_TABLE: %v", err)
-	} else {
-		InfoLog("Table ADMISSION_TABLE created or already exists")
+// checkClickHouse is a readiness check for the case when ClickHouse is required
+func checkClickHouse() error {
+	if clickhouseSink == nil {
+		return fmt.Errorf("not configured")
 	}
-
+	if !clickhouseSink.writer.Connected() {
+		return fmt.Errorf("not connected")
+	}
+	return nil
 }
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// backfillMonthSQL copies a month of ADMISSION_TABLE into the events table. processing_time was stored as a Go
+// duration string: "850µs", "1.234ms", "2.5s". Rows already copied are skipped, the lookup only reads the same
+// month of the events table, so a repeated run adds nothing and doesn't scan the whole table
+const backfillMonthSQL = `
+    INSERT INTO {table} (
+        event_time, k8s_id, level, message, user_id, user_name, user_groups, request_id, request_type,
+        target_namespace, target_kind, target_name, admission_result, admission_reason, processing_time_us, observer_mode
+    )
+    SELECT
+        toDateTime64(event_time, 3), k8s_id, level, message, user_id, user_name, user_groups, request_id, request_type,
+        target_namespace, target_kind, target_name, admission_result, admission_reason,
+        toUInt64(round(multiIf(
+            endsWith(processing_time, 'ns'), toFloat64OrZero(substring(processing_time, 1, length(processing_time) - 2)) / 1000,
+            endsWith(processing_time, 'µs'), toFloat64OrZero(substring(processing_time, 1, length(processing_time) - 3)),
+            endsWith(processing_time, 'us'), toFloat64OrZero(substring(processing_time, 1, length(processing_time) - 2)),
+            endsWith(processing_time, 'ms'), toFloat64OrZero(substring(processing_time, 1, length(processing_time) - 2)) * 1000,
+            endsWith(processing_time, 's'), toFloat64OrZero(substring(processing_time, 1, length(processing_time) - 1)) * 1000000,
+            0
+        ))),
+        observer_mode = 'true'
+    FROM ADMISSION_TABLE
+    WHERE toYYYYMM(event_date) = ?
+        AND (request_id, toDateTime64(event_time, 3), message) NOT IN (
+            SELECT request_id, event_time, message FROM {table} WHERE toYYYYMM(event_time) = ?
+        )
+    `
+
+// BackfillClickHouse copies the history of ADMISSION_TABLE into the events table month by month, the partition
+// of both tables. It is run once by an operator, not by the replicas, and may be repeated after a failure.
+// progress is called after every copied month, e.g. 202405
+func BackfillClickHouse(ctx context.Context, db *sql.DB, table string, progress func(month uint32)) error {
+	if !clickHouseIdentifierRe.MatchString(table) {
+		return fmt.Errorf("%q is not a valid ClickHouse identifier", table)
+	}
+	months, err := legacyMonths(ctx, db)
+	if err != nil {
+		return err
+	}
+	statement := strings.ReplaceAll(backfillMonthSQL, "{table}", table)
+	for _, month := range months {
+		if _, err := db.ExecContext(ctx, statement, month, month); err != nil {
+			return fmt.Errorf("failed to copy %d: %v", month, err)
+		}
+		progress(month)
+	}
+	return nil
+}
+
+// legacyMonths lists the months which have rows in ADMISSION_TABLE, oldest first
+func legacyMonths(ctx context.Context, db *sql.DB) ([]uint32, error) {
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT toYYYYMM(event_date) AS month FROM ADMISSION_TABLE ORDER BY month")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ADMISSION_TABLE: %v", err)
+	}
+	defer rows.Close()
+
+	var months []uint32
+	for rows.Next() {
+		var month uint32
+		if err := rows.Scan(&month); err != nil {
+			return nil, err
+		}
+		months = append(months, month)
+	}
+	return months, rows.Err()
+}
@@ -0,0 +1,509 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClickHouse is a stand-in database/sql driver recording what the writer sends to ClickHouse.
+// With schema enabled it also keeps created tables and rejects inserts which don't match them,
+// like the real server does
+type fakeClickHouse struct {
+	mu        sync.Mutex
+	schema    bool                        // Validate statements against created tables
+	tables    map[string][]string         // Table -> column names
+	tableRows map[string][][]driver.Value // Table -> committed rows, in the column order of the table
+	tableTTL  map[string]string           // Table -> TTL expression in the normalized form
+	queries   []string                    // Every prepared or executed statement
+	committed [][]driver.Value            // Rows of committed transactions
+	commits   int                         // Number of committed transactions
+	execErr   error                       // Returned by Exec of prepared statements if set
+	down      bool                        // Simulates an unreachable server: Ping and Exec fail
+	block     chan struct{}               // Exec waits until it is closed if set
+}
+
+func (f *fakeClickHouse) rows() [][]driver.Value {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]driver.Value(nil), f.committed...)
+}
+
+func (f *fakeClickHouse) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *fakeClickHouse) commitCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.commits
+}
+
+// enableSchema makes the fake keep tables and validate inserts against them
+func (f *fakeClickHouse) enableSchema() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.schema = true
+	f.tables = make(map[string][]string)
+	f.tableRows = make(map[string][][]driver.Value)
+	f.tableTTL = make(map[string]string)
+}
+
+func (f *fakeClickHouse) table(name string) ([]string, [][]driver.Value) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tables[name], append([][]driver.Value(nil), f.tableRows[name]...)
+}
+
+func (f *fakeClickHouse) queryCount(substr string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := 0
+	for _, query := range f.queries {
+		if strings.Contains(query, substr) {
+			count++
+		}
+	}
+	return count
+}
+
+var (
+	createTableRe = regexp.MustCompile(`(?is)^\s*CREATE TABLE IF NOT EXISTS (\w+)\s*\((.*)\)\s*ENGINE`)
+	addColumnRe   = regexp.MustCompile(`(?is)^\s*ALTER TABLE (\w+) ADD COLUMN IF NOT EXISTS (\w+)(?:\s+Nested\((.*)\))?`)
+	nestedFieldRe = regexp.MustCompile(`(?:^|,)\s*(\w+)\s`)
+	insertRe      = regexp.MustCompile(`(?is)^\s*INSERT INTO (\w+)\s*\(([^)]*)\)\s*VALUES\s*\((.*)\)\s*$`)
+	selectRe      = regexp.MustCompile(`(?is)^\s*SELECT (\w+) FROM (\w+)(?:\s+WHERE (\w+) = \?)?\s*$`)
+	modifyTTLRe   = regexp.MustCompile(`(?is)^\s*ALTER TABLE (\w+) MODIFY TTL toDateTime\(event_time\) \+ INTERVAL (\d+) DAY\s*$`)
+	removeTTLRe   = regexp.MustCompile(`(?is)^\s*ALTER TABLE (\w+) REMOVE TTL\s*$`)
+	insertFromRe  = regexp.MustCompile(`(?is)^\s*INSERT INTO (\w+)\s*\(([^)]*)\)\s*SELECT\s.*?\sFROM (\w+)\s+WHERE`)
+	engineRe      = regexp.MustCompile(`(?is)^\s*SELECT engine_full FROM system\.tables WHERE`)
+	monthsRe      = regexp.MustCompile(`(?is)^\s*SELECT DISTINCT toYYYYMM\(event_date\) AS month FROM (\w+) ORDER BY month\s*$`)
+	topUsersRe    = regexp.MustCompile(`(?is)^\s*SELECT if\(user_name != '', user_name, user_id\) AS user, count\(\) AS events FROM (\w+) WHERE notEmpty\(violations\.check_id\) GROUP BY user ORDER BY events DESC, user LIMIT \?\s*$`)
+)
+
+// exec applies a DDL statement to the fake schema
+func (f *fakeClickHouse) exec(query string) error {
+	if !f.schema {
+		return nil
+	}
+	if m := createTableRe.FindStringSubmatch(query); m != nil {
+		if _, ok := f.tables[m[1]]; !ok {
+			f.tables[m[1]] = parseColumnNames(m[2])
+		}
+		return nil
+	}
+	if m := addColumnRe.FindStringSubmatch(query); m != nil {
+		columns, ok := f.tables[m[1]]
+		if !ok {
+			return fmt.Errorf("table %s doesn't exist", m[1])
+		}
+		for _, column := range columns {
+			if column == m[2] || strings.HasPrefix(column, m[2]+".") {
+				return nil
+			}
+		}
+		if m[3] == "" {
+			f.tables[m[1]] = append(columns, m[2])
+			return nil
+		}
+		// Nested columns are visible as name.field arrays
+		for _, field := range nestedFieldRe.FindAllStringSubmatch(m[3], -1) {
+			columns = append(columns, m[2]+"."+field[1])
+		}
+		f.tables[m[1]] = columns
+		return nil
+	}
+	if m := modifyTTLRe.FindStringSubmatch(query); m != nil {
+		if _, ok := f.tables[m[1]]; !ok {
+			return fmt.Errorf("table %s doesn't exist", m[1])
+		}
+		f.tableTTL[m[1]] = fmt.Sprintf("toDateTime(event_time) + toIntervalDay(%s)", m[2])
+		return nil
+	}
+	if m := removeTTLRe.FindStringSubmatch(query); m != nil {
+		if f.tableTTL[m[1]] == "" {
+			return fmt.Errorf("table %s doesn't have TTL", m[1])
+		}
+		delete(f.tableTTL, m[1])
+		return nil
+	}
+	if m := insertFromRe.FindStringSubmatch(query); m != nil {
+		// Data is not copied, only the tables and the target columns are checked
+		if _, ok := f.tables[m[3]]; !ok {
+			return fmt.Errorf("table %s doesn't exist", m[3])
+		}
+		_, _, err := f.checkInsert(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", m[1], m[2],
+			strings.TrimSuffix(strings.Repeat("?,", len(parseColumnNames(m[2]))), ",")), make([]driver.Value, len(parseColumnNames(m[2]))))
+		return err
+	}
+	return fmt.Errorf("unsupported statement: %s", query)
+}
+
+// checkInsert validates an insert against the fake schema. It returns the target table and the row
+// in the column order of the table, columns missing in the insert are nil
+func (f *fakeClickHouse) checkInsert(query string, args []driver.Value) (string, []driver.Value, error) {
+	m := insertRe.FindStringSubmatch(query)
+	if m == nil {
+		return "", nil, fmt.Errorf("unsupported insert: %s", query)
+	}
+	columns, ok := f.tables[m[1]]
+	if !ok {
+		return "", nil, fmt.Errorf("table %s doesn't exist", m[1])
+	}
+	inserted := parseColumnNames(m[2])
+	placeholders := strings.Count(m[3], "?")
+	if placeholders != len(inserted) || len(args) != len(inserted) {
+		return "", nil, fmt.Errorf("insert has %d columns, %d placeholders and %d values", len(inserted), placeholders, len(args))
+	}
+
+	index := make(map[string]int, len(columns))
+	for i, column := range columns {
+		index[column] = i
+	}
+	row := make([]driver.Value, len(columns))
+	for i, column := range inserted {
+		position, ok := index[column]
+		if !ok {
+			return "", nil, fmt.Errorf("no such column %s in table %s", column, m[1])
+		}
+		row[position] = args[i]
+	}
+	return m[1], row, nil
+}
+
+// parseColumnNames returns the first word of every top-level comma separated definition
+func parseColumnNames(definitions string) []string {
+	var names []string
+	depth, start := 0, 0
+	add := func(definition string) {
+		if fields := strings.Fields(definition); len(fields) > 0 {
+			names = append(names, fields[0])
+		}
+	}
+	for i, r := range definitions {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				add(definitions[start:i])
+				start = i + 1
+			}
+		}
+	}
+	add(definitions[start:])
+	return names
+}
+
+var fakeClickHouses sync.Map // DSN -> *fakeClickHouse
+
+func init() {
+	sql.Register("fakeclickhouse", fakeDriver{})
+}
+
+// fakeConnector returns a connector opening new handles to the fake of the current test, like a reconnect does
+func fakeConnector(t *testing.T) clickHouseConnector {
+	return func(ctx context.Context) (*sql.DB, error) {
+		return sql.Open("fakeclickhouse", t.Name())
+	}
+}
+
+// newFakeClickHouse opens a database/sql handle backed by a fresh fakeClickHouse
+func newFakeClickHouse(t *testing.T) (*sql.DB, *fakeClickHouse) {
+	t.Helper()
+	fake := &fakeClickHouse{}
+	fakeClickHouses.Store(t.Name(), fake)
+	db, err := sql.Open("fakeclickhouse", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		fakeClickHouses.Delete(t.Name())
+	})
+	return db, fake
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fake, ok := fakeClickHouses.Load(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown fake database %q", name)
+	}
+	return &fakeConn{db: fake.(*fakeClickHouse)}, nil
+}
+
+type fakeConn struct {
+	db *fakeClickHouse
+	tx *fakeTx
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	c.db.mu.Lock()
+	c.db.queries = append(c.db.queries, query)
+	c.db.mu.Unlock()
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.tx = &fakeTx{conn: c}
+	return c.tx, nil
+}
+
+func (c *fakeConn) Ping(ctx context.Context) error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	if c.db.down {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+// CheckNamedValue accepts any argument type, like the ClickHouse driver does for arrays
+func (c *fakeConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.queries = append(c.db.queries, query)
+	if err := c.db.exec(query); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+type fakeTx struct {
+	conn    *fakeConn
+	pending [][]driver.Value
+	tables  []string         // Target table of every pending row
+	stored  [][]driver.Value // Pending rows in the column order of their table
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.conn.db.mu.Lock()
+	defer tx.conn.db.mu.Unlock()
+	tx.conn.db.committed = append(tx.conn.db.committed, tx.pending...)
+	if tx.conn.db.schema {
+		for i, row := range tx.stored {
+			tx.conn.db.tableRows[tx.tables[i]] = append(tx.conn.db.tableRows[tx.tables[i]], row)
+		}
+	}
+	tx.conn.db.commits++
+	tx.conn.tx = nil
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.conn.tx = nil
+	return nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.conn.db.mu.Lock()
+	block, execErr := s.conn.db.block, s.conn.db.execErr
+	if s.conn.db.down {
+		execErr = fmt.Errorf("connection refused")
+	}
+	var table string
+	var stored []driver.Value
+	if s.conn.db.schema && execErr == nil {
+		table, stored, execErr = s.conn.db.checkInsert(s.query, args)
+	}
+	s.conn.db.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+	if execErr != nil {
+		return nil, execErr
+	}
+	if s.conn.tx == nil {
+		return nil, fmt.Errorf("exec outside of a transaction")
+	}
+	s.conn.tx.pending = append(s.conn.tx.pending, args)
+	s.conn.tx.tables = append(s.conn.tx.tables, table)
+	s.conn.tx.stored = append(s.conn.tx.stored, stored)
+	return driver.RowsAffected(1), nil
+}
+
+// Query supports "SELECT <column> FROM <table>" against the fake schema
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.conn.db.mu.Lock()
+	defer s.conn.db.mu.Unlock()
+	if !s.conn.db.schema {
+		return &fakeRows{}, nil
+	}
+	if engineRe.MatchString(s.query) {
+		// Table name is the only argument
+		name, _ := args[0].(string)
+		if _, ok := s.conn.db.tables[name]; !ok {
+			return &fakeRows{columns: []string{"engine_full"}}, nil
+		}
+		engine := "MergeTree PARTITION BY toYYYYMM(event_time) ORDER BY (k8s_id, event_time, level)"
+		if ttl := s.conn.db.tableTTL[name]; ttl != "" {
+			engine += " TTL " + ttl
+		}
+		engine += " SETTINGS index_granularity = 8192"
+		return &fakeRows{columns: []string{"engine_full"}, values: [][]driver.Value{{engine}}}, nil
+	}
+	if m := topUsersRe.FindStringSubmatch(s.query); m != nil {
+		return s.conn.db.topUsers(m[1], args[0])
+	}
+	if m := monthsRe.FindStringSubmatch(s.query); m != nil {
+		return s.conn.db.months(m[1])
+	}
+	m := selectRe.FindStringSubmatch(s.query)
+	if m == nil {
+		return nil, fmt.Errorf("unsupported query: %s", s.query)
+	}
+	columns, ok := s.conn.db.tables[m[2]]
+	if !ok {
+		return nil, fmt.Errorf("table %s doesn't exist", m[2])
+	}
+	index := make(map[string]int, len(columns))
+	for i, column := range columns {
+		index[column] = i
+	}
+	// Rows inserted before a column was added have no value for it
+	value := func(row []driver.Value, column string) driver.Value {
+		if i := index[column]; i < len(row) {
+			return row[i]
+		}
+		return nil
+	}
+	for _, column := range []string{m[1], m[3]} {
+		if _, ok := index[column]; column != "" && !ok {
+			return nil, fmt.Errorf("no such column %s in table %s", column, m[2])
+		}
+	}
+
+	rows := &fakeRows{columns: []string{m[1]}}
+	for _, row := range s.conn.db.tableRows[m[2]] {
+		if m[3] != "" && value(row, m[3]) != args[0] {
+			continue
+		}
+		rows.values = append(rows.values, []driver.Value{value(row, m[1])})
+	}
+	return rows, nil
+}
+
+// topUsers runs the query of ClickHouseEventStore.TopUsers without filters, the lock is held by the caller
+func (f *fakeClickHouse) topUsers(table string, limit driver.Value) (driver.Rows, error) {
+	columns, ok := f.tables[table]
+	if !ok {
+		return nil, fmt.Errorf("table %s doesn't exist", table)
+	}
+	index := make(map[string]int, len(columns))
+	for i, column := range columns {
+		index[column] = i
+	}
+	counts := map[string]int64{}
+	for _, row := range f.tableRows[table] {
+		if checks, _ := row[index["violations.check_id"]].([]string); len(checks) == 0 {
+			continue
+		}
+		user, _ := row[index["user_name"]].(string)
+		if user == "" {
+			user, _ = row[index["user_id"]].(string)
+		}
+		counts[user]++
+	}
+	users := make([]string, 0, len(counts))
+	for user := range counts {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if counts[users[i]] != counts[users[j]] {
+			return counts[users[i]] > counts[users[j]]
+		}
+		return users[i] < users[j]
+	})
+	n, _ := limit.(int) // Arguments are passed as is, see CheckNamedValue
+	rows := &fakeRows{columns: []string{"user", "events"}}
+	for i, user := range users {
+		if i == n {
+			break
+		}
+		rows.values = append(rows.values, []driver.Value{user, counts[user]})
+	}
+	return rows, nil
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// columnIndex returns the position of a column in rows recorded from the writer
+func columnIndex(name string) int {
+	for i, column := range admissionColumns {
+		if column == name {
+			return i
+		}
+	}
+	panic("unknown column " + name)
+}
+
+// months lists the distinct months of event_date, which must be stored as time.Time. The lock is held by the caller
+func (f *fakeClickHouse) months(table string) (driver.Rows, error) {
+	columns, ok := f.tables[table]
+	if !ok {
+		return nil, fmt.Errorf("table %s doesn't exist", table)
+	}
+	column := -1
+	for i, name := range columns {
+		if name == "event_date" {
+			column = i
+		}
+	}
+	seen := map[uint32]bool{}
+	var months []uint32
+	for _, row := range f.tableRows[table] {
+		date := row[column].(time.Time)
+		month := uint32(date.Year()*100 + int(date.Month()))
+		if !seen[month] {
+			seen[month] = true
+			months = append(months, month)
+		}
+	}
+	sort.Slice(months, func(i, j int) bool { return months[i] < months[j] })
+	rows := &fakeRows{columns: []string{"month"}}
+	for _, month := range months {
+		rows.values = append(rows.values, []driver.Value{int64(month)})
+	}
+	return rows, nil
+}
@@ -0,0 +1,256 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// clickHouseMigration is a versioned schema change. ClickHouse has no DDL transactions and several replicas
+// may start at the same time, so every statement must be idempotent (IF NOT EXISTS, ADD COLUMN IF NOT EXISTS...).
+// Applied migrations are never edited, changes go into a new version
+type clickHouseMigration struct {
+	Version     uint32
+	Description string
+	Up          []string // {table} is replaced with the admission events table name
+	Legacy      bool     // Only for the default database and table, where ADMISSION_TABLE was written before
+}
+
+// ClickHouseTarget is the database and the admission events table the rows are written to
+type ClickHouseTarget struct {
+	Database string
+	Table    string
+}
+
+// legacy reports whether the target is the layout used before the names became configurable
+func (t ClickHouseTarget) legacy() bool {
+	return t.Database == defaultClickHouseDatabase && t.Table == admissionEventsTable
+}
+
+const (
+	migrationsTable           = "schema_migrations" // One per database, versions are recorded per events table
+	admissionEventsTable      = "admission_events"  // Typed replacement of ADMISSION_TABLE, written since migration 2
+	defaultClickHouseDatabase = "default"
+)
+
+// clickHouseMigrations is the ordered list of schema versions
+var clickHouseMigrations = []clickHouseMigration{
+	{
+		// Tables created by older versions with the deprecated MergeTree(event_date, ...) syntax are kept as is
+		Version:     1,
+		Description: "create ADMISSION_TABLE",
+		Legacy:      true,
+		Up: []string{`
+    CREATE TABLE IF NOT EXISTS ADMISSION_TABLE (
+        event_date Date DEFAULT toDate(event_time),
+        event_time DateTime,
+        k8s_id String,
+        level String,
+        message String,
+        user_id String,
+        user_name String,
+        user_groups Array(String),
+        request_id String,
+        request_type String,
+        target_namespace String,
+        target_kind String,
+        target_name String,
+        admission_result String,
+        admission_reason String,
+        processing_time String,
+        observer_mode String
+    ) ENGINE = MergeTree
+    PARTITION BY toYYYYMM(event_date)
+    ORDER BY (event_time, level)
+    SETTINGS index_granularity = 8192
+    `},
+	},
+	{
+		Version:     2,
+		Description: "create typed admission events table",
+		Up: []string{`
+    CREATE TABLE IF NOT EXISTS {table} (
+        event_time DateTime64(3),
+        k8s_id LowCardinality(String),
+        level LowCardinality(String),
+        message String,
+        user_id String,
+        user_name String,
+        user_groups Array(String),
+        request_id String,
+        request_type LowCardinality(String),
+        target_namespace LowCardinality(String),
+        target_kind LowCardinality(String),
+        target_name String,
+        admission_result LowCardinality(String),
+        admission_reason String,
+        processing_time_us UInt64,
+        observer_mode Bool
+    ) ENGINE = MergeTree
+    PARTITION BY toYYYYMM(event_time)
+    ORDER BY (k8s_id, event_time, level)
+    `},
+	},
+	{
+		// The copy of ADMISSION_TABLE used to run here, on every replica at startup. It reads the whole old
+		// table, so it is an operator step now: admissionctl backfill, see BackfillClickHouse
+		Version:     3,
+		Description: "backfill admission events table from ADMISSION_TABLE, moved to admissionctl backfill",
+		Legacy:      true,
+	},
+	{
+		// Snapshots are large and similar to each other, ZSTD compresses them well
+		Version:     4,
+		Description: "add object snapshot columns",
+		Up: []string{
+			"ALTER TABLE {table} ADD COLUMN IF NOT EXISTS object String CODEC(ZSTD(3))",
+			"ALTER TABLE {table} ADD COLUMN IF NOT EXISTS old_object String CODEC(ZSTD(3))",
+			"ALTER TABLE {table} ADD COLUMN IF NOT EXISTS snapshot_truncated Bool DEFAULT false",
+		},
+	},
+	{
+		Version:     5,
+		Description: "add violations",
+		Up: []string{
+			`ALTER TABLE {table} ADD COLUMN IF NOT EXISTS violations Nested(
+				check_id LowCardinality(String),
+				severity LowCardinality(String),
+				container String,
+				field_path String,
+				message String,
+				remediation String
+			)`,
+		},
+	},
+	{
+		Version:     6,
+		Description: "add config version",
+		Up: []string{
+			"ALTER TABLE {table} ADD COLUMN IF NOT EXISTS config_version LowCardinality(String) DEFAULT ''",
+		},
+	},
+}
+
+// MigrateClickHouse applies migrations of the target table which are not recorded in the migrations table yet.
+// The connection must use the target database
+func MigrateClickHouse(ctx context.Context, db *sql.DB, target ClickHouseTarget) error {
+	return applyClickHouseMigrations(ctx, db, target, clickHouseMigrations)
+}
+
+func applyClickHouseMigrations(ctx context.Context, db *sql.DB, target ClickHouseTarget, migrations []clickHouseMigration) error {
+	// table_name was added when table names became configurable, versions recorded before belong to the default table
+	createMigrationsTableSQL := []string{
+		fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s (
+        version UInt32,
+        description String,
+        applied_at DateTime
+    ) ENGINE = MergeTree
+    ORDER BY version
+    `, migrationsTable),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS table_name String DEFAULT '%s'", migrationsTable, admissionEventsTable),
+	}
+	for _, statement := range createMigrationsTableSQL {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("failed to create %s: %v", migrationsTable, err)
+		}
+	}
+
+	applied, err := appliedClickHouseMigrations(ctx, db, target.Table)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range migrations {
+		if applied[migration.Version] || (migration.Legacy && !target.legacy()) {
+			continue
+		}
+		DebugLog("Applying ClickHouse migration %d to %s.%s: %s", migration.Version, target.Database, target.Table, migration.Description)
+		for _, statement := range migration.Up {
+			if _, err := db.ExecContext(ctx, strings.ReplaceAll(statement, "{table}", target.Table)); err != nil {
+				return fmt.Errorf("migration %d (%s) failed: %v", migration.Version, migration.Description, err)
+			}
+		}
+		if err := recordClickHouseMigration(ctx, db, target.Table, migration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appliedClickHouseMigrations(ctx context.Context, db *sql.DB, table string) (map[uint32]bool, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT version FROM %s WHERE table_name = ?", migrationsTable), table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", migrationsTable, err)
+	}
+	defer rows.Close()
+
+	applied := make(map[uint32]bool)
+	for rows.Next() {
+		var version uint32
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// recordClickHouseMigration inserts the version into the migrations table. Inserts need a transaction in the native driver
+func recordClickHouseMigration(ctx context.Context, db *sql.DB, table string, migration clickHouseMigration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s (version, description, applied_at, table_name) VALUES (?, ?, ?, ?)", migrationsTable))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.ExecContext(ctx, migration.Version, migration.Description, time.Now().UTC(), table); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+var tableTTLRe = regexp.MustCompile(`\bTTL (.+?)(?: SETTINGS |$)`)
+
+// setClickHouseTTL sets retention of the admission events table, 0 days removes it. The table is altered
+// only when the TTL differs, because changing it starts a mutation which rewrites old parts
+func setClickHouseTTL(ctx context.Context, db *sql.DB, table string, days int) error {
+	if days < 0 {
+		return fmt.Errorf("TTL must not be negative, got %d days", days)
+	}
+
+	var engine string
+	row := db.QueryRowContext(ctx, "SELECT engine_full FROM system.tables WHERE database = currentDatabase() AND name = ?", table)
+	if err := row.Scan(&engine); err != nil {
+		return fmt.Errorf("failed to read %s TTL: %v", table, err)
+	}
+	current := ""
+	if m := tableTTLRe.FindStringSubmatch(engine); m != nil {
+		current = m[1]
+	}
+
+	// ClickHouse keeps the expression in the normalized form, INTERVAL 30 DAY becomes toIntervalDay(30)
+	var statement string
+	switch want := fmt.Sprintf("toDateTime(event_time) + toIntervalDay(%d)", days); {
+	case days == 0 && current != "":
+		statement = fmt.Sprintf("ALTER TABLE %s REMOVE TTL", table)
+	case days > 0 && current != want:
+		statement = fmt.Sprintf("ALTER TABLE %s MODIFY TTL toDateTime(event_time) + INTERVAL %d DAY", table, days)
+	default:
+		return nil
+	}
+	DebugLog("Changing %s TTL from %q to %d days", table, current, days)
+	if _, err := db.ExecContext(ctx, statement); err != nil {
+		return fmt.Errorf("failed to set %s TTL: %v", table, err)
+	}
+	return nil
+}
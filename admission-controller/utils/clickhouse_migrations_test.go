@@ -0,0 +1,293 @@
+package utils
+
+import (
+	"admissioncontroller"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+var defaultTarget = ClickHouseTarget{Database: defaultClickHouseDatabase, Table: admissionEventsTable}
+
+func TestMigrateClickHouseAppliesOnce(t *testing.T) {
+	db, fake := newFakeClickHouse(t)
+	fake.enableSchema()
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := MigrateClickHouse(ctx, db, defaultTarget); err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+	}
+
+	for _, table := range []string{"ADMISSION_TABLE", admissionEventsTable} {
+		if n := fake.queryCount("CREATE TABLE IF NOT EXISTS " + table); n != 1 {
+			t.Errorf("%s created %d times, want 1", table, n)
+		}
+	}
+	_, applied := fake.table(migrationsTable)
+	if len(applied) != len(clickHouseMigrations) {
+		t.Errorf("%d migrations recorded, want %d", len(applied), len(clickHouseMigrations))
+	}
+}
+
+func TestMigrateClickHouseAppliesNewVersions(t *testing.T) {
+	db, fake := newFakeClickHouse(t)
+	fake.enableSchema()
+
+	ctx := context.Background()
+	if err := MigrateClickHouse(ctx, db, defaultTarget); err != nil {
+		t.Fatal(err)
+	}
+	migrations := append(append([]clickHouseMigration(nil), clickHouseMigrations...), clickHouseMigration{
+		Version:     uint32(len(clickHouseMigrations) + 1),
+		Description: "add test column",
+		Up:          []string{"ALTER TABLE ADMISSION_TABLE ADD COLUMN IF NOT EXISTS test_column String"},
+	})
+	if err := applyClickHouseMigrations(ctx, db, defaultTarget, migrations); err != nil {
+		t.Fatal(err)
+	}
+
+	columns, _ := fake.table("ADMISSION_TABLE")
+	if columns[len(columns)-1] != "test_column" {
+		t.Errorf("columns = %v, want test_column added", columns)
+	}
+	_, applied := fake.table(migrationsTable)
+	if len(applied) != len(migrations) {
+		t.Errorf("%d migrations recorded, want %d", len(applied), len(migrations))
+	}
+}
+
+// TestBackfillClickHouse checks that the history is copied by the operator step, not by the replicas at startup,
+// one month at a time with the lookup of copied rows limited to the same month
+func TestBackfillClickHouse(t *testing.T) {
+	db, fake := newFakeClickHouse(t)
+	fake.enableSchema()
+	ctx := context.Background()
+	if err := MigrateClickHouse(ctx, db, defaultTarget); err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.queryCount("FROM ADMISSION_TABLE"); n != 0 {
+		t.Errorf("migrations read ADMISSION_TABLE %d times", n)
+	}
+
+	for _, date := range []string{"2024-03-31", "2024-01-15", "2024-03-01"} {
+		day, _ := time.Parse(time.DateOnly, date)
+		if err := insertWithQuery(db, "INSERT INTO ADMISSION_TABLE (event_date, request_id) VALUES (?, ?)", []interface{}{day, date}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var months []uint32
+	if err := BackfillClickHouse(ctx, db, admissionEventsTable, func(month uint32) { months = append(months, month) }); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(months) != "[202401 202403]" {
+		t.Errorf("copied months %v, want [202401 202403]", months)
+	}
+
+	fake.mu.Lock()
+	queries := append([]string(nil), fake.queries...)
+	fake.mu.Unlock()
+	copies := 0
+	for _, query := range queries {
+		if strings.Contains(query, "OPTIMIZE") {
+			t.Errorf("backfill rewrites the table: %s", query)
+		}
+		if !strings.Contains(query, "FROM ADMISSION_TABLE\n    WHERE") {
+			continue
+		}
+		copies++
+		if !strings.Contains(query, "WHERE toYYYYMM(event_date) = ?") || !strings.Contains(query, "FROM "+admissionEventsTable+" WHERE toYYYYMM(event_time) = ?") {
+			t.Errorf("copy is not limited to a month:\n%s", query)
+		}
+	}
+	if copies != len(months) {
+		t.Errorf("%d copies for %d months", copies, len(months))
+	}
+
+	if err := BackfillClickHouse(ctx, db, "events;DROP", func(uint32) {}); err == nil {
+		t.Error("invalid table name was accepted")
+	}
+}
+
+// TestClickHouseWriterMatchesSchema writes a row through the writer into a table created by the migrations
+func TestClickHouseWriterMatchesSchema(t *testing.T) {
+	db, fake := newFakeClickHouse(t)
+	fake.enableSchema()
+	if err := MigrateClickHouse(context.Background(), db, defaultTarget); err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := newClickHouseWriter(fakeConnector(t), ClickHouseWriterConfig{
+		BatchSize:     10,
+		FlushInterval: time.Hour,
+		QueueSize:     10,
+		QueuePolicy:   QueuePolicyBlock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := testRow(1)
+	row.Level = "info"
+	row.TargetKind = "Pod"
+	row.ProcessingTime = 1500
+	row.ObserverMode = true
+	row.Violations = []admissioncontroller.Violation{
+		{CheckID: "probes", Severity: admissioncontroller.SeverityError, Container: "app", FieldPath: "spec.template.spec.containers[0]", Message: "no probes"},
+		{CheckID: "image-latest", Severity: admissioncontroller.SeverityError, Container: "sidecar", Message: "latest tag"},
+	}
+	writer.Enqueue(row)
+	if err := writer.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	columns, rows := fake.table(admissionEventsTable)
+	if len(rows) != 1 {
+		t.Fatalf("got %d rows in %s, want 1", len(rows), admissionEventsTable)
+	}
+	values := make(map[string]interface{}, len(columns))
+	for i, column := range columns {
+		values[column] = rows[0][i]
+	}
+	if values["message"] != row.Message || values["processing_time_us"] != row.ProcessingTime || values["observer_mode"] != true || values["level"] != "info" || values["target_kind"] != "Pod" {
+		t.Errorf("row stored as %v", values)
+	}
+	if got := fmt.Sprint(values["violations.check_id"], values["violations.container"]); got != "[probes image-latest] [app sidecar]" {
+		t.Errorf("violations stored as %s", got)
+	}
+	if values["event_time"] != row.EventTime {
+		t.Errorf("event_time = %v, want %v", values["event_time"], row.EventTime)
+	}
+}
+
+func TestFakeClickHouseRejectsPlaceholderMismatch(t *testing.T) {
+	db, fake := newFakeClickHouse(t)
+	fake.enableSchema()
+	if err := MigrateClickHouse(context.Background(), db, defaultTarget); err != nil {
+		t.Fatal(err)
+	}
+
+	// Like the statement used before the column list was introduced: one placeholder less than columns
+	broken := "INSERT INTO " + admissionEventsTable + " (" + strings.Join(admissionColumns, ", ") + ") VALUES (toDate(?)" +
+		strings.Repeat(", ?", len(admissionColumns)-2) + ")"
+	row := testRow(1)
+	err := insertWithQuery(db, broken, row.args())
+	if err == nil || !strings.Contains(err.Error(), "placeholders") {
+		t.Errorf("expected placeholder mismatch, got %v", err)
+	}
+	if err := insertWithQuery(db, insertAdmissionRowSQL(admissionEventsTable), row.args()); err != nil {
+		t.Errorf("insert failed: %v", err)
+	}
+}
+
+func insertWithQuery(db *sql.DB, query string, args []interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	if _, err := stmt.Exec(args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func TestSetClickHouseTTL(t *testing.T) {
+	db, fake := newFakeClickHouse(t)
+	fake.enableSchema()
+	ctx := context.Background()
+	if err := MigrateClickHouse(ctx, db, defaultTarget); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []struct {
+		days    int
+		ttl     string
+		altered int // TTL changes executed so far
+	}{
+		{days: 0, ttl: "", altered: 0},
+		{days: 30, ttl: "toDateTime(event_time) + toIntervalDay(30)", altered: 1},
+		{days: 30, ttl: "toDateTime(event_time) + toIntervalDay(30)", altered: 1},
+		{days: 90, ttl: "toDateTime(event_time) + toIntervalDay(90)", altered: 2},
+		{days: 0, ttl: "", altered: 3},
+	} {
+		if err := setClickHouseTTL(ctx, db, admissionEventsTable, step.days); err != nil {
+			t.Fatalf("%d days: %v", step.days, err)
+		}
+		fake.mu.Lock()
+		ttl := fake.tableTTL[admissionEventsTable]
+		fake.mu.Unlock()
+		if ttl != step.ttl {
+			t.Errorf("%d days: TTL = %q, want %q", step.days, ttl, step.ttl)
+		}
+		if n := fake.queryCount("ALTER TABLE "+admissionEventsTable+" MODIFY TTL") + fake.queryCount("ALTER TABLE "+admissionEventsTable+" REMOVE TTL"); n != step.altered {
+			t.Errorf("%d days: %d ALTER statements, want %d", step.days, n, step.altered)
+		}
+	}
+}
+
+func TestMigrateClickHouseKeepsVersionsPerTable(t *testing.T) {
+	db, fake := newFakeClickHouse(t)
+	fake.enableSchema()
+	ctx := context.Background()
+
+	targets := []ClickHouseTarget{
+		{Database: "admission", Table: "events_prod"},
+		{Database: "admission", Table: "events_stage"},
+	}
+	for _, target := range targets {
+		for i := 0; i < 2; i++ {
+			if err := MigrateClickHouse(ctx, db, target); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, target := range targets {
+		if columns, _ := fake.table(target.Table); len(columns) == 0 {
+			t.Errorf("table %s was not created", target.Table)
+		}
+	}
+	// Legacy migrations only apply to the default table
+	if columns, _ := fake.table("ADMISSION_TABLE"); columns != nil {
+		t.Errorf("ADMISSION_TABLE created for a custom table")
+	}
+	legacy := 0
+	for _, migration := range clickHouseMigrations {
+		if migration.Legacy {
+			legacy++
+		}
+	}
+	_, applied := fake.table(migrationsTable)
+	if want := 2 * (len(clickHouseMigrations) - legacy); len(applied) != want {
+		t.Errorf("%d migrations recorded, want %d", len(applied), want)
+	}
+}
+
+func TestClickHouseName(t *testing.T) {
+	for _, tt := range []struct {
+		template, id, want string
+		wantErr            bool
+	}{
+		{template: "admission_events", id: "prod", want: "admission_events"},
+		{template: "admission_{k8s_id}", id: "prod-eu.1", want: "admission_prod_eu_1"},
+		{template: "{k8s_id}_events", id: "prod", want: "prod_events"},
+		{template: "{k8s_id}", id: "1prod", wantErr: true},
+		{template: "events;DROP", id: "prod", wantErr: true},
+		{template: "", id: "prod", wantErr: true},
+	} {
+		got, err := clickHouseName(tt.template, tt.id)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("clickHouseName(%q, %q) = %q, %v", tt.template, tt.id, got, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"admissioncontroller"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventFilterWhereClause(t *testing.T) {
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	filter := EventFilter{Namespace: "team-a", User: "alice", CheckID: "probes", From: from}
+	where, args := filter.whereClause()
+
+	want := " WHERE target_namespace = ? AND (user_name = ? OR user_id = ?) AND has(violations.check_id, ?) AND event_time >= ?"
+	if where != want {
+		t.Errorf("where = %q, want %q", where, want)
+	}
+	if got := fmt.Sprint(args); got != fmt.Sprint([]interface{}{"team-a", "alice", "alice", "probes", from}) {
+		t.Errorf("args = %s", got)
+	}
+
+	if where, args := (EventFilter{}).whereClause(); where != "" || len(args) != 0 {
+		t.Errorf("empty filter: where = %q, args = %v", where, args)
+	}
+}
+
+func TestEventStoreQueriesMatchPlaceholders(t *testing.T) {
+	store := NewClickHouseEventStore(nil, "admission_events")
+	filter := EventFilter{K8sID: "prod", Kind: "Deployment", Result: AuditDenied, To: time.Now()}
+
+	queries := map[string]func() (string, []interface{}){
+		"events":     func() (string, []interface{}) { return store.eventsQuery(filter, 100, 200) },
+		"top checks": func() (string, []interface{}) { return store.topChecksQuery(filter, 10) },
+		"top users":  func() (string, []interface{}) { return store.topUsersQuery(EventFilter{}, 10) },
+		"snapshots":  func() (string, []interface{}) { return store.snapshotsQuery(filter) },
+	}
+	for name, build := range queries {
+		query, args := build()
+		if n := strings.Count(query, "?"); n != len(args) {
+			t.Errorf("%s: %d placeholders, %d args: %s", name, n, len(args), query)
+		}
+		if !strings.Contains(query, "FROM admission_events") {
+			t.Errorf("%s: query doesn't read the table: %s", name, query)
+		}
+	}
+
+	if query, _ := store.topUsersQuery(EventFilter{}, 10); !strings.Contains(query, "WHERE notEmpty(violations.check_id)") {
+		t.Errorf("top users counts requests without violations: %s", query)
+	}
+	if query, _ := store.snapshotsQuery(EventFilter{}); !strings.Contains(query, "WHERE object != ''") {
+		t.Errorf("snapshots reads events without objects: %s", query)
+	}
+}
+
+func TestTopUsersFallsBackToUserID(t *testing.T) {
+	db, fake := newFakeClickHouse(t)
+	fake.enableSchema()
+	if err := MigrateClickHouse(context.Background(), db, defaultTarget); err != nil {
+		t.Fatal(err)
+	}
+
+	violation := []admissioncontroller.Violation{{CheckID: "probes", Severity: admissioncontroller.SeverityError}}
+	for i, event := range []AuditEvent{
+		{UserID: "u-1001", UserName: "alice", Violations: violation},
+		{UserID: "u-1001", UserName: "alice", Violations: violation},
+		{UserID: "system:serviceaccount:ci:deployer", Violations: violation}, // No "username" extra
+		{UserID: "system:serviceaccount:ci:deployer", Violations: violation},
+		{UserID: "system:serviceaccount:ci:deployer", Violations: violation},
+		{UserID: "bob", Violations: violation},
+		{UserID: "carol"}, // Without violations
+	} {
+		event.Time = time.Date(2024, 5, 1, 12, 0, i, 0, time.UTC)
+		event.Result = AuditDenied
+		if err := insertWithQuery(db, insertAdmissionRowSQL(admissionEventsTable), newClickHouseRow(event).args()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := NewClickHouseEventStore(db, admissionEventsTable)
+	counts, err := store.TopUsers(context.Background(), EventFilter{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []EventCount{{Key: "system:serviceaccount:ci:deployer", Count: 3}, {Key: "alice", Count: 2}, {Key: "bob", Count: 1}}
+	if fmt.Sprint(counts) != fmt.Sprint(want) {
+		t.Errorf("top users = %v, want %v", counts, want)
+	}
+}
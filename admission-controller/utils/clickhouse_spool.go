@@ -0,0 +1,198 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// clickHouseSpool is a file-backed, size-capped queue of rows kept while ClickHouse is unavailable.
+// Rows are stored as JSON lines, replay progress is kept in a separate offset file, so after a restart
+// replay continues where it stopped. A row may be written twice if the process dies in the middle of a replay
+type clickHouseSpool struct {
+	path     string
+	maxBytes int64
+	file     *os.File // Opened for appending
+	size     int64    // Current size of the spool file
+	offset   int64    // Position of the first row which is not replayed yet
+}
+
+func openClickHouseSpool(path string, maxBytes int64) (*clickHouseSpool, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	s := &clickHouseSpool{path: path, maxBytes: maxBytes, file: file, size: info.Size()}
+	if data, err := os.ReadFile(s.offsetPath()); err == nil {
+		offset, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err == nil && offset >= 0 && offset <= s.size {
+			s.offset = offset
+		}
+	}
+	clickhouseSpoolBytes.WithLabelValues(k8sID).Set(float64(s.pending()))
+	return s, nil
+}
+
+func (s *clickHouseSpool) offsetPath() string {
+	return s.path + ".offset"
+}
+
+// pending returns the number of bytes waiting for replay
+func (s *clickHouseSpool) pending() int64 {
+	return s.size - s.offset
+}
+
+// Empty reports whether every spooled row was replayed
+func (s *clickHouseSpool) Empty() bool {
+	return s.pending() == 0
+}
+
+// Append writes rows to the end of the spool. Rows which don't fit into maxBytes are dropped
+func (s *clickHouseSpool) Append(rows []clickHouseRow) (int, error) {
+	var buf []byte
+	dropped := 0
+	for _, row := range rows {
+		line, err := json.Marshal(row)
+		if err != nil {
+			return dropped, err
+		}
+		if s.size+int64(len(buf)+len(line)+1) > s.maxBytes && s.offset > 0 {
+			// The replayed head still takes space, move the pending tail to the beginning of the file
+			if err := s.compact(); err != nil {
+				return dropped, err
+			}
+		}
+		if s.size+int64(len(buf)+len(line)+1) > s.maxBytes {
+			dropped++
+			continue
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+	if len(buf) == 0 {
+		return dropped, nil
+	}
+
+	n, err := s.file.Write(buf)
+	s.size += int64(n)
+	clickhouseSpoolBytes.WithLabelValues(k8sID).Set(float64(s.pending()))
+	if err != nil {
+		return dropped, err
+	}
+	return dropped, s.file.Sync()
+}
+
+// Peek reads up to limit rows starting at the replay position. It returns the rows and the position after them
+func (s *clickHouseSpool) Peek(limit int) ([]clickHouseRow, int64, error) {
+	reader, err := os.Open(s.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer reader.Close()
+	if _, err := reader.Seek(s.offset, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	buffered := bufio.NewReader(io.LimitReader(reader, s.pending()))
+	rows := make([]clickHouseRow, 0, limit)
+	next := s.offset
+	for len(rows) < limit {
+		line, err := buffered.ReadBytes('\n')
+		if err == io.EOF {
+			// Appends are complete by the time of a replay, so a line without a newline is left by a crash
+			next += int64(len(line))
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		next += int64(len(line))
+
+		var row clickHouseRow
+		if err := json.Unmarshal(line, &row); err != nil {
+			Log.Warnf("Skipping corrupted ClickHouse spool record at offset %d: %v", next-int64(len(line)), err)
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, next, nil
+}
+
+// Commit marks rows up to the position returned by Peek as replayed. Once everything is replayed the file is truncated
+func (s *clickHouseSpool) Commit(next int64) error {
+	s.offset = next
+	defer func() {
+		clickhouseSpoolBytes.WithLabelValues(k8sID).Set(float64(s.pending()))
+	}()
+
+	if s.Empty() {
+		if err := s.file.Truncate(0); err != nil {
+			return err
+		}
+		s.size, s.offset = 0, 0
+		if err := os.Remove(s.offsetPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(s.offsetPath(), []byte(strconv.FormatInt(s.offset, 10)), 0o600)
+}
+
+// compact rewrites the spool without the replayed rows
+func (s *clickHouseSpool) compact() error {
+	reader, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if _, err := reader.Seek(s.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(tmp, reader)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	// Offset goes first: a crash before the rename then replays the old head again instead of skipping rows
+	if err == nil {
+		if removeErr := os.Remove(s.offsetPath()); removeErr != nil && !os.IsNotExist(removeErr) {
+			err = removeErr
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file, s.size, s.offset = file, size, 0
+	return nil
+}
+
+func (s *clickHouseSpool) Close() error {
+	return s.file.Close()
+}
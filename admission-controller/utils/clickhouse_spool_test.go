@@ -0,0 +1,253 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func messages(rows []clickHouseRow) []string {
+	result := make([]string, 0, len(rows))
+	for _, row := range rows {
+		result = append(result, row.Message)
+	}
+	return result
+}
+
+func TestClickHouseSpoolReplaysInOrderAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+	spool, err := openClickHouseSpool(path, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := []clickHouseRow{testRow(0), testRow(1), testRow(2), testRow(3), testRow(4)}
+	if dropped, err := spool.Append(rows); err != nil || dropped != 0 {
+		t.Fatalf("Append() = %d, %v", dropped, err)
+	}
+
+	head, next, err := spool.Peek(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(messages(head)); got != "[row 0 row 1]" {
+		t.Fatalf("first Peek() = %s", got)
+	}
+	if err := spool.Commit(next); err != nil {
+		t.Fatal(err)
+	}
+	spool.Close()
+
+	// Replay continues from the committed offset after reopening
+	spool, err = openClickHouseSpool(path, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	tail, next, err := spool.Peek(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(messages(tail)); got != "[row 2 row 3 row 4]" {
+		t.Fatalf("Peek() after reopen = %s", got)
+	}
+	if !tail[0].EventTime.Equal(rows[2].EventTime) {
+		t.Errorf("event time = %v, want %v", tail[0].EventTime, rows[2].EventTime)
+	}
+	if err := spool.Commit(next); err != nil {
+		t.Fatal(err)
+	}
+	if !spool.Empty() {
+		t.Error("spool is not empty after replaying everything")
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+		t.Errorf("spool file was not truncated: %v, %v", info, err)
+	}
+	if _, err := os.Stat(path + ".offset"); !os.IsNotExist(err) {
+		t.Errorf("offset file was not removed: %v", err)
+	}
+}
+
+func TestClickHouseSpoolDropsRowsBeyondLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+	spool, err := openClickHouseSpool(path, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	dropped, err := spool.Append([]clickHouseRow{testRow(0), testRow(1), testRow(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped == 0 {
+		t.Fatal("no rows were dropped")
+	}
+	if info, _ := os.Stat(path); info.Size() > 400 {
+		t.Errorf("spool size %d is over the limit", info.Size())
+	}
+}
+
+func TestClickHouseSpoolCompactsReplayedRows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+	spool, err := openClickHouseSpool(path, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool.Append([]clickHouseRow{testRow(0), testRow(1)})
+	head, next, _ := spool.Peek(1)
+	if len(head) != 1 {
+		t.Fatalf("Peek() returned %d rows", len(head))
+	}
+	spool.Commit(next)
+	spool.Close()
+
+	// Three rows fit, so the second Append needs the replayed one to be removed
+	limit := 3*next + 2
+	spool, err = openClickHouseSpool(path, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	if dropped, err := spool.Append([]clickHouseRow{testRow(2), testRow(3)}); err != nil || dropped != 0 {
+		t.Fatalf("Append() = %d, %v", dropped, err)
+	}
+	rows, _, err := spool.Peek(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(messages(rows)); got != "[row 1 row 2 row 3]" {
+		t.Errorf("Peek() after compaction = %s", got)
+	}
+}
+
+func TestClickHouseSpoolSkipsTruncatedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+	spool, err := openClickHouseSpool(path, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool.Append([]clickHouseRow{testRow(0)})
+	spool.file.WriteString(`{"message":"row 1","ev`) // Crash in the middle of a write
+	spool.Close()
+
+	spool, err = openClickHouseSpool(path, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	rows, next, err := spool.Peek(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(messages(rows)); got != "[row 0]" {
+		t.Errorf("Peek() = %s", got)
+	}
+	spool.Commit(next)
+	if !spool.Empty() {
+		t.Error("truncated record was not skipped")
+	}
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestClickHouseWriterSpoolsUntilConnected(t *testing.T) {
+	_, fake := newFakeClickHouse(t)
+	var available atomic.Bool
+	connect := func(ctx context.Context) (*sql.DB, error) {
+		if !available.Load() {
+			return nil, fmt.Errorf("connection refused")
+		}
+		return fakeConnector(t)(ctx)
+	}
+	spoolPath := filepath.Join(t.TempDir(), "spool.jsonl")
+	writer, err := newClickHouseWriter(connect, ClickHouseWriterConfig{
+		BatchSize:     2,
+		FlushInterval: 5 * time.Millisecond,
+		QueueSize:     100,
+		QueuePolicy:   QueuePolicyBlock,
+		SpoolPath:     spoolPath,
+		SpoolMaxBytes: 1 << 20,
+		RetryMin:      5 * time.Millisecond,
+		RetryMax:      20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if writer.Connected() {
+		t.Fatal("writer reports a connection while ClickHouse is down")
+	}
+
+	for i := 0; i < 3; i++ {
+		writer.Enqueue(testRow(i))
+	}
+	waitFor(t, "rows in the spool", func() bool {
+		info, err := os.Stat(spoolPath)
+		return err == nil && info.Size() > 0 && len(writer.queue) == 0
+	})
+
+	available.Store(true)
+	waitFor(t, "spool replay", func() bool { return len(fake.rows()) == 3 })
+	if !writer.Connected() {
+		t.Error("writer doesn't report the connection after replay")
+	}
+
+	writer.Enqueue(testRow(3))
+	if err := writer.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, row := range fake.rows() {
+		got = append(got, row[columnIndex("message")].(string))
+	}
+	if fmt.Sprint(got) != "[row 0 row 1 row 2 row 3]" {
+		t.Errorf("rows = %v", got)
+	}
+}
+
+func TestClickHouseWriterSpoolsOnConnectionLoss(t *testing.T) {
+	_, fake := newFakeClickHouse(t)
+	writer, err := newClickHouseWriter(fakeConnector(t), ClickHouseWriterConfig{
+		BatchSize:     1,
+		FlushInterval: time.Hour,
+		QueueSize:     100,
+		QueuePolicy:   QueuePolicyBlock,
+		SpoolPath:     filepath.Join(t.TempDir(), "spool.jsonl"),
+		SpoolMaxBytes: 1 << 20,
+		RetryMin:      5 * time.Millisecond,
+		RetryMax:      20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close(context.Background())
+
+	writer.Enqueue(testRow(0))
+	waitFor(t, "direct write", func() bool { return len(fake.rows()) == 1 })
+
+	fake.setDown(true)
+	writer.Enqueue(testRow(1))
+	waitFor(t, "disconnect", func() bool { return !writer.Connected() })
+	writer.Enqueue(testRow(2))
+
+	fake.setDown(false)
+	waitFor(t, "spool replay", func() bool { return len(fake.rows()) == 3 })
+	for i, row := range fake.rows() {
+		if got, want := row[columnIndex("message")], fmt.Sprintf("row %d", i); got != want {
+			t.Errorf("row %d: message = %v, want %q", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,431 @@
+package utils
+
+import (
+	"admissioncontroller"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Queue policies of the ClickHouse writer when the queue is full
+const (
+	QueuePolicyDrop  = "drop"  // Drop the new row and count it in clickhouse_dropped_rows_total
+	QueuePolicyBlock = "block" // Block the caller until there is room in the queue
+)
+
+// admissionColumns are admission events table columns written by the writer, in the order of clickHouseRow.args
+var admissionColumns = []string{
+	"event_time", "k8s_id", "level", "message", "user_id", "user_name", "user_groups",
+	"request_id", "request_type", "target_namespace", "target_kind", "target_name",
+	"admission_result", "admission_reason", "processing_time_us", "observer_mode",
+	"object", "old_object", "snapshot_truncated", "config_version",
+	"violations.check_id", "violations.severity", "violations.container",
+	"violations.field_path", "violations.message", "violations.remediation",
+}
+
+// insertAdmissionRowSQL is built from the column list, so the number of placeholders always matches it
+func insertAdmissionRowSQL(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table,
+		strings.Join(admissionColumns, ", "),
+		strings.TrimSuffix(strings.Repeat("?, ", len(admissionColumns)), ", "),
+	)
+}
+
+// ClickHouseWriterConfig holds batching settings of the ClickHouse writer
+type ClickHouseWriterConfig struct {
+	Table         string        // Admission events table, admission_events if not set
+	BatchSize     int           // Rows per INSERT transaction
+	FlushInterval time.Duration // Maximum time a row waits in a partial batch
+	QueueSize     int           // Rows buffered between the log hook and the writer
+	QueuePolicy   string        // QueuePolicyDrop or QueuePolicyBlock
+	FlushTimeout  time.Duration // Time limit for a single batch write, 10s if not set
+	SpoolPath     string        // File keeping rows while ClickHouse is unavailable, spooling is disabled if empty
+	SpoolMaxBytes int64         // Size limit of the spool file, rows beyond it are dropped
+	RetryMin      time.Duration // Reconnect backoff bounds, 1s and 1m if not set
+	RetryMax      time.Duration
+}
+
+// clickHouseConnector returns a connection which is ready for inserts: pinged and with the schema in place
+type clickHouseConnector func(ctx context.Context) (*sql.DB, error)
+
+// clickHouseRow is a single row of the admission events table
+type clickHouseRow struct {
+	EventTime       time.Time `json:"event_time"`
+	K8sID           string    `json:"k8s_id"`
+	Level           string    `json:"level"`
+	Message         string    `json:"message"`
+	UserID          string    `json:"user_id"`
+	UserName        string    `json:"user_name"`
+	UserGroups      []string  `json:"user_groups"`
+	RequestID       string    `json:"request_id"`
+	RequestType     string    `json:"request_type"`
+	TargetNamespace string    `json:"target_namespace"`
+	TargetKind      string    `json:"target_kind"`
+	TargetName      string    `json:"target_name"`
+	AdmissionResult string    `json:"admission_result"`
+	AdmissionReason string    `json:"admission_reason"`
+	ProcessingTime  uint64    `json:"processing_time_us"` // Microseconds
+	ObserverMode    bool      `json:"observer_mode"`
+	Object          string    `json:"object,omitempty"`
+	OldObject       string    `json:"old_object,omitempty"`
+	Truncated       bool      `json:"snapshot_truncated,omitempty"`
+	ConfigVersion   string    `json:"config_version,omitempty"`
+
+	Violations []admissioncontroller.Violation `json:"violations,omitempty"`
+}
+
+// args returns the row values in the order of admissionColumns
+func (row clickHouseRow) args() []interface{} {
+	args := []interface{}{
+		row.EventTime, row.K8sID, row.Level, row.Message,
+		row.UserID, row.UserName, row.UserGroups,
+		row.RequestID, row.RequestType, row.TargetNamespace, row.TargetKind, row.TargetName,
+		row.AdmissionResult, row.AdmissionReason, row.ProcessingTime, row.ObserverMode,
+		row.Object, row.OldObject, row.Truncated, row.ConfigVersion,
+	}
+	// Nested columns are written as parallel arrays of the same length
+	var nested [6][]string
+	for i := range nested {
+		nested[i] = make([]string, 0, len(row.Violations))
+	}
+	for _, v := range row.Violations {
+		for i, value := range []string{v.CheckID, v.Severity, v.Container, v.FieldPath, v.Message, v.Remediation} {
+			nested[i] = append(nested[i], value)
+		}
+	}
+	for _, values := range nested {
+		args = append(args, values)
+	}
+	return args
+}
+
+// clickHouseWriter buffers rows in a bounded queue and writes them in batches from a background goroutine,
+// so a slow ClickHouse doesn't add latency to admission requests. While ClickHouse is unavailable batches go
+// to the spool, the writer reconnects with backoff and replays the spool in order before writing new rows.
+// The writer logs only with Warning and Debug levels, which are not sent back to ClickHouse
+type clickHouseWriter struct {
+	connect clickHouseConnector
+	cfg     ClickHouseWriterConfig
+	queue   chan clickHouseRow
+	done    chan struct{}
+	closing chan struct{} // Closed by Close, releases senders waiting for room in the queue
+
+	lock      sync.RWMutex   // Held for reading by Enqueue only to register as a sender, never across the send
+	closed    bool           // Set under lock, no sender registers afterwards
+	senders   sync.WaitGroup // Registered senders, the queue is closed once they return
+	closeOnce sync.Once
+
+	connected atomic.Bool // For readiness checks, everything below is owned by the run goroutine
+	db        *sql.DB     // nil while disconnected
+	spool     *clickHouseSpool
+	retry     *time.Timer // Pending reconnect or replay attempt
+	backoff   time.Duration
+}
+
+func newClickHouseWriter(connect clickHouseConnector, cfg ClickHouseWriterConfig) (*clickHouseWriter, error) {
+	if cfg.BatchSize <= 0 || cfg.QueueSize <= 0 || cfg.FlushInterval <= 0 {
+		return nil, fmt.Errorf("batch size, queue size and flush interval must be positive")
+	}
+	if cfg.QueuePolicy != QueuePolicyDrop && cfg.QueuePolicy != QueuePolicyBlock {
+		return nil, fmt.Errorf("unknown queue policy %q, expected %s or %s", cfg.QueuePolicy, QueuePolicyDrop, QueuePolicyBlock)
+	}
+	if cfg.Table == "" {
+		cfg.Table = admissionEventsTable
+	}
+	if cfg.FlushTimeout <= 0 {
+		cfg.FlushTimeout = 10 * time.Second
+	}
+	if cfg.RetryMin <= 0 {
+		cfg.RetryMin = time.Second
+	}
+	if cfg.RetryMax < cfg.RetryMin {
+		cfg.RetryMax = max(time.Minute, cfg.RetryMin)
+	}
+
+	w := &clickHouseWriter{
+		connect: connect,
+		cfg:     cfg,
+		queue:   make(chan clickHouseRow, cfg.QueueSize),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	if cfg.SpoolPath != "" {
+		if cfg.SpoolMaxBytes <= 0 {
+			return nil, fmt.Errorf("spool size limit must be positive")
+		}
+		spool, err := openClickHouseSpool(cfg.SpoolPath, cfg.SpoolMaxBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open spool: %v", err)
+		}
+		w.spool = spool
+	}
+
+	// The first attempt is synchronous, so entries logged during startup go straight to ClickHouse.
+	// A spool left from the previous run is replayed by the run goroutine
+	if !w.connectDB() || (w.spool != nil && !w.spool.Empty()) {
+		w.scheduleRetry()
+	}
+	go w.run()
+	return w, nil
+}
+
+// Connected reports whether the last attempt to reach ClickHouse succeeded
+func (w *clickHouseWriter) Connected() bool {
+	return w.connected.Load()
+}
+
+// Enqueue adds a row to the queue. It returns false if the row was dropped
+func (w *clickHouseWriter) Enqueue(row clickHouseRow) bool {
+	w.lock.RLock()
+	if w.closed {
+		w.lock.RUnlock()
+		clickhouseDroppedRows.WithLabelValues("closed", k8sID).Inc()
+		return false
+	}
+	w.senders.Add(1)
+	w.lock.RUnlock()
+	defer w.senders.Done()
+
+	if w.cfg.QueuePolicy == QueuePolicyBlock {
+		select {
+		case w.queue <- row:
+		case <-w.closing:
+			clickhouseDroppedRows.WithLabelValues("closed", k8sID).Inc()
+			return false
+		}
+	} else {
+		select {
+		case w.queue <- row:
+		default:
+			clickhouseDroppedRows.WithLabelValues("queue_full", k8sID).Inc()
+			return false
+		}
+	}
+	clickhouseQueueDepth.WithLabelValues(k8sID).Set(float64(len(w.queue)))
+	return true
+}
+
+// Close stops accepting rows and waits until the queued ones are written or spooled, or ctx is done
+func (w *clickHouseWriter) Close(ctx context.Context) error {
+	w.closeOnce.Do(func() {
+		close(w.closing)
+		go w.closeQueue()
+	})
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d rows were not written: %v", len(w.queue), ctx.Err())
+	}
+}
+
+// closeQueue closes the queue once no sender can write to it, so the run goroutine drains it and stops
+func (w *clickHouseWriter) closeQueue() {
+	w.lock.Lock()
+	w.closed = true
+	w.lock.Unlock()
+	w.senders.Wait()
+	close(w.queue)
+}
+
+func (w *clickHouseWriter) run() {
+	defer close(w.done)
+	defer w.shutdown()
+
+	ticker := time.NewTicker(w.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]clickHouseRow, 0, w.cfg.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		w.writeBatch(batch)
+		batch = batch[:0]
+	}
+
+	for {
+		var retry <-chan time.Time
+		if w.retry != nil {
+			retry = w.retry.C
+		}
+
+		select {
+		case row, ok := <-w.queue:
+			if !ok {
+				flush()
+				return
+			}
+			clickhouseQueueDepth.WithLabelValues(k8sID).Set(float64(len(w.queue)))
+			batch = append(batch, row)
+			if len(batch) >= w.cfg.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-retry:
+			w.retry = nil
+			w.reconnect()
+		}
+	}
+}
+
+// shutdown releases the spool and the connection once the queue is drained
+func (w *clickHouseWriter) shutdown() {
+	if w.retry != nil {
+		w.retry.Stop()
+	}
+	if w.spool != nil {
+		if !w.spool.Empty() {
+			Log.Warnf("ClickHouse spool is not empty on shutdown: %d bytes left for replay", w.spool.pending())
+		}
+		w.spool.Close()
+	}
+	if w.db != nil {
+		w.db.Close()
+	}
+}
+
+// writeBatch writes rows directly if ClickHouse is available and the spool is empty, otherwise appends them to the spool
+func (w *clickHouseWriter) writeBatch(batch []clickHouseRow) {
+	if w.db != nil && (w.spool == nil || w.spool.Empty()) {
+		if w.write(batch) {
+			return
+		}
+	}
+	w.spoolRows(batch)
+}
+
+// write inserts rows and reports whether ClickHouse is still available. Rows rejected by a reachable ClickHouse
+// are dropped, since retrying them won't help
+func (w *clickHouseWriter) write(rows []clickHouseRow) bool {
+	startTime := time.Now()
+	err := w.insert(rows)
+	status := "ok"
+	defer func() {
+		clickhouseFlushDuration.WithLabelValues(status, k8sID).Observe(time.Since(startTime).Seconds())
+	}()
+	if err == nil {
+		return true
+	}
+
+	status = "error"
+	ctx, cancel := context.WithTimeout(context.Background(), w.cfg.FlushTimeout)
+	defer cancel()
+	if pingErr := w.db.PingContext(ctx); pingErr == nil {
+		clickhouseDroppedRows.WithLabelValues("write_error", k8sID).Add(float64(len(rows)))
+		Log.Warnf("ClickHouse rejected %d rows: %v", len(rows), err)
+		return true
+	}
+
+	Log.Warnf("Lost connection to ClickHouse: %v", err)
+	w.disconnect()
+	return false
+}
+
+// spoolRows keeps rows for replay, or drops them if spooling is disabled
+func (w *clickHouseWriter) spoolRows(rows []clickHouseRow) {
+	defer w.scheduleRetry()
+	if w.spool == nil {
+		clickhouseDroppedRows.WithLabelValues("unavailable", k8sID).Add(float64(len(rows)))
+		return
+	}
+	dropped, err := w.spool.Append(rows)
+	if dropped > 0 {
+		clickhouseDroppedRows.WithLabelValues("spool_full", k8sID).Add(float64(dropped))
+	}
+	if err != nil {
+		Log.Warnf("Failed to write to ClickHouse spool %s: %v", w.cfg.SpoolPath, err)
+	}
+}
+
+// reconnect restores the connection if needed and replays the spool. On failure it schedules another attempt
+func (w *clickHouseWriter) reconnect() {
+	if !w.connectDB() || !w.replaySpool() {
+		w.scheduleRetry()
+		return
+	}
+	w.backoff = 0
+}
+
+func (w *clickHouseWriter) connectDB() bool {
+	if w.db != nil {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), w.cfg.FlushTimeout)
+	defer cancel()
+	db, err := w.connect(ctx)
+	if err != nil {
+		Log.Warnf("Failed to connect to ClickHouse: %v", err)
+		return false
+	}
+	w.db = db
+	w.connected.Store(true)
+	Log.Debugf("Connected to ClickHouse")
+	return true
+}
+
+// replaySpool writes spooled rows in order, batch by batch. It returns false if the spool is not empty yet
+func (w *clickHouseWriter) replaySpool() bool {
+	for w.spool != nil && !w.spool.Empty() {
+		rows, next, err := w.spool.Peek(w.cfg.BatchSize)
+		if err != nil {
+			Log.Warnf("Failed to read ClickHouse spool %s: %v", w.cfg.SpoolPath, err)
+			return false
+		}
+		if len(rows) > 0 && !w.write(rows) {
+			return false
+		}
+		if err := w.spool.Commit(next); err != nil {
+			Log.Warnf("Failed to update ClickHouse spool %s: %v", w.cfg.SpoolPath, err)
+			return false
+		}
+	}
+	return true
+}
+
+func (w *clickHouseWriter) disconnect() {
+	if w.db != nil {
+		w.db.Close()
+		w.db = nil
+	}
+	w.connected.Store(false)
+}
+
+func (w *clickHouseWriter) scheduleRetry() {
+	if w.retry != nil {
+		return
+	}
+	w.backoff = min(max(2*w.backoff, w.cfg.RetryMin), w.cfg.RetryMax)
+	w.retry = time.NewTimer(w.backoff)
+}
+
+func (w *clickHouseWriter) insert(batch []clickHouseRow) error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.cfg.FlushTimeout)
+	defer cancel()
+
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, insertAdmissionRowSQL(w.cfg.Table))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, row := range batch {
+		if _, err := stmt.ExecContext(ctx, row.args()...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
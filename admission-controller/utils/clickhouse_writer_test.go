@@ -0,0 +1,257 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func testRow(i int) clickHouseRow {
+	return clickHouseRow{
+		EventTime:  time.Date(2024, 5, 1, 12, 0, i, 0, time.UTC),
+		Message:    fmt.Sprintf("row %d", i),
+		UserGroups: []string{},
+	}
+}
+
+func TestClickHouseWriterBatchesRowsInOrder(t *testing.T) {
+	_, fake := newFakeClickHouse(t)
+	writer, err := newClickHouseWriter(fakeConnector(t), ClickHouseWriterConfig{
+		BatchSize:     3,
+		FlushInterval: time.Hour,
+		QueueSize:     100,
+		QueuePolicy:   QueuePolicyBlock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 7; i++ {
+		if !writer.Enqueue(testRow(i)) {
+			t.Fatalf("row %d was dropped", i)
+		}
+	}
+	if err := writer.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := fake.rows()
+	if len(rows) != 7 {
+		t.Fatalf("got %d rows, want 7", len(rows))
+	}
+	for i, row := range rows {
+		if got, want := row[columnIndex("message")], fmt.Sprintf("row %d", i); got != want {
+			t.Errorf("row %d: message = %v, want %q", i, got, want)
+		}
+	}
+	// Two full batches and the remainder flushed on Close
+	if got := fake.commitCount(); got != 3 {
+		t.Errorf("got %d transactions, want 3", got)
+	}
+}
+
+func TestClickHouseWriterFlushesOnInterval(t *testing.T) {
+	_, fake := newFakeClickHouse(t)
+	writer, err := newClickHouseWriter(fakeConnector(t), ClickHouseWriterConfig{
+		BatchSize:     100,
+		FlushInterval: 10 * time.Millisecond,
+		QueueSize:     100,
+		QueuePolicy:   QueuePolicyDrop,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close(context.Background())
+
+	writer.Enqueue(testRow(1))
+	writer.Enqueue(testRow(2))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(fake.rows()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("partial batch was not flushed, got %d rows", len(fake.rows()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestClickHouseWriterDropsWhenQueueIsFull(t *testing.T) {
+	_, fake := newFakeClickHouse(t)
+	fake.block = make(chan struct{})
+	writer, err := newClickHouseWriter(fakeConnector(t), ClickHouseWriterConfig{
+		BatchSize:     1,
+		FlushInterval: time.Hour,
+		QueueSize:     2,
+		QueuePolicy:   QueuePolicyDrop,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := testutil.ToFloat64(clickhouseDroppedRows.WithLabelValues("queue_full", k8sID))
+
+	// The first row blocks the writer inside Exec, two more fill the queue
+	writer.Enqueue(testRow(0))
+	deadline := time.Now().Add(2 * time.Second)
+	for len(writer.queue) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("writer didn't pick up the first row")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	writer.Enqueue(testRow(1))
+	writer.Enqueue(testRow(2))
+	if writer.Enqueue(testRow(3)) {
+		t.Fatal("row was queued into a full queue")
+	}
+	if got := testutil.ToFloat64(clickhouseDroppedRows.WithLabelValues("queue_full", k8sID)) - dropped; got != 1 {
+		t.Errorf("dropped rows metric increased by %v, want 1", got)
+	}
+
+	close(fake.block)
+	if err := writer.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(fake.rows()); got != 3 {
+		t.Errorf("got %d rows, want 3", got)
+	}
+}
+
+func TestClickHouseWriterCountsFailedBatches(t *testing.T) {
+	_, fake := newFakeClickHouse(t)
+	fake.execErr = fmt.Errorf("connection reset")
+	writer, err := newClickHouseWriter(fakeConnector(t), ClickHouseWriterConfig{
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+		QueueSize:     10,
+		QueuePolicy:   QueuePolicyBlock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := testutil.ToFloat64(clickhouseDroppedRows.WithLabelValues("write_error", k8sID))
+	writer.Enqueue(testRow(0))
+	writer.Enqueue(testRow(1))
+	if err := writer.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(clickhouseDroppedRows.WithLabelValues("write_error", k8sID)) - dropped; got != 2 {
+		t.Errorf("dropped rows metric increased by %v, want 2", got)
+	}
+	if writer.Enqueue(testRow(2)) {
+		t.Error("row was queued after Close")
+	}
+}
+
+func TestClickHouseWriterRejectsInvalidConfig(t *testing.T) {
+	newFakeClickHouse(t)
+	for _, cfg := range []ClickHouseWriterConfig{
+		{BatchSize: 0, FlushInterval: time.Second, QueueSize: 1, QueuePolicy: QueuePolicyDrop},
+		{BatchSize: 1, FlushInterval: time.Second, QueueSize: 1, QueuePolicy: "retry"},
+	} {
+		if _, err := newClickHouseWriter(fakeConnector(t), cfg); err == nil {
+			t.Errorf("config %+v was accepted", cfg)
+		}
+	}
+}
+
+func TestNewClickHouseRow(t *testing.T) {
+	event := AuditEvent{
+		Time:            time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC),
+		K8sID:           "prod",
+		UserID:          "system:serviceaccount:ci:deployer",
+		UserName:        "alice",
+		UserGroups:      []string{"system:authenticated"},
+		RequestID:       "0df28fbd",
+		RequestType:     "create",
+		TargetNamespace: "team-a",
+		TargetKind:      "Deployment",
+		TargetName:      "web",
+		Result:          AuditDenied,
+		Reason:          "no probes",
+		ProcessingTime:  1200 * time.Microsecond,
+	}
+
+	row := newClickHouseRow(event)
+	want := clickHouseRow{
+		EventTime:       time.Date(2024, 5, 1, 12, 0, 0, 123000000, time.UTC),
+		K8sID:           "prod",
+		Level:           "error",
+		Message:         "Admission denied",
+		UserID:          "system:serviceaccount:ci:deployer",
+		UserName:        "alice",
+		UserGroups:      []string{"system:authenticated"},
+		RequestID:       "0df28fbd",
+		RequestType:     "create",
+		TargetNamespace: "team-a",
+		TargetKind:      "Deployment",
+		TargetName:      "web",
+		AdmissionResult: "denied",
+		AdmissionReason: "no probes",
+		ProcessingTime:  1200,
+		ObserverMode:    false,
+	}
+	if fmt.Sprint(row) != fmt.Sprint(want) {
+		t.Errorf("newClickHouseRow() = %+v, want %+v", row, want)
+	}
+}
+
+func TestClickHouseWriterCloseReleasesBlockedSenders(t *testing.T) {
+	_, fake := newFakeClickHouse(t)
+	fake.block = make(chan struct{})
+	writer, err := newClickHouseWriter(fakeConnector(t), ClickHouseWriterConfig{
+		BatchSize:     1,
+		FlushInterval: time.Hour,
+		QueueSize:     1,
+		QueuePolicy:   QueuePolicyBlock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first row blocks the writer inside Exec, the second fills the queue and the third waits for room
+	writer.Enqueue(testRow(0))
+	deadline := time.Now().Add(2 * time.Second)
+	for len(writer.queue) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("writer didn't pick up the first row")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	writer.Enqueue(testRow(1))
+	queued := make(chan bool)
+	go func() { queued <- writer.Enqueue(testRow(2)) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := writer.Close(ctx); err == nil {
+		t.Error("Close returned nil while the writer was blocked")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close took %v past a 50ms deadline", elapsed)
+	}
+	select {
+	case ok := <-queued:
+		if ok {
+			t.Error("blocked row was queued after Close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Enqueue stayed blocked after Close")
+	}
+	if writer.Enqueue(testRow(3)) {
+		t.Error("row was queued after Close")
+	}
+
+	close(fake.block)
+	if err := writer.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(fake.rows()); got != 2 {
+		t.Errorf("got %d rows, want 2", got)
+	}
+}
@@ -1,8 +1,6 @@
 package utils
 
 import (
-	"os"
-
 	"github.com/sirupsen/logrus"
 )
 
@@ -21,13 +19,22 @@ func init() {
 		},
 	}
 
-	// Debug loglevel
-	if os.Getenv("DEBUG") == "true" {
-		Log.Level = logrus.DebugLevel
+	Log.Level = logrus.InfoLevel
+	Log.AddHook(&K8sIDHook{})
+}
+
+// SetDebug switches between the debug and info log levels
+func SetDebug(debug bool) {
+	if debug {
+		Log.SetLevel(logrus.DebugLevel)
 	} else {
-		Log.Level = logrus.InfoLevel
+		Log.SetLevel(logrus.InfoLevel)
 	}
-	Log.AddHook(&K8sIDHook{})
+}
+
+// DebugEnabled reports whether the debug log level is active
+func DebugEnabled() bool {
+	return Log.IsLevelEnabled(logrus.DebugLevel)
 }
 
 // K8sIDHook добавляет k8s_id ко всем записям лога
@@ -52,17 +59,3 @@ func InfoLog(format string, args ...interface{}) {
 func ErrorLog(format string, args ...interface{}) {
 	Log.Errorf(format, args...)
 }
-
-// Функция для безопасного получения строкового значения из logrus.Entry
-func safeString(data map[string]interface{}, key string) string {
-	if val, exists := data[key]; exists && val != nil {
-		// fmt.Printf("Type of value for %s: %T\n", key, val) // log data type
-		switch v := val.(type) {
-		case string:
-			return v
-		default:
-			// fmt.Printf("Failed to assert type for key %s with value %v of type %T\n", key, val, val)
-		}
-	}
-	return ""
-}
@@ -0,0 +1,201 @@
+package utils
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Treatment of the username label
+const (
+	UsernameKeep  = "keep"  // Label every request with the user name
+	UsernameDrop  = "drop"  // Leave the label empty
+	UsernameGroup = "group" // Replace the user name with the first matching group, OtherLabelValue if none matches
+)
+
+// OtherLabelValue replaces label values beyond the limits of the label policy
+const OtherLabelValue = "other"
+
+// LabelGroup maps user names matching Pattern (path.Match syntax) to Name
+type LabelGroup struct {
+	Name    string
+	Pattern string
+}
+
+// LabelPolicy limits the values of the username and namespace labels, which grow with CI
+// service accounts and preview namespaces
+type LabelPolicy struct {
+	Username       string // UsernameKeep, UsernameDrop or UsernameGroup
+	UsernameGroups []LabelGroup
+	Namespaces     []string // Allowlist of namespace patterns, always kept
+	MaxNamespaces  int      // Distinct namespaces outside the allowlist which are kept, 0 means no limit
+}
+
+var (
+	labelPolicy     = LabelPolicy{Username: UsernameKeep}
+	seenNamespaces  = make(map[string]struct{}) // Namespaces counted against MaxNamespaces
+	labelPolicyLock sync.Mutex
+)
+
+// SetLabelPolicy validates and applies the policy. Series created before keep their labels, and namespaces
+// counted against MaxNamespaces stay counted: their series are already exported, so a reload doesn't let
+// another MaxNamespaces through
+func SetLabelPolicy(policy LabelPolicy) error {
+	switch policy.Username {
+	case UsernameKeep, UsernameDrop:
+	case UsernameGroup:
+		if len(policy.UsernameGroups) == 0 {
+			return fmt.Errorf("username grouping needs at least one group")
+		}
+	default:
+		return fmt.Errorf("unknown username label mode %q, expected %s, %s or %s", policy.Username, UsernameKeep, UsernameDrop, UsernameGroup)
+	}
+	for _, group := range policy.UsernameGroups {
+		if _, err := path.Match(group.Pattern, ""); err != nil || group.Name == "" {
+			return fmt.Errorf("invalid username group %s=%s", group.Name, group.Pattern)
+		}
+	}
+	for _, pattern := range policy.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid namespace pattern %q", pattern)
+		}
+	}
+	if policy.MaxNamespaces < 0 {
+		return fmt.Errorf("namespace limit must not be negative")
+	}
+
+	labelPolicyLock.Lock()
+	defer labelPolicyLock.Unlock()
+	labelPolicy = policy
+	return nil
+}
+
+// ParseLabelGroups parses a comma separated list of name=pattern pairs
+func ParseLabelGroups(value string) ([]LabelGroup, error) {
+	var groups []LabelGroup
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		name, pattern, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid username group %q, expected name=pattern", field)
+		}
+		groups = append(groups, LabelGroup{Name: strings.TrimSpace(name), Pattern: strings.TrimSpace(pattern)})
+	}
+	return groups, nil
+}
+
+// policyLabelValue returns the value to export for the label
+func policyLabelValue(name, value string) string {
+	switch name {
+	case "username":
+		return policyUsername(value)
+	case "namespace":
+		return policyNamespace(value)
+	}
+	return value
+}
+
+func policyUsername(username string) string {
+	labelPolicyLock.Lock()
+	defer labelPolicyLock.Unlock()
+	switch labelPolicy.Username {
+	case UsernameDrop:
+		return ""
+	case UsernameGroup:
+		for _, group := range labelPolicy.UsernameGroups {
+			if matched, _ := path.Match(group.Pattern, username); matched {
+				return group.Name
+			}
+		}
+		return OtherLabelValue
+	}
+	return username
+}
+
+func policyNamespace(namespace string) string {
+	labelPolicyLock.Lock()
+	defer labelPolicyLock.Unlock()
+	for _, pattern := range labelPolicy.Namespaces {
+		if matched, _ := path.Match(pattern, namespace); matched {
+			return namespace
+		}
+	}
+	switch {
+	case labelPolicy.MaxNamespaces > 0:
+		if _, ok := seenNamespaces[namespace]; ok {
+			return namespace
+		}
+		if len(seenNamespaces) < labelPolicy.MaxNamespaces {
+			seenNamespaces[namespace] = struct{}{}
+			return namespace
+		}
+		return OtherLabelValue
+	case len(labelPolicy.Namespaces) > 0:
+		return OtherLabelValue
+	}
+	return namespace
+}
+
+// CounterVec passes label values through the label policy
+type CounterVec struct {
+	*prometheus.CounterVec
+	labels []string
+}
+
+func newCounterVec(opts prometheus.CounterOpts, labels []string) *CounterVec {
+	return &CounterVec{CounterVec: prometheus.NewCounterVec(opts, labels), labels: labels}
+}
+
+// WithLabelValues is prometheus.CounterVec.WithLabelValues with the label policy applied
+func (v *CounterVec) WithLabelValues(values ...string) prometheus.Counter {
+	return v.CounterVec.WithLabelValues(applyLabelPolicy(v.labels, values)...)
+}
+
+// With is prometheus.CounterVec.With with the label policy applied
+func (v *CounterVec) With(labels prometheus.Labels) prometheus.Counter {
+	return v.CounterVec.With(applyLabelsPolicy(labels))
+}
+
+// HistogramVec passes label values through the label policy
+type HistogramVec struct {
+	*prometheus.HistogramVec
+	labels []string
+}
+
+func newHistogramVec(opts prometheus.HistogramOpts, labels []string) *HistogramVec {
+	return &HistogramVec{HistogramVec: prometheus.NewHistogramVec(opts, labels), labels: labels}
+}
+
+// WithLabelValues is prometheus.HistogramVec.WithLabelValues with the label policy applied
+func (v *HistogramVec) WithLabelValues(values ...string) prometheus.Observer {
+	return v.HistogramVec.WithLabelValues(applyLabelPolicy(v.labels, values)...)
+}
+
+// With is prometheus.HistogramVec.With with the label policy applied
+func (v *HistogramVec) With(labels prometheus.Labels) prometheus.Observer {
+	return v.HistogramVec.With(applyLabelsPolicy(labels))
+}
+
+func applyLabelPolicy(names, values []string) []string {
+	if len(names) != len(values) {
+		return values // Let the vector report the mismatch
+	}
+	result := make([]string, len(values))
+	for i, value := range values {
+		result[i] = policyLabelValue(names[i], value)
+	}
+	return result
+}
+
+func applyLabelsPolicy(labels prometheus.Labels) prometheus.Labels {
+	result := make(prometheus.Labels, len(labels))
+	for name, value := range labels {
+		result[name] = policyLabelValue(name, value)
+	}
+	return result
+}
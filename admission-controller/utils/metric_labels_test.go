@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func setTestLabelPolicy(t *testing.T, policy LabelPolicy) {
+	t.Helper()
+	if err := SetLabelPolicy(policy); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		SetLabelPolicy(LabelPolicy{Username: UsernameKeep})
+		labelPolicyLock.Lock()
+		seenNamespaces = make(map[string]struct{})
+		labelPolicyLock.Unlock()
+	})
+}
+
+func TestLabelPolicyUsername(t *testing.T) {
+	groups, err := ParseLabelGroups("ci=system:serviceaccount:ci-*:*, nodes=system:node:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestLabelPolicy(t, LabelPolicy{Username: UsernameGroup, UsernameGroups: groups})
+
+	for username, want := range map[string]string{
+		"system:serviceaccount:ci-1234:deployer": "ci",
+		"system:node:worker-1":                   "nodes",
+		"alice":                                  OtherLabelValue,
+	} {
+		if got := policyLabelValue("username", username); got != want {
+			t.Errorf("username %s: got %q, want %q", username, got, want)
+		}
+	}
+
+	setTestLabelPolicy(t, LabelPolicy{Username: UsernameDrop})
+	if got := policyLabelValue("username", "alice"); got != "" {
+		t.Errorf("dropped username: got %q", got)
+	}
+	if got := policyLabelValue("kind", "alice"); got != "alice" {
+		t.Errorf("other labels must not change, got %q", got)
+	}
+}
+
+func TestLabelPolicyNamespaces(t *testing.T) {
+	setTestLabelPolicy(t, LabelPolicy{Username: UsernameKeep, Namespaces: []string{"kube-*"}, MaxNamespaces: 2})
+
+	for _, step := range []struct{ namespace, want string }{
+		{"preview-1", "preview-1"},
+		{"preview-2", "preview-2"},
+		{"preview-3", OtherLabelValue},
+		{"preview-1", "preview-1"}, // Already counted
+		{"kube-system", "kube-system"},
+	} {
+		if got := policyLabelValue("namespace", step.namespace); got != step.want {
+			t.Errorf("namespace %s: got %q, want %q", step.namespace, got, step.want)
+		}
+	}
+
+	setTestLabelPolicy(t, LabelPolicy{Username: UsernameKeep, Namespaces: []string{"prod"}})
+	if got := policyLabelValue("namespace", "preview-1"); got != OtherLabelValue {
+		t.Errorf("namespace outside the allowlist: got %q", got)
+	}
+}
+
+func TestLabelPolicyAppliesToVectors(t *testing.T) {
+	setTestLabelPolicy(t, LabelPolicy{Username: UsernameDrop, Namespaces: []string{"prod"}})
+
+	counter := newCounterVec(prometheus.CounterOpts{Name: "test_total", Help: "test"}, []string{"namespace", "username"})
+	counter.WithLabelValues("preview-1", "alice").Inc()
+	counter.With(prometheus.Labels{"namespace": "preview-2", "username": "bob"}).Inc()
+	counter.WithLabelValues("prod", "carol").Inc()
+
+	if got := testutil.CollectAndCount(counter); got != 2 {
+		t.Errorf("got %d series, want 2", got)
+	}
+	if got := testutil.ToFloat64(counter.CounterVec.WithLabelValues(OtherLabelValue, "")); got != 2 {
+		t.Errorf("other series = %v, want 2", got)
+	}
+}
+
+func TestSetLabelPolicyRejectsInvalid(t *testing.T) {
+	for _, policy := range []LabelPolicy{
+		{Username: "hash"},
+		{Username: UsernameGroup},
+		{Username: UsernameKeep, Namespaces: []string{"[prod"}},
+		{Username: UsernameKeep, MaxNamespaces: -1},
+	} {
+		if err := SetLabelPolicy(policy); err == nil {
+			t.Errorf("policy %+v was accepted", policy)
+		}
+	}
+	if _, err := ParseLabelGroups("ci"); err == nil {
+		t.Error("group without a pattern was parsed")
+	}
+}
+
+func TestLabelPolicyNamespaceLimitSurvivesReloads(t *testing.T) {
+	policy := LabelPolicy{Username: UsernameKeep, MaxNamespaces: 2}
+	setTestLabelPolicy(t, policy)
+	counter := newCounterVec(prometheus.CounterOpts{Name: "test_reload_total", Help: "test"}, []string{"namespace"})
+
+	// Every reload applies the policy again, also when only unrelated settings changed
+	for i, namespaces := range [][]string{{"preview-1", "preview-2", "preview-3"}, {"preview-4"}, {"preview-5", "preview-1"}} {
+		if i > 0 {
+			if err := SetLabelPolicy(policy); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, namespace := range namespaces {
+			counter.WithLabelValues(namespace).Inc()
+		}
+	}
+
+	// preview-1, preview-2 and other
+	if got := testutil.CollectAndCount(counter); got != 3 {
+		t.Errorf("got %d namespace series after two reloads, want 3", got)
+	}
+	if got := testutil.ToFloat64(counter.CounterVec.WithLabelValues("preview-1")); got != 2 {
+		t.Errorf("preview-1 = %v, want 2: a namespace counted before the reload keeps its series", got)
+	}
+}
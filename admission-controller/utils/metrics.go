@@ -3,7 +3,10 @@ package utils
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -11,10 +14,12 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// Counters and histograms are created with newCounterVec and newHistogramVec, so username and namespace
+// labels pass through the label policy
 var (
 	customRegistry = prometheus.NewRegistry() // Metrics registry
 
-	TotalRequests = prometheus.NewCounterVec(
+	TotalRequests = newCounterVec(
 		prometheus.CounterOpts{
 			Name: "total_requests",
 			Help: "Total number of processed admission requests",
@@ -22,21 +27,77 @@ var (
 		[]string{"status", "namespace", "kind", "username", "operation", "observer_mode", "k8s_id"},
 	)
 
-	AvgProcessingTime = prometheus.NewSummaryVec(
-		prometheus.SummaryOpts{
-			Name:       "avg_processing_time_seconds",
-			Help:       "Average time in seconds per admission request",
-			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+	Violations = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "violations_total",
+			Help: "Number of violations found in admission requests by check, also in observer mode",
 		},
-		[]string{"operation", "kind", "status", "namespace", "k8s_id"},
+		[]string{"check", "severity", "namespace", "kind", "operation", "observer_mode", "k8s_id"},
+	)
+
+	WouldDeny = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "would_deny_total",
+			Help: "Number of admission requests which have violations and are denied unless observer mode is on",
+		},
+		[]string{"namespace", "kind", "operation", "observer_mode", "k8s_id"},
+	)
+
+	TimeoutRequests = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "timeout_requests_total",
+			Help: "Number of admission requests which ran out of the time budget, by resulting decision",
+		},
+		[]string{"kind", "operation", "decision", "k8s_id"},
 	)
 
-	MaxProcessingTime = prometheus.NewGaugeVec(
+	InFlightRequests = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Name: "max_processing_time_seconds",
-			Help: "Maximum time in seconds for admission requests",
+			Name: "in_flight_requests",
+			Help: "Number of admission requests currently being processed",
 		},
-		[]string{"operation", "kind", "status", "namespace", "k8s_id"},
+		[]string{"path", "k8s_id"},
+	)
+
+	clickhouseQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "clickhouse_queue_depth",
+			Help: "Number of rows waiting to be written to ClickHouse",
+		},
+		[]string{"k8s_id"},
+	)
+
+	clickhouseDroppedRows = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "clickhouse_dropped_rows_total",
+			Help: "Number of rows which were not written to ClickHouse, by reason",
+		},
+		[]string{"reason", "k8s_id"},
+	)
+
+	clickhouseSpoolBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "clickhouse_spool_bytes",
+			Help: "Size in bytes of the rows waiting in the spool file for replay to ClickHouse",
+		},
+		[]string{"k8s_id"},
+	)
+
+	clickhouseFlushDuration = newHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "clickhouse_flush_duration_seconds",
+			Help:    "Time in seconds to write a batch of rows to ClickHouse",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		},
+		[]string{"status", "k8s_id"},
+	)
+
+	auditDroppedEvents = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "audit_dropped_events_total",
+			Help: "Number of audit events which were not delivered by the file or HTTP sink, by reason",
+		},
+		[]string{"sink", "reason", "k8s_id"},
 	)
 
 	certExpiryMetric = prometheus.NewGaugeVec(
@@ -47,13 +108,112 @@ var (
 		[]string{"k8s_id"},
 	)
 
-	maxTimeValues = make(map[string]float64)
-	maxTimeLock   sync.Mutex
+	certChainExpiryMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tls_cert_chain_expiry_seconds",
+			Help: "Number of seconds until each certificate of the TLS chain and CA bundle expires",
+		},
+		[]string{"k8s_id", "source", "position", "subject"},
+	)
+
+	certExpiryThresholdMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tls_cert_expiry_threshold_seconds",
+			Help: "Configured certificate expiry thresholds in seconds",
+		},
+		[]string{"k8s_id", "severity"},
+	)
+
+	certExpiryStateMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tls_cert_expiry_state",
+			Help: "Certificate expiry state of the earliest expiring certificate: 0 - ok, 1 - warning, 2 - critical",
+		},
+		[]string{"k8s_id"},
+	)
+
+	configInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "config_info",
+			Help: "Version (hash) of the active configuration, always 1",
+		},
+		[]string{"version", "k8s_id"},
+	)
+
+	ConfigReloads = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "config_reloads_total",
+			Help: "Number of configuration reloads by result: applied, unchanged or rejected",
+		},
+		[]string{"result", "k8s_id"},
+	)
+
+	// Cluster scan results are replaced after every scan
+	ScanObjects = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "scan_objects",
+			Help: "Number of existing objects by result of the last cluster scan",
+		},
+		[]string{"kind", "result", "k8s_id"},
+	)
+
+	ScanViolations = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "scan_violations",
+			Help: "Number of violations by check found in existing objects by the last cluster scan",
+		},
+		[]string{"check", "kind", "k8s_id"},
+	)
+
+	ScanDuration = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "scan_duration_seconds",
+			Help: "Duration of the last cluster scan in seconds",
+		},
+		[]string{"k8s_id"},
+	)
+
+	ScanLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "scan_last_success_timestamp_seconds",
+			Help: "Unix time of the last completed cluster scan",
+		},
+		[]string{"k8s_id"},
+	)
+
+	ScanFailures = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "scan_failures_total",
+			Help: "Number of cluster scans which failed to list objects",
+		},
+		[]string{"k8s_id"},
+	)
+
+	ScanLeader = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "scan_leader",
+			Help: "1 if the replica holds the scan lease and runs the cluster scans",
+		},
+		[]string{"k8s_id"},
+	)
+
+	// Latency histograms are replaced by SetLatencyBuckets, so they are only used under the lock
+	processingTime *HistogramVec
+	checkDuration  *HistogramVec
+	latencyLock    sync.RWMutex
+
+	metricsRegistry prometheus.Registerer
+
+	configVersion atomic.Value // string, changes on reload
 )
 
+// DefaultLatencyBuckets cover admission requests from a millisecond up to the 10s webhook timeout
+var DefaultLatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
 func init() {
 	// Creation of a wrapped registrar for adding a prefix to all the metrics
 	prefixedRegistry := prometheus.WrapRegistererWithPrefix("admission_controller_", customRegistry)
+	metricsRegistry = prefixedRegistry
 
 	// Adding default go collectors via wrapped registrar
 	prefixedRegistry.MustRegister(collectors.NewGoCollector())
@@ -61,9 +221,31 @@ func init() {
 
 	// Adding custom metrics via wrapped registrar
 	prefixedRegistry.MustRegister(TotalRequests)
-	prefixedRegistry.MustRegister(AvgProcessingTime)
-	prefixedRegistry.MustRegister(MaxProcessingTime)
+	prefixedRegistry.MustRegister(TimeoutRequests)
+	prefixedRegistry.MustRegister(InFlightRequests)
+	prefixedRegistry.MustRegister(clickhouseQueueDepth)
+	prefixedRegistry.MustRegister(clickhouseDroppedRows)
+	prefixedRegistry.MustRegister(clickhouseSpoolBytes)
+	prefixedRegistry.MustRegister(clickhouseFlushDuration)
+	prefixedRegistry.MustRegister(auditDroppedEvents)
+	prefixedRegistry.MustRegister(Violations)
+	prefixedRegistry.MustRegister(WouldDeny)
 	prefixedRegistry.MustRegister(certExpiryMetric)
+	prefixedRegistry.MustRegister(certChainExpiryMetric)
+	prefixedRegistry.MustRegister(certExpiryThresholdMetric)
+	prefixedRegistry.MustRegister(certExpiryStateMetric)
+	prefixedRegistry.MustRegister(configInfo)
+	prefixedRegistry.MustRegister(ConfigReloads)
+	prefixedRegistry.MustRegister(ScanObjects)
+	prefixedRegistry.MustRegister(ScanViolations)
+	prefixedRegistry.MustRegister(ScanDuration)
+	prefixedRegistry.MustRegister(ScanLastSuccess)
+	prefixedRegistry.MustRegister(ScanFailures)
+	prefixedRegistry.MustRegister(ScanLeader)
+
+	if err := SetLatencyBuckets(DefaultLatencyBuckets, false); err != nil {
+		panic(err)
+	}
 }
 
 // SetK8SId sets the global K8S_ID value
@@ -76,30 +258,97 @@ func GetK8SId() string {
 	return k8sID
 }
 
+// SetConfigVersion sets the version of the active configuration reported in config_info and audit events
+func SetConfigVersion(version string) {
+	// The new series is set before the previous one is deleted, so a scrape never sees config_info without a version
+	configInfo.WithLabelValues(version, k8sID).Set(1)
+	if previous, _ := configVersion.Swap(version).(string); previous != version {
+		configInfo.DeleteLabelValues(previous, k8sID)
+	}
+}
+
+// GetConfigVersion returns the version of the active configuration
+func GetConfigVersion() string {
+	version, _ := configVersion.Load().(string)
+	return version
+}
+
 // ServeMetrics creates HTTP handler for Prometheus metrics.
 func ServeMetrics() http.Handler {
 	return promhttp.HandlerFor(customRegistry, promhttp.HandlerOpts{})
 }
 
-// UpdateProcessingTimeMetrics updates metrics of avg & max processing time
-func UpdateProcessingTimeMetrics(startTime time.Time, labels prometheus.Labels, status string) {
-	labels["k8s_id"] = k8sID
-	duration := time.Since(startTime).Seconds()
-	AvgProcessingTime.With(labels).Observe(duration)
+// SetLatencyBuckets replaces the latency histograms. With native set they are also exposed as native
+// histograms, which Prometheus scrapes when started with --enable-feature=native-histograms
+func SetLatencyBuckets(buckets []float64, native bool) error {
+	if len(buckets) == 0 {
+		return fmt.Errorf("no latency buckets")
+	}
+	for i, bucket := range buckets {
+		if bucket <= 0 || (i > 0 && bucket <= buckets[i-1]) {
+			return fmt.Errorf("latency buckets must be positive and increasing, got %v", buckets)
+		}
+	}
+	var nativeFactor float64
+	if native {
+		nativeFactor = 1.1
+	}
 
-	labelString := labelsToString(labels)
+	newProcessingTime := newHistogramVec(
+		prometheus.HistogramOpts{
+			Name:                        "processing_time_seconds",
+			Help:                        "Time in seconds to process an admission request",
+			Buckets:                     buckets,
+			NativeHistogramBucketFactor: nativeFactor,
+		},
+		[]string{"operation", "kind", "status", "namespace", "k8s_id"},
+	)
+	newCheckDuration := newHistogramVec(
+		prometheus.HistogramOpts{
+			Name:                        "check_duration_seconds",
+			Help:                        "Time in seconds spent in a single check",
+			Buckets:                     buckets,
+			NativeHistogramBucketFactor: nativeFactor,
+		},
+		[]string{"check", "kind", "k8s_id"},
+	)
 
-	maxTimeLock.Lock()
-	defer maxTimeLock.Unlock()
+	latencyLock.Lock()
+	defer latencyLock.Unlock()
+	if processingTime != nil {
+		metricsRegistry.Unregister(processingTime)
+		metricsRegistry.Unregister(checkDuration)
+	}
+	processingTime, checkDuration = newProcessingTime, newCheckDuration
+	metricsRegistry.MustRegister(processingTime)
+	metricsRegistry.MustRegister(checkDuration)
+	return nil
+}
 
-	currentMax, exists := maxTimeValues[labelString]
-	if !exists || duration > currentMax {
-		maxTimeValues[labelString] = duration
-		MaxProcessingTime.With(labels).Set(duration)
+// ParseLatencyBuckets parses a comma separated list of bucket bounds in seconds
+func ParseLatencyBuckets(value string) ([]float64, error) {
+	var buckets []float64
+	for _, field := range strings.Split(value, ",") {
+		bucket, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid latency bucket %q: %v", field, err)
+		}
+		buckets = append(buckets, bucket)
 	}
+	return buckets, nil
+}
+
+// UpdateProcessingTimeMetrics observes the processing time of an admission request
+func UpdateProcessingTimeMetrics(startTime time.Time, labels prometheus.Labels) {
+	labels["k8s_id"] = k8sID
+	latencyLock.RLock()
+	defer latencyLock.RUnlock()
+	processingTime.With(labels).Observe(time.Since(startTime).Seconds())
 }
 
-// labelsToString converts labels to a string to use as a map key
-func labelsToString(labels prometheus.Labels) string {
-	return fmt.Sprintf("%s_%s_%s_%s_%s", labels["operation"], labels["kind"], labels["status"], labels["namespace"], labels["k8s_id"])
+// ObserveCheckDuration observes the time spent in a single check
+func ObserveCheckDuration(check, kind string, duration time.Duration) {
+	latencyLock.RLock()
+	defer latencyLock.RUnlock()
+	checkDuration.WithLabelValues(check, kind, k8sID).Observe(duration.Seconds())
 }
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v1 "k8s.io/api/admission/v1"
+)
+
+// histogramBuckets returns the bucket bounds of a metric family in the registry
+func histogramBuckets(t *testing.T, name string) []float64 {
+	t.Helper()
+	families, err := customRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name || len(family.GetMetric()) == 0 {
+			continue
+		}
+		var bounds []float64
+		for _, bucket := range family.GetMetric()[0].GetHistogram().GetBucket() {
+			bounds = append(bounds, bucket.GetUpperBound())
+		}
+		return bounds
+	}
+	t.Fatalf("metric %s not found", name)
+	return nil
+}
+
+func TestSetLatencyBuckets(t *testing.T) {
+	t.Cleanup(func() { SetLatencyBuckets(DefaultLatencyBuckets, false) })
+
+	for _, buckets := range [][]float64{nil, {0.1, 0.1}, {-1, 1}} {
+		if err := SetLatencyBuckets(buckets, false); err == nil {
+			t.Errorf("buckets %v were accepted", buckets)
+		}
+	}
+
+	buckets, err := ParseLatencyBuckets("0.01, 0.1,1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetLatencyBuckets(buckets, true); err != nil {
+		t.Fatal(err)
+	}
+	UpdateProcessingTimeMetrics(time.Now(), prometheus.Labels{"operation": "CREATE", "kind": "Deployment", "status": "allowed", "namespace": "team-a"})
+	ObserveCheckDuration("probes", "Deployment", 5*time.Millisecond)
+
+	for _, name := range []string{"admission_controller_processing_time_seconds", "admission_controller_check_duration_seconds"} {
+		if got := histogramBuckets(t, name); len(got) != 3 || got[2] != 1 {
+			t.Errorf("%s buckets = %v, want %v", name, got, buckets)
+		}
+	}
+
+	if _, err := ParseLatencyBuckets("0.1,fast"); err == nil {
+		t.Error("invalid bucket was parsed")
+	}
+}
+
+func TestSetConfigVersion(t *testing.T) {
+	t.Cleanup(func() { SetConfigVersion("") })
+
+	SetConfigVersion("aaa")
+	SetConfigVersion("bbb")
+	if got := testutil.CollectAndCount(configInfo); got != 1 {
+		t.Errorf("got %d config_info series, want only the active version", got)
+	}
+	if got := testutil.ToFloat64(configInfo.WithLabelValues("bbb", k8sID)); got != 1 {
+		t.Errorf("config_info for the active version = %v", got)
+	}
+
+	// Scrapes during a reload see the previous or the new version, never none
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			SetConfigVersion(fmt.Sprintf("v%d", i))
+		}
+		SetConfigVersion("bbb")
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		if got := testutil.CollectAndCount(configInfo); got == 0 {
+			t.Fatal("config_info has no series during a version change")
+		}
+	}
+
+	event := NewAuditEvent(&v1.AdmissionRequest{UID: "test"})
+	if event.ConfigVersion != "bbb" || newClickHouseRow(event).ConfigVersion != "bbb" {
+		t.Errorf("audit event has config version %q", event.ConfigVersion)
+	}
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"sync"
+)
+
+// ReadinessCheck returns an error if the component is not ready to serve admission requests
+type ReadinessCheck func() error
+
+// ComponentStatus is the readiness state of a single component
+type ComponentStatus struct {
+	Name    string `json:"name"`
+	Ready   bool   `json:"ready"`
+	Message string `json:"message,omitempty"`
+}
+
+var (
+	readinessLock   sync.RWMutex
+	readinessNames  []string // Registration order, used for stable output
+	readinessChecks = make(map[string]ReadinessCheck)
+)
+
+// RegisterReadinessCheck adds or replaces a named component check used by /readyz
+func RegisterReadinessCheck(name string, check ReadinessCheck) {
+	readinessLock.Lock()
+	defer readinessLock.Unlock()
+
+	if _, exists := readinessChecks[name]; !exists {
+		readinessNames = append(readinessNames, name)
+	}
+	readinessChecks[name] = check
+}
+
+// CheckReadiness runs all registered checks and returns overall readiness with per-component details
+func CheckReadiness() (bool, []ComponentStatus) {
+	readinessLock.RLock()
+	names := append([]string(nil), readinessNames...)
+	checks := make([]ReadinessCheck, 0, len(names))
+	for _, name := range names {
+		checks = append(checks, readinessChecks[name])
+	}
+	readinessLock.RUnlock()
+
+	ready := true
+	statuses := make([]ComponentStatus, 0, len(names))
+	for i, check := range checks {
+		status := ComponentStatus{Name: names[i], Ready: true}
+		if err := check(); err != nil {
+			ready = false
+			status.Ready = false
+			status.Message = err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	return ready, statuses
+}
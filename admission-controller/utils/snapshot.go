@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+
+	v1 "k8s.io/api/admission/v1"
+)
+
+// Modes of the object snapshot capture
+const (
+	SnapshotOff    = "off"
+	SnapshotDenied = "denied" // Objects of requests which were not allowed, plus a sample of allowed ones
+)
+
+const redactedValue = "[REDACTED]"
+
+// lastAppliedAnnotation holds the whole previous object, including Secret data and env values
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// SnapshotConfig defines which request objects are stored with audit events and what is removed from them
+type SnapshotConfig struct {
+	Mode       string
+	SampleRate float64             // Share of allowed requests captured in the denied mode, 0..1
+	MaxBytes   int                 // Objects larger than this after redaction are not stored
+	Redact     map[string][]string // Kind ("*" for all kinds) -> dot separated paths replaced with [REDACTED]
+}
+
+// defaultRedactions can't be turned off. Env values are redacted in every kind, see redactEnv
+var defaultRedactions = map[string][]string{
+	"Secret": {"data", "stringData"},
+}
+
+var (
+	snapshotLock   sync.RWMutex
+	snapshotConfig = SnapshotConfig{Mode: SnapshotOff}
+)
+
+// SetSnapshotConfig validates and applies the snapshot settings
+func SetSnapshotConfig(cfg SnapshotConfig) error {
+	if cfg.Mode != SnapshotOff && cfg.Mode != SnapshotDenied {
+		return fmt.Errorf("unknown snapshot mode %q, expected %s or %s", cfg.Mode, SnapshotOff, SnapshotDenied)
+	}
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return fmt.Errorf("snapshot sample rate must be between 0 and 1, got %v", cfg.SampleRate)
+	}
+	if cfg.Mode != SnapshotOff && cfg.MaxBytes <= 0 {
+		return fmt.Errorf("snapshot size limit must be positive")
+	}
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+	snapshotConfig = cfg
+	return nil
+}
+
+// ParseRedactionRules parses "Kind:path,path;Kind:path", e.g. "ConfigMap:data,binaryData;*:metadata.labels.owner"
+func ParseRedactionRules(value string) (map[string][]string, error) {
+	rules := make(map[string][]string)
+	for _, rule := range strings.Split(value, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		kind, paths, ok := strings.Cut(rule, ":")
+		kind = strings.TrimSpace(kind)
+		if !ok || kind == "" {
+			return nil, fmt.Errorf("invalid redaction rule %q, expected Kind:path,path", rule)
+		}
+		for _, path := range strings.Split(paths, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				rules[kind] = append(rules[kind], path)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// captureSnapshot attaches redacted copies of the request objects to the event if the configuration asks for it
+func captureSnapshot(event *AuditEvent, r *v1.AdmissionRequest) {
+	snapshotLock.RLock()
+	cfg := snapshotConfig
+	snapshotLock.RUnlock()
+
+	switch {
+	case cfg.Mode == SnapshotOff:
+		return
+	case event.Result == AuditTracked:
+		return
+	case event.Result == AuditAllowed && (cfg.SampleRate == 0 || rand.Float64() >= cfg.SampleRate):
+		return
+	}
+
+	var truncated bool
+	event.Object, truncated = snapshotObject(r.Object.Raw, r.Kind.Kind, cfg)
+	event.SnapshotTruncated = truncated
+	event.OldObject, truncated = snapshotObject(r.OldObject.Raw, r.Kind.Kind, cfg)
+	event.SnapshotTruncated = event.SnapshotTruncated || truncated
+}
+
+// snapshotObject returns the redacted object, or nothing and true if it doesn't fit into the size limit
+func snapshotObject(raw []byte, kind string, cfg SnapshotConfig) (json.RawMessage, bool) {
+	if len(raw) == 0 {
+		return nil, false
+	}
+	redacted, err := redactObject(raw, kind, cfg.Redact)
+	if err != nil {
+		// Never store what couldn't be redacted
+		Log.Warnf("Failed to redact %s snapshot: %v", kind, err)
+		return nil, true
+	}
+	if len(redacted) > cfg.MaxBytes {
+		return nil, true
+	}
+	return redacted, false
+}
+
+// redactObject removes managed fields, the last applied configuration, env values and the configured paths
+func redactObject(raw []byte, kind string, rules map[string][]string) ([]byte, error) {
+	var object map[string]interface{}
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, err
+	}
+
+	if metadata, ok := object["metadata"].(map[string]interface{}); ok {
+		delete(metadata, "managedFields")
+		if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+			if _, ok := annotations[lastAppliedAnnotation]; ok {
+				annotations[lastAppliedAnnotation] = redactedValue
+			}
+		}
+	}
+	redactEnv(object)
+
+	var paths []string
+	paths = append(paths, defaultRedactions[kind]...)
+	paths = append(paths, rules[kind]...)
+	paths = append(paths, rules["*"]...)
+	for _, path := range paths {
+		redactPath(object, strings.Split(path, "."))
+	}
+	return json.Marshal(object)
+}
+
+// redactEnv replaces the value of every env entry, wherever containers are in the object
+func redactEnv(node interface{}) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if env, ok := child.([]interface{}); ok && key == "env" {
+				for _, entry := range env {
+					if variable, ok := entry.(map[string]interface{}); ok {
+						if _, ok := variable["value"]; ok {
+							variable["value"] = redactedValue
+						}
+					}
+				}
+				continue
+			}
+			redactEnv(child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			redactEnv(child)
+		}
+	}
+}
+
+// redactPath replaces values at the path. "*" matches any key, lists are walked element by element
+func redactPath(node interface{}, path []string) {
+	switch v := node.(type) {
+	case []interface{}:
+		for _, child := range v {
+			redactPath(child, path)
+		}
+	case map[string]interface{}:
+		for key, child := range v {
+			if key != path[0] && path[0] != "*" {
+				continue
+			}
+			if len(path) == 1 {
+				v[key] = redactedValue
+			} else {
+				redactPath(child, path[1:])
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const secretObject = `{
+  "kind": "Secret",
+  "metadata": {
+    "name": "db",
+    "annotations": {"kubectl.kubernetes.io/last-applied-configuration": "{\"data\":{\"password\":\"aHVudGVyMg==\"}}"},
+    "managedFields": [{"manager": "kubectl"}]
+  },
+  "data": {"password": "aHVudGVyMg=="},
+  "stringData": {"token": "plain"}
+}`
+
+const deploymentObject = `{
+  "kind": "Deployment",
+  "metadata": {"name": "web", "labels": {"owner": "alice"}},
+  "spec": {"template": {"spec": {
+    "initContainers": [{"name": "init", "env": [{"name": "A", "value": "secret-a"}]}],
+    "containers": [{"name": "app", "args": ["--token=secret-b"], "env": [
+      {"name": "B", "value": "secret-c"},
+      {"name": "C", "valueFrom": {"secretKeyRef": {"name": "db", "key": "password"}}}
+    ]}]
+  }}}
+}`
+
+func withSnapshotConfig(t *testing.T, cfg SnapshotConfig) {
+	t.Helper()
+	if err := SetSnapshotConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetSnapshotConfig(SnapshotConfig{Mode: SnapshotOff}) })
+}
+
+func snapshotRequest(kind, object string) *v1.AdmissionRequest {
+	return &v1.AdmissionRequest{
+		UID:       "uid",
+		Kind:      metav1.GroupVersionKind{Kind: kind},
+		Operation: v1.Create,
+		Object:    runtime.RawExtension{Raw: []byte(object)},
+	}
+}
+
+func TestSnapshotRedactsSecretsAndEnv(t *testing.T) {
+	rules, err := ParseRedactionRules("Deployment:spec.template.spec.containers.args; *:metadata.labels.owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSnapshotConfig(t, SnapshotConfig{Mode: SnapshotDenied, MaxBytes: 64 << 10, Redact: rules})
+
+	for kind, object := range map[string]string{"Secret": secretObject, "Deployment": deploymentObject} {
+		event := NewAuditEvent(snapshotRequest(kind, object))
+		event.Result = AuditDenied
+		captureSnapshot(&event, event.request)
+
+		if len(event.Object) == 0 || event.SnapshotTruncated {
+			t.Fatalf("%s: object was not captured", kind)
+		}
+		for _, leaked := range []string{"aHVudGVyMg==", "plain", "secret-a", "secret-b", "secret-c", "alice", "managedFields"} {
+			if strings.Contains(string(event.Object), leaked) {
+				t.Errorf("%s snapshot contains %q: %s", kind, leaked, event.Object)
+			}
+		}
+		if !json.Valid(event.Object) {
+			t.Errorf("%s snapshot is not valid JSON", kind)
+		}
+	}
+}
+
+func TestSnapshotSelection(t *testing.T) {
+	withSnapshotConfig(t, SnapshotConfig{Mode: SnapshotDenied, MaxBytes: 64 << 10})
+	for result, captured := range map[string]bool{
+		AuditDenied:  true,
+		AuditTimeout: true,
+		AuditAllowed: false, // Sample rate is 0
+		AuditTracked: false,
+	} {
+		event := NewAuditEvent(snapshotRequest("Deployment", deploymentObject))
+		event.Result = result
+		captureSnapshot(&event, event.request)
+		if (len(event.Object) > 0) != captured {
+			t.Errorf("%s: captured = %t, want %t", result, len(event.Object) > 0, captured)
+		}
+	}
+
+	withSnapshotConfig(t, SnapshotConfig{Mode: SnapshotDenied, MaxBytes: 64})
+	event := NewAuditEvent(snapshotRequest("Deployment", deploymentObject))
+	event.Result = AuditDenied
+	captureSnapshot(&event, event.request)
+	if len(event.Object) != 0 || !event.SnapshotTruncated {
+		t.Errorf("object over the size limit was stored: %s", event.Object)
+	}
+}
+
+func TestParseRedactionRulesRejectsMissingKind(t *testing.T) {
+	if _, err := ParseRedactionRules("data,binaryData"); err == nil {
+		t.Error("rule without a kind was accepted")
+	}
+}
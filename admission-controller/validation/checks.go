@@ -2,51 +2,39 @@ package validation
 
 import (
 	"admissioncontroller/utils"
+	"context"
 	"encoding/json"
-	"os"
+	"fmt"
 	"regexp"
-	"strconv"
+	"time"
 
 	"admissioncontroller"
 
-	log "github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
-var (
-	observerMode bool
-	k8sID        string
-)
+// ValidatedKinds are the kinds the hook has checks for, other kinds are denied as unhandled.
+// The webhook rules in the chart select the same kinds
+var ValidatedKinds = []string{"Deployment", "StatefulSet", "Service"}
 
-func init() {
-	k8sID = utils.GetK8SId() //TODO Doesn't work, look below
-	observerModeValue := getEnv("OBSERVER_MODE", "false")
-	var err error
-	observerMode, err = strconv.ParseBool(observerModeValue)
-	if err != nil {
-		observerMode = false
-		utils.ErrorLog("Error parsing OBSERVER_MODE value: %s", err)
-	}
-	if observerMode {
-		utils.InfoLog("Observer mode is activated. All requests will be allowed without enforcement.") // This record does not contain k8s_id. Not a huge problem since
-	} // Not a huge problem since all the requests have observer_mode: true|false indicator
-}
-
-func getEnv(key, defaultValue string) string {
-	value, exists := os.LookupEnv(key)
-	if !exists {
-		return defaultValue
+// Validates reports whether the hook has checks for the kind
+func Validates(kind string) bool {
+	for _, k := range ValidatedKinds {
+		if k == kind {
+			return true
+		}
 	}
-	return value
+	return false
 }
 
-// NewValidationHook creates a new instance of deployment validation hook
-func NewValidationHook() admissioncontroller.Hook {
+// NewValidationHook creates a new instance of deployment validation hook.
+// While isObserver returns true violations are logged and counted, but requests are allowed
+func NewValidationHook(isObserver func() bool) admissioncontroller.Hook {
 	return admissioncontroller.Hook{
-		Create: validateCreate(),
-		Update: validateUpdate(),
+		Create: validateCreate(isObserver),
+		Update: validateUpdate(isObserver),
 	}
 }
 
@@ -59,87 +47,164 @@ func parseObject(object []byte) (runtime.Object, error) {
 	return obj, nil
 }
 
-func hasProbes(spec corev1.PodSpec, logFields log.Fields) bool {
-	for _, container := range spec.Containers {
+// podTemplatePath is the pod spec of Deployments and StatefulSets
+const podTemplatePath = "spec.template.spec"
+
+// IDs of the checks, used in violations, metrics and audit events
+const (
+	CheckProbes          = "probes"
+	CheckImageLatest     = "image-latest"
+	CheckImagePullPolicy = "image-pull-policy"
+	CheckRunAsRoot       = "run-as-root"
+	CheckServiceNodePort = "service-nodeport"
+)
+
+// podCheck is a check of the pod template of a workload
+type podCheck struct {
+	id  string
+	run func(spec corev1.PodSpec, specPath string) []admissioncontroller.Violation
+}
+
+var (
+	probesCheck          = podCheck{CheckProbes, hasProbes}
+	imageLatestCheck     = podCheck{CheckImageLatest, checkImageLatest}
+	imagePullPolicyCheck = podCheck{CheckImagePullPolicy, checkImagePullPolicy}
+	runAsUserCheck       = podCheck{CheckRunAsRoot, hasValidRunAsUser}
+)
+
+// runPodChecks runs the checks in order and observes the duration of each of them. It also returns
+// the IDs of the checks, so passed ones can be reported. It stops with the error of the context once it is done
+func runPodChecks(ctx context.Context, kind string, spec corev1.PodSpec, checks ...podCheck) (violations []admissioncontroller.Violation, ran []string, err error) {
+	for _, check := range checks {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		start := time.Now()
+		violations = append(violations, check.run(spec, podTemplatePath)...)
+		utils.ObserveCheckDuration(check.id, kind, time.Since(start))
+		ran = append(ran, check.id)
+	}
+	return violations, ran, nil
+}
+
+func containerPath(specPath string, index int) string {
+	return fmt.Sprintf("%s.containers[%d]", specPath, index)
+}
+
+func hasProbes(spec corev1.PodSpec, specPath string) []admissioncontroller.Violation {
+	var violations []admissioncontroller.Violation
+	for i, container := range spec.Containers {
 		if container.ReadinessProbe == nil && container.LivenessProbe == nil && container.StartupProbe == nil {
-			utils.Log.WithFields(logFields).Errorf("Container %s doesn't have probes set", container.Name)
-			if !observerMode {
-				return false
-			}
+			violations = append(violations, admissioncontroller.Violation{
+				CheckID:     CheckProbes,
+				Severity:    admissioncontroller.SeverityError,
+				Container:   container.Name,
+				FieldPath:   containerPath(specPath, i),
+				Message:     fmt.Sprintf("Container %s doesn't have probes set", container.Name),
+				Remediation: "add a readinessProbe, livenessProbe or startupProbe",
+			})
 		}
 	}
-	return true
+	return violations
 }
 
-func checkImageLatest(spec corev1.PodSpec, logFields log.Fields) bool {
+func checkImageLatest(spec corev1.PodSpec, specPath string) []admissioncontroller.Violation {
 	pattern := regexp.MustCompile(`:latest$`)
-	for _, container := range spec.Containers {
+	var violations []admissioncontroller.Violation
+	for i, container := range spec.Containers {
 		if pattern.MatchString(container.Image) {
-			utils.Log.WithFields(logFields).Errorf("Container %s is created with the following image: %s. `latest` tags are restricted. Please use specific image versions", container.Name, container.Image)
-			if !observerMode {
-				return false
-			}
+			violations = append(violations, admissioncontroller.Violation{
+				CheckID:     CheckImageLatest,
+				Severity:    admissioncontroller.SeverityError,
+				Container:   container.Name,
+				FieldPath:   containerPath(specPath, i) + ".image",
+				Message:     fmt.Sprintf("Container %s uses image %s with the `latest` tag", container.Name, container.Image),
+				Remediation: "use a specific image version",
+			})
 		}
 	}
-	return true
+	return violations
 }
 
-func checkImagePullPolicy(spec corev1.PodSpec, logFields log.Fields) bool {
+func checkImagePullPolicy(spec corev1.PodSpec, specPath string) []admissioncontroller.Violation {
 	restrictedImagePolicies := regexp.MustCompile(`Always`)
-	for _, container := range spec.Containers {
+	var violations []admissioncontroller.Violation
+	for i, container := range spec.Containers {
 		if restrictedImagePolicies.MatchString(string(container.ImagePullPolicy)) {
-			utils.Log.WithFields(logFields).Errorf("Container %s uses forbidden imagePullPolicy `%s`", container.Name, container.ImagePullPolicy)
-			if !observerMode {
-				return false
-			}
+			violations = append(violations, admissioncontroller.Violation{
+				CheckID:     CheckImagePullPolicy,
+				Severity:    admissioncontroller.SeverityError,
+				Container:   container.Name,
+				FieldPath:   containerPath(specPath, i) + ".imagePullPolicy",
+				Message:     fmt.Sprintf("Container %s uses forbidden imagePullPolicy `%s`", container.Name, container.ImagePullPolicy),
+				Remediation: "use imagePullPolicy IfNotPresent",
+			})
 		}
 	}
-	return true
+	return violations
 }
 
-func hasValidRunAsUser(spec corev1.PodSpec, logFields log.Fields) bool {
+func hasValidRunAsUser(spec corev1.PodSpec, specPath string) []admissioncontroller.Violation {
+	const remediation = "set runAsUser to a non-zero UID"
+	var violations []admissioncontroller.Violation
+	podRunsAsRoot := spec.SecurityContext != nil && spec.SecurityContext.RunAsUser != nil && *spec.SecurityContext.RunAsUser == 0
+
 	// Check runAsUser on pod level
-	if spec.SecurityContext != nil && spec.SecurityContext.RunAsUser != nil && *spec.SecurityContext.RunAsUser == 0 {
-		utils.Log.WithFields(logFields).Error("Pod securityContext has runAsUser set to 0")
-		if !observerMode {
-			return false
-		}
+	if podRunsAsRoot {
+		violations = append(violations, admissioncontroller.Violation{
+			CheckID:     CheckRunAsRoot,
+			Severity:    admissioncontroller.SeverityError,
+			FieldPath:   specPath + ".securityContext.runAsUser",
+			Message:     "Pod securityContext has runAsUser set to 0",
+			Remediation: remediation,
+		})
 	}
 
 	// Check runAsUser on container level
-	for _, container := range spec.Containers {
+	for i, container := range spec.Containers {
 		if container.SecurityContext != nil && container.SecurityContext.RunAsUser != nil {
 			if *container.SecurityContext.RunAsUser == 0 {
-				utils.Log.WithFields(logFields).Errorf("Container %s has runAsUser set to 0", container.Name)
-				if !observerMode {
-					return false
-				}
-			}
-		} else if spec.SecurityContext != nil && spec.SecurityContext.RunAsUser != nil && *spec.SecurityContext.RunAsUser == 0 {
-			// Check on container level if pod level is set
-			utils.Log.WithFields(logFields).Errorf("Container %s inherits pod's runAsUser set to 0", container.Name)
-			if !observerMode {
-				return false
+				violations = append(violations, admissioncontroller.Violation{
+					CheckID:     CheckRunAsRoot,
+					Severity:    admissioncontroller.SeverityError,
+					Container:   container.Name,
+					FieldPath:   containerPath(specPath, i) + ".securityContext.runAsUser",
+					Message:     fmt.Sprintf("Container %s has runAsUser set to 0", container.Name),
+					Remediation: remediation,
+				})
 			}
+		} else if podRunsAsRoot {
+			// Container inherits the pod level setting
+			violations = append(violations, admissioncontroller.Violation{
+				CheckID:     CheckRunAsRoot,
+				Severity:    admissioncontroller.SeverityError,
+				Container:   container.Name,
+				FieldPath:   containerPath(specPath, i) + ".securityContext.runAsUser",
+				Message:     fmt.Sprintf("Container %s inherits pod's runAsUser set to 0", container.Name),
+				Remediation: remediation,
+			})
 		}
 	}
-	return true
+	return violations
 }
 
-func checkServiceType(service *corev1.Service, logFields log.Fields) (bool, error) {
+func checkServiceType(service *corev1.Service) ([]admissioncontroller.Violation, error) {
 	if service.Spec.Type == corev1.ServiceTypeNodePort {
-		utils.Log.WithFields(logFields).Errorf("Service %s is of type NodePort, which is restricted", service.Name) //TODO change loglevel to warning. complication - need warnings to be sent to clickhouse. Done in logging.go
-		if !observerMode {
-			return false, nil
-		}
+		return []admissioncontroller.Violation{{
+			CheckID:     CheckServiceNodePort,
+			Severity:    admissioncontroller.SeverityError,
+			FieldPath:   "spec.type",
+			Message:     fmt.Sprintf("Service %s is of a type NodePort, which is restricted", service.Name),
+			Remediation: "use ClusterIP or LoadBalancer, or expose the service with an Ingress",
+		}}, nil
 	}
-	return true, nil
+	return nil, nil
 }
 
-// func checkServiceAnnotations(service *corev1.Service) (bool, error) {
+// func checkServiceAnnotations(service *corev1.Service) ([]admissioncontroller.Violation, error) {
 // 	// Например, проверяем наличие определенной аннотации
 // 	if value, ok := service.Annotations["example.io/required-annotation"]; !ok || value != "true" {
-// 		return false, fmt.Errorf("required annotation is missing or incorrect")
+// 		return nil, fmt.Errorf("required annotation is missing or incorrect")
 // 	}
-// 	return true, nil
+// 	return nil, nil
 // }
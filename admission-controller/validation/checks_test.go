@@ -0,0 +1,85 @@
+package validation
+
+import (
+	"testing"
+
+	"admissioncontroller"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestChecksReturnViolationPerContainer(t *testing.T) {
+	root := int64(0)
+	spec := corev1.PodSpec{
+		SecurityContext: &corev1.PodSecurityContext{RunAsUser: &root},
+		Containers: []corev1.Container{
+			{Name: "app", Image: "app:1.2", ReadinessProbe: &corev1.Probe{}},
+			{Name: "sidecar", Image: "proxy:latest", ImagePullPolicy: corev1.PullAlways},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		check func(corev1.PodSpec, string) []admissioncontroller.Violation
+		want  []admissioncontroller.Violation
+	}{
+		{"probes", hasProbes, []admissioncontroller.Violation{
+			{CheckID: CheckProbes, Container: "sidecar", FieldPath: "spec.template.spec.containers[1]"},
+		}},
+		{"latest", checkImageLatest, []admissioncontroller.Violation{
+			{CheckID: CheckImageLatest, Container: "sidecar", FieldPath: "spec.template.spec.containers[1].image"},
+		}},
+		{"pull policy", checkImagePullPolicy, []admissioncontroller.Violation{
+			{CheckID: CheckImagePullPolicy, Container: "sidecar", FieldPath: "spec.template.spec.containers[1].imagePullPolicy"},
+		}},
+		{"run as root", hasValidRunAsUser, []admissioncontroller.Violation{
+			{CheckID: CheckRunAsRoot, FieldPath: "spec.template.spec.securityContext.runAsUser"},
+			{CheckID: CheckRunAsRoot, Container: "app", FieldPath: "spec.template.spec.containers[0].securityContext.runAsUser"},
+			{CheckID: CheckRunAsRoot, Container: "sidecar", FieldPath: "spec.template.spec.containers[1].securityContext.runAsUser"},
+		}},
+	}
+	for _, tt := range tests {
+		got := tt.check(spec, podTemplatePath)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %d violations, want %d: %+v", tt.name, len(got), len(tt.want), got)
+			continue
+		}
+		for i, v := range got {
+			want := tt.want[i]
+			if v.CheckID != want.CheckID || v.Container != want.Container || v.FieldPath != want.FieldPath {
+				t.Errorf("%s: violation %d = %+v, want %+v", tt.name, i, v, want)
+			}
+			if v.Severity != admissioncontroller.SeverityError || v.Message == "" || v.Remediation == "" {
+				t.Errorf("%s: violation %d is incomplete: %+v", tt.name, i, v)
+			}
+		}
+	}
+}
+
+func TestCheckServiceType(t *testing.T) {
+	service := &corev1.Service{Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeNodePort}}
+	service.Name = "web"
+	violations, err := checkServiceType(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 1 || violations[0].CheckID != CheckServiceNodePort || violations[0].FieldPath != "spec.type" {
+		t.Errorf("got %+v", violations)
+	}
+
+	service.Spec.Type = corev1.ServiceTypeClusterIP
+	if violations, _ := checkServiceType(service); len(violations) != 0 {
+		t.Errorf("ClusterIP service got %+v", violations)
+	}
+}
+
+func TestFormatViolations(t *testing.T) {
+	got := admissioncontroller.FormatViolations([]admissioncontroller.Violation{
+		{Message: "Container app doesn't have probes set", Remediation: "add a probe"},
+		{Message: "Service web is of a type NodePort"},
+	})
+	want := "\n- Container app doesn't have probes set (add a probe);\n- Service web is of a type NodePort"
+	if got != want {
+		t.Errorf("FormatViolations() = %q, want %q", got, want)
+	}
+}
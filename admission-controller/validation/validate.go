@@ -2,9 +2,10 @@ package validation
 
 import (
 	"admissioncontroller"
+	"context"
 
 	"admissioncontroller/utils"
-	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,14 +20,23 @@ import (
 	corev1 "k8s.io/api/core/v1"
 )
 
-func updateTimeMetrics(startTime time.Time, r *v1.AdmissionRequest, status string) {
+// simulated reports evaluations which don't come from the API server: cluster scans and dry runs
+func simulated(ctx context.Context, r *v1.AdmissionRequest) bool {
+	requestType := utils.RequestType(ctx, r)
+	return requestType == utils.RequestTypeAudit || requestType == utils.RequestTypeDryRun
+}
+
+func updateTimeMetrics(ctx context.Context, startTime time.Time, r *v1.AdmissionRequest, status string) {
+	if simulated(ctx, r) || ctx.Err() != nil { // Timed out requests are counted by the HTTP handler
+		return
+	}
 	labels := prometheus.Labels{
 		"operation": string(r.Operation),
 		"kind":      r.Kind.Kind,
 		"status":    status,
 		"namespace": r.Namespace,
 	}
-	utils.UpdateProcessingTimeMetrics(startTime, labels, status)
+	utils.UpdateProcessingTimeMetrics(startTime, labels)
 }
 
 // Parallel processing with goroutines take twice as much time on local cluster and basically the same time on remote one. Maybe will be useful later though.
@@ -85,32 +95,143 @@ func updateTimeMetrics(startTime time.Time, r *v1.AdmissionRequest, status strin
 //	return errorMessages
 //}
 
-func validateCreate() admissioncontroller.AdmitFunc {
-	return func(r *v1.AdmissionRequest) (*admissioncontroller.Result, error) {
+// joinViolations returns the violation messages as a single admission_reason string
+func joinViolations(violations []admissioncontroller.Violation) string {
+	messages := make([]string, 0, len(violations))
+	for _, v := range violations {
+		messages = append(messages, v.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// logViolations logs every violation, also in observer mode
+func logViolations(ctx context.Context, logFields log.Fields, violations []admissioncontroller.Violation) {
+	for _, v := range violations {
+		utils.Log.WithContext(ctx).WithFields(logFields).WithFields(log.Fields{
+			"check_id":   v.CheckID,
+			"field_path": v.FieldPath,
+		}).Error(v.Message)
+	}
+}
+
+// countViolations updates the per-check and would-deny counters. It runs before the observer mode
+// drops the violations, so the counters show what enforcement would block
+func countViolations(r *v1.AdmissionRequest, observerMode bool, violations []admissioncontroller.Violation) {
+	observer := strconv.FormatBool(observerMode)
+	for _, v := range violations {
+		utils.Violations.WithLabelValues(v.CheckID, v.Severity, r.Namespace, r.Kind.Kind, string(r.Operation), observer, utils.GetK8SId()).Inc()
+	}
+	if len(violations) > 0 {
+		utils.WouldDeny.WithLabelValues(r.Namespace, r.Kind.Kind, string(r.Operation), observer, utils.GetK8SId()).Inc()
+	}
+}
+
+// decide makes the admission decision for the collected violations. It is the only place where the observer
+// mode is applied: violations are always logged, counted and returned, in observer mode the request is allowed anyway
+func decide(ctx context.Context, r *v1.AdmissionRequest, observerMode bool, startTime time.Time, logFields log.Fields, checks []string, violations []admissioncontroller.Violation) *admissioncontroller.Result {
+	logViolations(ctx, logFields, violations)
+	if !simulated(ctx, r) && ctx.Err() == nil { // Cluster scans report existing objects with their own metrics, dry runs are not counted
+		countViolations(r, observerMode, violations)
+	}
+
+	entry := utils.Log.WithContext(ctx).WithFields(logFields).WithFields(log.Fields{
+		"processing_time": time.Since(startTime).String(),
+		"observer_mode":   observerMode,
+	})
+	switch {
+	case len(violations) == 0:
+		updateTimeMetrics(ctx, startTime, r, utils.AuditAllowed)
+		entry.WithFields(log.Fields{
+			"admission_result": utils.AuditAllowed,
+			"admission_reason": "all checks passed",
+		}).Info("Admission allowed")
+		return &admissioncontroller.Result{Allowed: true, Checks: checks}
+
+	case observerMode:
+		updateTimeMetrics(ctx, startTime, r, utils.AuditAllowedObserver)
+		entry.WithFields(log.Fields{
+			"admission_result": utils.AuditAllowedObserver,
+			"admission_reason": joinViolations(violations),
+		}).Warn("Admission allowed in observer mode")
+		return &admissioncontroller.Result{Allowed: true, Checks: checks, Violations: violations}
+
+	default:
+		updateTimeMetrics(ctx, startTime, r, utils.AuditDenied)
+		entry.WithFields(log.Fields{
+			"admission_result": utils.AuditDenied,
+			"admission_reason": joinViolations(violations),
+		}).Error("Admission denied")
+		return &admissioncontroller.Result{
+			Msg:        admissioncontroller.FormatViolations(violations),
+			Allowed:    false,
+			Checks:     checks,
+			Violations: violations,
+		}
+	}
+}
+
+// auditDecision emits the audit event for the decision of an admit function. Requests which ran out
+// of their time budget are reported by the HTTP handler, it makes the final decision for them. Dry runs are not audited
+func auditDecision(ctx context.Context, r *v1.AdmissionRequest, observerMode bool, startTime time.Time, result *admissioncontroller.Result, err error) {
+	if ctx.Err() != nil || utils.RequestType(ctx, r) == utils.RequestTypeDryRun || !utils.ClaimAudit(ctx) {
+		return
+	}
+	event := utils.NewAuditEvent(r)
+	event.RequestType = utils.RequestType(ctx, r)
+	event.ProcessingTime = time.Since(startTime)
+	event.ObserverMode = observerMode
+	switch {
+	case err != nil || result == nil:
+		event.Result = utils.AuditError
+		if err != nil {
+			event.Reason = err.Error()
+		}
+	case result.Allowed && len(result.Violations) > 0:
+		event.Result, event.Reason = utils.AuditAllowedObserver, joinViolations(result.Violations)
+		event.Violations = result.Violations
+	case result.Allowed:
+		event.Result, event.Reason = utils.AuditAllowed, "all checks passed"
+	case len(result.Violations) > 0:
+		event.Result, event.Reason = utils.AuditDenied, joinViolations(result.Violations)
+		event.Violations = result.Violations
+	default:
+		event.Result, event.Reason = utils.AuditDenied, result.Msg
+	}
+	utils.EmitAudit(event)
+}
+
+func validateCreate(isObserver func() bool) admissioncontroller.AdmitFunc {
+	return func(ctx context.Context, r *v1.AdmissionRequest) (result *admissioncontroller.Result, err error) {
+		observerMode := isObserver() // Read once, a reload must not change the mode in the middle of a request
 		var username string
 		if usernames, ok := r.UserInfo.Extra["username"]; ok && len(usernames) > 0 {
 			username = usernames[0]
 		}
 		startTime := time.Now()
+		var violations []admissioncontroller.Violation
+		var checks []string // IDs of the checks which ran
+		defer func() {
+			auditDecision(ctx, r, observerMode, startTime, result, err)
+		}()
 		logFields := log.Fields{
 			"k8s_id":           utils.GetK8SId(),
 			"user_id":          r.UserInfo.Username,
 			"user_name":        username,
 			"user_groups":      r.UserInfo.Groups,
 			"request_id":       string(r.UID),
-			"request_type":     "create",
+			"request_type":     utils.RequestType(ctx, r),
 			"target_namespace": r.Namespace,
 			"target_kind":      r.Kind.Kind,
 			"target_name":      r.Name,
 		}
 
-		utils.Log.WithFields(log.Fields{
+		utils.Log.WithContext(ctx).WithFields(log.Fields{
 			"k8s_id":           utils.GetK8SId(),
 			"user_id":          r.UserInfo.Username,
 			"user_name":        username,
 			"user_groups":      r.UserInfo.Groups,
 			"request_id":       string(r.UID),
-			"request_type":     "create",
+			"request_type":     utils.RequestType(ctx, r),
 			"target_namespace": r.Namespace,
 			"target_kind":      r.Kind.Kind,
 			"target_name":      r.Name,
@@ -132,8 +253,11 @@ func validateCreate() admissioncontroller.AdmitFunc {
 			return &admissioncontroller.Result{Msg: "Internal error: object type assertion failed", Allowed: false}, nil
 		}
 
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		kind := unstructuredObj.GetKind()
-		errorMessages := []string{}
 
 		switch kind {
 		case "Deployment":
@@ -144,15 +268,9 @@ func validateCreate() admissioncontroller.AdmitFunc {
 				return &admissioncontroller.Result{Msg: "Failed to convert object to deployment", Allowed: false}, nil
 			}
 			utils.DebugLog("Processing a Deployment named %s", deployment.ObjectMeta.Name)
-			if !hasProbes(deployment.Spec.Template.Spec, logFields) {
-				errorMessages = append(errorMessages, fmt.Sprintf("At least one container of Deployment %s does not have required probes", deployment.ObjectMeta.Name))
-			}
-			if !checkImageLatest(deployment.Spec.Template.Spec, logFields) {
-				errorMessages = append(errorMessages, fmt.Sprintf("At least one container of Deployment %s uses tag `Latest`", deployment.ObjectMeta.Name))
-			}
-
-			if !checkImagePullPolicy(deployment.Spec.Template.Spec, logFields) {
-				errorMessages = append(errorMessages, fmt.Sprintf("At least one container of Deployment %s uses imagePullPolicy `Always`", deployment.ObjectMeta.Name))
+			violations, checks, err = runPodChecks(ctx, "Deployment", deployment.Spec.Template.Spec, probesCheck, imageLatestCheck, imagePullPolicyCheck)
+			if err != nil {
+				return nil, err
 			}
 
 		case "StatefulSet":
@@ -163,18 +281,9 @@ func validateCreate() admissioncontroller.AdmitFunc {
 				return &admissioncontroller.Result{Msg: "Failed to convert object to statefulSet", Allowed: false}, nil
 			}
 			utils.DebugLog("Processing a StatefulSet named %s", statefulSet.ObjectMeta.Name)
-			if !hasProbes(statefulSet.Spec.Template.Spec, logFields) {
-				errorMessages = append(errorMessages, fmt.Sprintf("At least one container of StatefulSet %s does not have required probes", statefulSet.ObjectMeta.Name))
-			}
-			if !checkImageLatest(statefulSet.Spec.Template.Spec, logFields) {
-				errorMessages = append(errorMessages, fmt.Sprintf("At least one container of StatefulSet %s uses tag `Latest`", statefulSet.ObjectMeta.Name))
-			}
-
-			if !checkImagePullPolicy(statefulSet.Spec.Template.Spec, logFields) {
-				errorMessages = append(errorMessages, fmt.Sprintf("At least one container of StatefulSet %s uses imagePullPolicy `Always`", statefulSet.ObjectMeta.Name))
-			}
-			if !hasValidRunAsUser(statefulSet.Spec.Template.Spec, logFields) {
-				errorMessages = append(errorMessages, fmt.Sprintf("At least one container of StatefulSet %s has its RunAsUser set to 0. This is forbidden", statefulSet.ObjectMeta.Name))
+			violations, checks, err = runPodChecks(ctx, "StatefulSet", statefulSet.Spec.Template.Spec, probesCheck, imageLatestCheck, imagePullPolicyCheck, runAsUserCheck)
+			if err != nil {
+				return nil, err
 			}
 
 		case "Service":
@@ -184,82 +293,42 @@ func validateCreate() admissioncontroller.AdmitFunc {
 				utils.ErrorLog("Error converting unstructured to service: %s", err)
 				return &admissioncontroller.Result{Msg: "Failed to convert object to service", Allowed: false}, nil
 			}
-			allowed, err := checkServiceType(service, logFields) // example for function which returns bool and err. For a standardized way of adding new ones
+			checkStart := time.Now()
+			serviceViolations, err := checkServiceType(service) // example for function which returns violations and err. For a standardized way of adding new ones
+			utils.ObserveCheckDuration(CheckServiceNodePort, kind, time.Since(checkStart))
 			if err != nil {
 				return nil, err
 			}
-			if !allowed {
-				errorMessages = append(errorMessages, fmt.Sprintf("Service %s is of a type NodePort, which is restricted", service.ObjectMeta.Name))
-			}
+			violations, checks = append(violations, serviceViolations...), []string{CheckServiceNodePort}
 
 			// Example
-			// allowed, err = checkServiceAnnotations(service)
+			// serviceViolations, err = checkServiceAnnotations(service)
 			// if err != nil {
 			// 	return nil, err
 			// }
-			// if !allowed {
-			// 	errorMessages = append(errorMessages, fmt.Sprintf("Service %s does not meet the required annotations", service.ObjectMeta.Name))
-			// }
+			// violations = append(violations, serviceViolations...)
 
 		default:
 			utils.ErrorLog("Unhandled or unknown resource type: %s", kind)
 			return &admissioncontroller.Result{Msg: "Unhandled resource type", Allowed: false}, nil
 		}
-		elapsedTime := time.Since(startTime)
-
-		if len(errorMessages) > 0 {
-			formattedMessages := "- " + strings.Join(errorMessages, ";\n- ")
-
-			updateTimeMetrics(startTime, r, "denied")
-
-			utils.Log.WithFields(log.Fields{
-				"k8s_id":           utils.GetK8SId(),
-				"user_id":          r.UserInfo.Username,
-				"user_name":        username,
-				"user_groups":      r.UserInfo.Groups,
-				"request_id":       string(r.UID),
-				"request_type":     "create",
-				"target_namespace": r.Namespace,
-				"target_kind":      r.Kind.Kind,
-				"target_name":      r.Name,
-				"admission_result": "denied",
-				"admission_reason": strings.Join(errorMessages, "; "),
-				"processing_time":  elapsedTime.String(),
-				"observer_mode":    observerMode,
-			}).Error("Admission denied")
-			return &admissioncontroller.Result{
-				Msg:     "\n" + formattedMessages,
-				Allowed: false,
-			}, nil
-		}
-		updateTimeMetrics(startTime, r, "allowed")
-		utils.Log.WithFields(log.Fields{
-			"k8s_id":           utils.GetK8SId(),
-			"user_id":          r.UserInfo.Username,
-			"user_name":        username,
-			"user_groups":      r.UserInfo.Groups,
-			"request_id":       string(r.UID),
-			"request_type":     "create",
-			"target_namespace": r.Namespace,
-			"target_kind":      r.Kind.Kind,
-			"target_name":      r.Name,
-			"admission_result": "allowed",
-			"admission_reason": "all checks passed or observer mode is on",
-			"processing_time":  elapsedTime.String(),
-			"observer_mode":    observerMode,
-		}).Info("Admission allowed")
-
-		return &admissioncontroller.Result{Allowed: true}, nil
+		return decide(ctx, r, observerMode, startTime, logFields, checks, violations), nil
 	}
 }
 
-func validateUpdate() admissioncontroller.AdmitFunc {
-	return func(r *v1.AdmissionRequest) (*admissioncontroller.Result, error) {
+func validateUpdate(isObserver func() bool) admissioncontroller.AdmitFunc {
+	return func(ctx context.Context, r *v1.AdmissionRequest) (result *admissioncontroller.Result, err error) {
+		observerMode := isObserver() // Read once, a reload must not change the mode in the middle of a request
 		var username string
 		if usernames, ok := r.UserInfo.Extra["username"]; ok && len(usernames) > 0 {
 			username = usernames[0]
 		}
 		startTime := time.Now()
+		var violations []admissioncontroller.Violation
+		var checks []string // IDs of the checks which ran
+		defer func() {
+			auditDecision(ctx, r, observerMode, startTime, result, err)
+		}()
 
 		logFields := log.Fields{
 			"k8s_id":           utils.GetK8SId(),
@@ -267,19 +336,19 @@ func validateUpdate() admissioncontroller.AdmitFunc {
 			"user_name":        username,
 			"user_groups":      r.UserInfo.Groups,
 			"request_id":       string(r.UID),
-			"request_type":     "create",
+			"request_type":     utils.RequestType(ctx, r),
 			"target_namespace": r.Namespace,
 			"target_kind":      r.Kind.Kind,
 			"target_name":      r.Name,
 		}
 
-		utils.Log.WithFields(log.Fields{
+		utils.Log.WithContext(ctx).WithFields(log.Fields{
 			"k8s_id":           utils.GetK8SId(),
 			"user_id":          r.UserInfo.Username,
 			"user_name":        username,
 			"user_groups":      r.UserInfo.Groups,
 			"request_id":       string(r.UID),
-			"request_type":     "update",
+			"request_type":     utils.RequestType(ctx, r),
 			"target_namespace": r.Namespace,
 			"target_kind":      r.Kind.Kind,
 			"target_name":      r.Name,
@@ -301,8 +370,11 @@ func validateUpdate() admissioncontroller.AdmitFunc {
 			return &admissioncontroller.Result{Msg: "Internal error: object type assertion failed", Allowed: false}, nil
 		}
 
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		kind := unstructuredObj.GetKind()
-		errorMessages := []string{}
 
 		switch kind {
 		case "Deployment":
@@ -313,15 +385,9 @@ func validateUpdate() admissioncontroller.AdmitFunc {
 				return &admissioncontroller.Result{Msg: "Failed to convert object to deployment", Allowed: false}, nil
 			}
 			utils.DebugLog("Processing a Deployment named %s", deployment.ObjectMeta.Name)
-			if !hasProbes(deployment.Spec.Template.Spec, logFields) {
-				errorMessages = append(errorMessages, fmt.Sprintf("Deployment %s does not have required probes", deployment.ObjectMeta.Name))
-			}
-			if !checkImageLatest(deployment.Spec.Template.Spec, logFields) {
-				errorMessages = append(errorMessages, fmt.Sprintf("Deployment %s uses tag Latest", deployment.ObjectMeta.Name))
-			}
-
-			if !checkImagePullPolicy(deployment.Spec.Template.Spec, logFields) {
-				errorMessages = append(errorMessages, fmt.Sprintf("At least one container of Deployment %s uses imagePullPolicy `Always`", deployment.ObjectMeta.Name))
+			violations, checks, err = runPodChecks(ctx, "Deployment", deployment.Spec.Template.Spec, probesCheck, imageLatestCheck, imagePullPolicyCheck)
+			if err != nil {
+				return nil, err
 			}
 
 		case "StatefulSet":
@@ -332,15 +398,9 @@ func validateUpdate() admissioncontroller.AdmitFunc {
 				return &admissioncontroller.Result{Msg: "Failed to convert object to statefulSet", Allowed: false}, nil
 			}
 			utils.DebugLog("Processing a StatefulSet named %s", statefulSet.ObjectMeta.Name)
-			if !hasProbes(statefulSet.Spec.Template.Spec, logFields) {
-				errorMessages = append(errorMessages, fmt.Sprintf("StatefulSet %s does not have required probes", statefulSet.ObjectMeta.Name))
-			}
-			if !checkImageLatest(statefulSet.Spec.Template.Spec, logFields) {
-				errorMessages = append(errorMessages, fmt.Sprintf("StatefulSet %s uses tag Latest", statefulSet.ObjectMeta.Name))
-			}
-
-			if !checkImagePullPolicy(statefulSet.Spec.Template.Spec, logFields) {
-				errorMessages = append(errorMessages, fmt.Sprintf("At least one container of StatefulSet %s uses imagePullPolicy `Always`", statefulSet.ObjectMeta.Name))
+			violations, checks, err = runPodChecks(ctx, "StatefulSet", statefulSet.Spec.Template.Spec, probesCheck, imageLatestCheck, imagePullPolicyCheck)
+			if err != nil {
+				return nil, err
 			}
 
 		case "Service":
@@ -350,63 +410,18 @@ func validateUpdate() admissioncontroller.AdmitFunc {
 				utils.ErrorLog("Error converting unstructured to service: %s", err)
 				return &admissioncontroller.Result{Msg: "Failed to convert object to service", Allowed: false}, nil
 			}
-			allowed, err := checkServiceType(service, logFields)
+			checkStart := time.Now()
+			serviceViolations, err := checkServiceType(service)
+			utils.ObserveCheckDuration(CheckServiceNodePort, kind, time.Since(checkStart))
 			if err != nil {
 				return nil, err
 			}
-			if !allowed {
-				errorMessages = append(errorMessages, fmt.Sprintf("Service %s is of a type NodePort, which is restricted", service.ObjectMeta.Name))
-			} // TODO Maybe remake all the checks to also provide err (?)
+			violations, checks = append(violations, serviceViolations...), []string{CheckServiceNodePort} // TODO Maybe remake all the checks to also provide err (?)
 
 		default:
 			utils.ErrorLog("Unhandled or unknown resource type: %s", kind)
 			return &admissioncontroller.Result{Msg: "Unhandled resource type", Allowed: false}, nil
 		}
-		elapsedTime := time.Since(startTime)
-
-		if len(errorMessages) > 0 {
-			formattedMessages := "- " + strings.Join(errorMessages, ";\n- ")
-			updateTimeMetrics(startTime, r, "denied")
-
-			utils.Log.WithFields(log.Fields{
-				"k8s_id":           utils.GetK8SId(),
-				"user_id":          r.UserInfo.Username,
-				"user_name":        username,
-				"user_groups":      r.UserInfo.Groups,
-				"request_id":       string(r.UID),
-				"request_type":     "update",
-				"target_namespace": r.Namespace,
-				"target_kind":      r.Kind.Kind,
-				"target_name":      r.Name,
-				"admission_result": "denied",
-				"admission_reason": strings.Join(errorMessages, "; "),
-				"processing_time":  elapsedTime.String(),
-				"observer_mode":    observerMode,
-			}).Error("Admission denied")
-
-			return &admissioncontroller.Result{
-				Msg:     "\n" + formattedMessages,
-				Allowed: false,
-			}, nil
-		}
-		updateTimeMetrics(startTime, r, "allowed")
-
-		utils.Log.WithFields(log.Fields{
-			"k8s_id":           utils.GetK8SId(),
-			"user_id":          r.UserInfo.Username,
-			"user_name":        username,
-			"user_groups":      r.UserInfo.Groups,
-			"request_id":       string(r.UID),
-			"request_type":     "update",
-			"target_namespace": r.Namespace,
-			"target_kind":      r.Kind.Kind,
-			"target_name":      r.Name,
-			"admission_result": "allowed",
-			"admission_reason": "all checks passed or observer mode is on",
-			"processing_time":  elapsedTime.String(),
-			"observer_mode":    observerMode,
-		}).Info("Admission allowed")
-
-		return &admissioncontroller.Result{Allowed: true}, nil
+		return decide(ctx, r, observerMode, startTime, logFields, checks, violations), nil
 	}
 }
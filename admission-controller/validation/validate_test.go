@@ -0,0 +1,88 @@
+package validation
+
+import (
+	"admissioncontroller/utils"
+	"admissioncontroller/utils/audittest"
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// deploymentWithoutProbes has two containers without probes, one of them with the latest tag
+const deploymentWithoutProbes = `{
+	"apiVersion": "apps/v1",
+	"kind": "Deployment",
+	"metadata": {"name": "web", "namespace": "would-deny"},
+	"spec": {"template": {"spec": {"containers": [
+		{"name": "app", "image": "app:1.0"},
+		{"name": "sidecar", "image": "proxy:latest"}
+	]}}}
+}`
+
+func createRequest(object string) *v1.AdmissionRequest {
+	return &v1.AdmissionRequest{
+		UID:       "test",
+		Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+		Namespace: "would-deny",
+		Name:      "web",
+		Operation: v1.Create,
+		Object:    runtime.RawExtension{Raw: []byte(object)},
+	}
+}
+
+func TestObserverModeCountsViolations(t *testing.T) {
+	for _, observer := range []bool{true, false} {
+		label := "false"
+		if observer {
+			label = "true"
+		}
+		wouldDeny := utils.WouldDeny.WithLabelValues("would-deny", "Deployment", "CREATE", label, utils.GetK8SId())
+		probes := utils.Violations.WithLabelValues(CheckProbes, "error", "would-deny", "Deployment", "CREATE", label, utils.GetK8SId())
+		before, probesBefore := testutil.ToFloat64(wouldDeny), testutil.ToFloat64(probes)
+
+		result, err := validateCreate(func() bool { return observer })(context.Background(), createRequest(deploymentWithoutProbes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Allowed != observer {
+			t.Errorf("observer mode %v: allowed = %v", observer, result.Allowed)
+		}
+		if got := testutil.ToFloat64(wouldDeny) - before; got != 1 {
+			t.Errorf("observer mode %v: would_deny_total increased by %v, want 1", observer, got)
+		}
+		if got := testutil.ToFloat64(probes) - probesBefore; got != 2 {
+			t.Errorf("observer mode %v: probes violations increased by %v, want 2", observer, got)
+		}
+	}
+}
+
+func TestObserverModeReportsViolations(t *testing.T) {
+	sink := audittest.Install(t)
+
+	for _, step := range []struct {
+		observer bool
+		result   string
+	}{
+		{true, utils.AuditAllowedObserver},
+		{false, utils.AuditDenied},
+	} {
+		result, err := validateCreate(func() bool { return step.observer })(context.Background(), createRequest(deploymentWithoutProbes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Two containers without probes and one with the latest tag
+		if len(result.Violations) != 3 {
+			t.Errorf("observer mode %v: got %d violations, want 3", step.observer, len(result.Violations))
+		}
+
+		events := sink.Events()
+		event := events[len(events)-1]
+		if event.Result != step.result || len(event.Violations) != 3 || event.Reason == "" {
+			t.Errorf("observer mode %v: audit event %s %q with %d violations", step.observer, event.Result, event.Reason, len(event.Violations))
+		}
+	}
+}
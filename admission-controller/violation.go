@@ -0,0 +1,35 @@
+package admissioncontroller
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Severities of a violation
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Violation is a single failed check of an admission request
+type Violation struct {
+	CheckID     string `json:"check_id"`
+	Severity    string `json:"severity"`
+	Container   string `json:"container,omitempty"`
+	FieldPath   string `json:"field_path,omitempty"` // Path in the object, e.g. spec.template.spec.containers[0].image
+	Message     string `json:"message"`
+	Remediation string `json:"remediation,omitempty"` // How to fix it
+}
+
+// FormatViolations renders violations as a list for the admission response
+func FormatViolations(violations []Violation) string {
+	lines := make([]string, 0, len(violations))
+	for _, v := range violations {
+		line := "- " + v.Message
+		if v.Remediation != "" {
+			line += fmt.Sprintf(" (%s)", v.Remediation)
+		}
+		lines = append(lines, line)
+	}
+	return "\n" + strings.Join(lines, ";\n")
+}